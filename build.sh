@@ -1,5 +1,5 @@
 #!/bin/sh
-echo "==> Go get all"
-go get all
+echo "==> Go mod download"
+go mod download
 echo "==> Make it"
 make
@@ -0,0 +1,73 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/araujobsd/cli-example/utils"
+)
+
+func help() {
+	fmt.Println("[attach_image] - Attach a jpeg, png or gif image file to a product")
+}
+
+func do(cmd []string) {
+	if len(cmd) > 0 && cmd[0] == "-h" {
+		help()
+	}
+
+	if len(cmd) < 3 {
+		fmt.Println("Error - You need to specify username, id and the image file")
+		help()
+	} else {
+		user := cmd[0]
+		id, _ := strconv.Atoi(cmd[1])
+		err := utils.AttachImage(user, id, cmd[2])
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("Success")
+		}
+	}
+}
+
+func main() {
+	err := utils.Startup()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	args := os.Args[1:]
+	do(args)
+}
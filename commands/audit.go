@@ -0,0 +1,86 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/araujobsd/cli-example/utils"
+)
+
+func help() {
+	fmt.Println("[audit] - Query or verify the audit log of the shell")
+}
+
+func do(cmd []string) {
+	if len(cmd) > 0 && cmd[0] == "-h" {
+		help()
+	}
+
+	page, cmd, err := utils.ParsePage(cmd)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	q, cmd, err := utils.ParseAuditQuery(cmd)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if len(cmd) < 1 {
+		fmt.Println("Error - You need to specify an username")
+		help()
+	} else if len(cmd) > 1 && cmd[1] == "verify" {
+		n, err := utils.VerifyAudit(cmd[0])
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println(fmt.Sprintf("Audit log is intact, %d records", n))
+		}
+	} else {
+		err = utils.PrintAudit(cmd[0], q, page)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func main() {
+	err := utils.Startup()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	args := os.Args[1:]
+	do(args)
+}
@@ -32,7 +32,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/araujobsd/cli-example/utils"
@@ -53,30 +52,54 @@ func do(cmd []string) {
 		help()
 	}
 
+	changes, cmd, err := utils.ParseAttributes(cmd)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	if len(cmd) < 5 {
 		fmt.Println("Error - Some items missing")
 		help()
 	} else {
-		product.Id = utils.LastProductId()
 		product.Username = cmd[0]
 		product.Title = cmd[1]
 		product.Description = cmd[2]
-		product.Price, _ = strconv.Atoi(cmd[3])
 		product.Category = cmd[4]
+		changes.Apply(&product)
+
+		price, err := utils.ParseMoney(cmd[3])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		product.Price = price
 
 		t := time.Now()
 		product.CreatedAt = t.Format(timeFormat)
 
-		err := utils.WriteCSVProduct(product)
+		err = utils.ValidateProduct(product)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		id, err := utils.CreateCSVProduct(product)
 		if err != nil {
 			fmt.Println(err)
 		} else {
-			fmt.Println(product.Id)
+			fmt.Println(id)
 		}
 	}
 }
 
 func main() {
+	err := utils.Startup()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	args := os.Args[1:]
 	do(args)
 }
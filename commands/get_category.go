@@ -41,21 +41,27 @@ func help() {
 }
 
 func do(cmd []string) {
-	var err error
 	if len(cmd) > 0 && cmd[0] == "-h" {
 		help()
 	}
 
+	page, cmd, err := utils.ParsePage(cmd)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	filter, cmd, err := utils.ParseFilter(cmd)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	if len(cmd) < 2 {
 		fmt.Println("Error - You need to specify username and category")
 		help()
-	} else if len(cmd) >= 4 {
-		if cmd[2] == "sort_price" || cmd[2] == "sort_time" &&
-			cmd[3] == "dsc" || cmd[3] == "asc" {
-			err = utils.GetCSVCategory(cmd[0], cmd[1], cmd[2], cmd[3])
-		}
 	} else {
-		err = utils.GetCSVCategory(cmd[0], cmd[1])
+		err = utils.GetCSVCategory(cmd[0], cmd[1], filter, page)
 	}
 
 	if err != nil {
@@ -64,6 +70,12 @@ func do(cmd []string) {
 }
 
 func main() {
+	err := utils.Startup()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	args := os.Args[1:]
 	do(args)
 }
@@ -58,6 +58,12 @@ func do(cmd []string) {
 }
 
 func main() {
+	err := utils.Startup()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	args := os.Args[1:]
 	do(args)
 }
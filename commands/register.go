@@ -46,7 +46,7 @@ func do(cmd []string) {
 	} else if len(cmd) > 0 {
 		err := utils.WriteCSVUser(cmd[0])
 		if err != nil {
-			fmt.Println("Error - user already exists")
+			fmt.Println(err)
 		} else {
 			fmt.Println("Success")
 		}
@@ -56,6 +56,12 @@ func do(cmd []string) {
 }
 
 func main() {
+	err := utils.Startup()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	args := os.Args[1:]
 	do(args)
 }
@@ -57,6 +57,12 @@ func do(cmd []string) {
 }
 
 func main() {
+	err := utils.Startup()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	args := os.Args[1:]
 	do(args)
 }
@@ -0,0 +1,5 @@
+module github.com/araujobsd/cli-example
+
+go 1.12
+
+require golang.org/x/text v0.14.0
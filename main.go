@@ -33,9 +33,10 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"regexp"
+	"os/user"
 	"strings"
 
 	"github.com/araujobsd/cli-example/utils"
@@ -48,13 +49,29 @@ const (
 
 var (
 	prompt = utils.SetPrompt()
+
+	// actor - The user the shell runs as, the login user until su
+	actor = loginUser()
 )
 
+func loginUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+// audit - Record a command in the audit log
+func audit(pid int, args []string, outcome string) {
+	err := utils.AppendAudit(pid, actor, args[0], args[1:], outcome)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
 func runCommand(commandStr string) error {
-	commandStr = strings.TrimSuffix(strings.ToLower(commandStr), "\n")
-	commandStr = strings.TrimSuffix(commandStr, "\n")
-	rgx := regexp.MustCompile("'.*?'|\".*?\"|\\S+")
-	argCommandStr := rgx.FindAllString(commandStr, -1)
+	argCommandStr := utils.SplitCommand(commandStr)
 
 	if len(argCommandStr) <= 0 {
 		return nil
@@ -62,35 +79,51 @@ func runCommand(commandStr string) error {
 
 	switch argCommandStr[0] {
 	case "help":
+		audit(os.Getpid(), argCommandStr, "ok")
 	case "exit":
+		audit(os.Getpid(), argCommandStr, "ok")
 		if prompt != thecarousell {
 			prompt = thecarousell
+			actor = loginUser()
 			return nil
 		}
 		os.Exit(0)
 	case "su":
 		if len(argCommandStr) < 2 {
-			return errors.New("You need to specify the username")
+			err := errors.New("You need to specify the username")
+			audit(os.Getpid(), argCommandStr, "failed "+err.Error())
+			return err
 		}
 
 		if prompt != thecarousell {
-			return errors.New("You need to be super user")
+			err := errors.New("You need to be super user")
+			audit(os.Getpid(), argCommandStr, "failed "+err.Error())
+			return err
 		}
+		audit(os.Getpid(), argCommandStr, "ok")
 		prompt = utils.SetPrompt(argCommandStr[1])
+		actor = argCommandStr[1]
 		return nil
 	default:
 		if len(argCommandStr) > 0 {
 			cmd := []string{argCommandStr[0]}
 			fcmd, err := utils.FindCmd(cmd)
 			if err != nil {
+				audit(os.Getpid(), argCommandStr, "failed "+err.Error())
 				return err
 			}
 
+			outcome := &utils.Outcome{}
 			runCmd := exec.Command(fcmd, argCommandStr[1:]...)
 			runCmd.Stderr = os.Stderr
-			runCmd.Stdout = os.Stdout
+			runCmd.Stdout = io.MultiWriter(os.Stdout, outcome)
 
 			err = runCmd.Run()
+			pid := os.Getpid()
+			if runCmd.Process != nil {
+				pid = runCmd.Process.Pid
+			}
+			audit(pid, argCommandStr, outcome.Result(err))
 			if err != nil {
 				return err
 			}
@@ -109,6 +142,10 @@ func main() {
 	fmt.Fprintln(os.Stdout, banner)
 
 	for {
+		// The unread messages of the user are counted again every time
+		if prompt != thecarousell {
+			prompt = utils.SetPrompt(actor)
+		}
 		fmt.Print(prompt)
 
 		cmdString, err := reader.ReadString('\n')
@@ -0,0 +1,320 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// attrSep - Separates the key=value attributes of an item row
+	attrSep = ";"
+
+	// tagSep - Separates the tags of an item row
+	tagSep = ","
+)
+
+var (
+	ErrATTR = errors.New("Error - Invalid attribute, use --attr key=value with a key of " +
+		"letters, digits, _ or - and a value without | or ;")
+	ErrTAGN = errors.New("Error - Invalid tag, it cannot be empty or contain |, ; or ,")
+)
+
+// AttrChanges - Attributes and tags given to CREATE_LISTING or
+//               UPDATE_LISTING by --attr key=value, --tag and --untag.
+//               An empty value removes the attribute.
+type AttrChanges struct {
+	set   map[string]string
+	tags  []string
+	untag []string
+}
+
+// attrFilter - Attributes and tags a listing must have to match, a key
+//              without a value only asks for the attribute to be set
+type attrFilter struct {
+	attrs map[string]string
+	tags  []string
+}
+
+// attrKey - Check an attribute key and return its normal form
+func attrKey(key string) (string, error) {
+	key = strings.ToLower(strings.TrimSpace(trimQuotes(key)))
+	if len(key) == 0 {
+		return "", ErrATTR
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '_' && r != '-' {
+			return "", ErrATTR
+		}
+	}
+
+	return key, nil
+}
+
+// parseAttr - Split key=value, the value may be empty
+func parseAttr(pair string) (key string, value string, err error) {
+	kv := strings.SplitN(trimQuotes(pair), "=", 2)
+	key, err = attrKey(kv[0])
+	if err != nil || len(kv) < 2 {
+		return key, "", ErrATTR
+	}
+
+	value = strings.Join(strings.Fields(kv[1]), " ")
+	if strings.ContainsAny(value, "|"+attrSep) {
+		return key, "", ErrATTR
+	}
+
+	return key, value, nil
+}
+
+// parseTags - Split a comma separated list of tags into their normal form
+func parseTags(list string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.Split(trimQuotes(list), tagSep) {
+		tag = categoryKey(tag)
+		if len(tag) == 0 || strings.ContainsAny(tag, "|"+attrSep) {
+			return nil, ErrTAGN
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, nil
+}
+
+// encodeAttributes - Format attributes for an item row, sorted by key
+func encodeAttributes(attrs map[string]string) string {
+	var keys []string
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+attrs[key])
+	}
+
+	return strings.Join(pairs, attrSep)
+}
+
+// decodeAttributes - Parse the attributes of an item row
+func decodeAttributes(entry string) map[string]string {
+	if len(entry) == 0 {
+		return nil
+	}
+
+	attrs := make(map[string]string)
+	for _, pair := range strings.Split(entry, attrSep) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			attrs[kv[0]] = kv[1]
+		}
+	}
+
+	return attrs
+}
+
+// encodeTags - Format tags for an item row, sorted
+func encodeTags(tags []string) string {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+
+	return strings.Join(sorted, tagSep)
+}
+
+// decodeTags - Parse the tags of an item row
+func decodeTags(entry string) []string {
+	if len(entry) == 0 {
+		return nil
+	}
+
+	return strings.Split(entry, tagSep)
+}
+
+func hasTag(product ProductListing, tag string) bool {
+	for _, t := range product.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseAttributes - Take --attr key=value, --tag and --untag out of the
+//                   arguments of CREATE_LISTING and UPDATE_LISTING
+func ParseAttributes(args []string) (changes AttrChanges, rest []string, err error) {
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		if flag != "--attr" && flag != "--tag" && flag != "--untag" {
+			rest = append(rest, flag)
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return changes, nil, fmt.Errorf("Error - Missing value for %s", flag)
+		}
+		value := args[i+1]
+		i++
+
+		switch flag {
+		case "--attr":
+			key, value, err := parseAttr(value)
+			if err != nil {
+				return changes, nil, err
+			}
+			if changes.set == nil {
+				changes.set = make(map[string]string)
+			}
+			changes.set[key] = value
+		case "--tag", "--untag":
+			tags, err := parseTags(value)
+			if err != nil {
+				return changes, nil, err
+			}
+			if flag == "--tag" {
+				changes.tags = append(changes.tags, tags...)
+			} else {
+				changes.untag = append(changes.untag, tags...)
+			}
+		}
+	}
+
+	return changes, rest, nil
+}
+
+// empty - Check if no attribute nor tag is changed
+func (changes AttrChanges) empty() bool {
+	return len(changes.set) == 0 && len(changes.tags) == 0 && len(changes.untag) == 0
+}
+
+// Apply - Set and remove the attributes and tags of a product
+func (changes AttrChanges) Apply(product *ProductListing) {
+	attrs := make(map[string]string)
+	for key, value := range product.Attributes {
+		attrs[key] = value
+	}
+	for key, value := range changes.set {
+		if len(value) == 0 {
+			delete(attrs, key)
+		} else {
+			attrs[key] = value
+		}
+	}
+	product.Attributes = attrs
+
+	untag := make(map[string]bool)
+	for _, tag := range changes.untag {
+		untag[tag] = true
+	}
+	var tags []string
+	for _, tag := range append(append([]string{}, product.Tags...), changes.tags...) {
+		if !untag[tag] {
+			untag[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	product.Tags = tags
+}
+
+// checkAttributes - Check a listing has the attributes its category and
+//                   the categories above it require
+func checkAttributes(product ProductListing) error {
+	tax := loadTaxonomy()
+	c, err := tax.resolve(product.Category)
+	if err != nil {
+		return nil
+	}
+
+	var missing []string
+	for _, key := range tax.required(c) {
+		if len(product.Attributes[key]) == 0 {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Error - Category %s requires the attributes %s, use --attr key=value",
+			tax.path(c), strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// add - Add the condition of an --attr key[=value] or --tag flag
+func (f *attrFilter) add(flag string, value string) error {
+	if flag == "--tag" {
+		tags, err := parseTags(value)
+		f.tags = append(f.tags, tags...)
+		return err
+	}
+
+	var key, want string
+	var err error
+	if strings.Contains(value, "=") {
+		key, want, err = parseAttr(value)
+	} else {
+		key, err = attrKey(value)
+	}
+	if err != nil {
+		return err
+	}
+	if f.attrs == nil {
+		f.attrs = make(map[string]string)
+	}
+	f.attrs[key] = want
+
+	return nil
+}
+
+// match - Check a product has every attribute and tag of the filter
+func (f attrFilter) match(product ProductListing) bool {
+	for key, value := range f.attrs {
+		have, ok := product.Attributes[key]
+		if !ok || (len(value) > 0 && !strings.EqualFold(have, value)) {
+			return false
+		}
+	}
+	for _, tag := range f.tags {
+		if !hasTag(product, tag) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// empty - Check if the filter has no condition
+func (f attrFilter) empty() bool {
+	return len(f.attrs) == 0 && len(f.tags) == 0
+}
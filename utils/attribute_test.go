@@ -0,0 +1,188 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAttributes(t *testing.T) {
+	changes, rest, err := ParseAttributes([]string{"id", "--attr", "'Condition=  Like   new '",
+		"--tag", "'Vintage, Boxed'", "--untag", "film", "--attr", "color=", "90"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rest, []string{"id", "90"}) {
+		t.Errorf("rest = %q", rest)
+	}
+	if !reflect.DeepEqual(changes.set, map[string]string{"condition": "Like new", "color": ""}) {
+		t.Errorf("attributes = %v", changes.set)
+	}
+	if !reflect.DeepEqual(changes.tags, []string{"vintage", "boxed"}) ||
+		!reflect.DeepEqual(changes.untag, []string{"film"}) {
+		t.Errorf("tags = %q, untag = %q", changes.tags, changes.untag)
+	}
+
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"--attr", "bad key=x"}, ErrATTR},
+		{[]string{"--attr", "color"}, ErrATTR},
+		{[]string{"--attr", "color=red;blue"}, ErrATTR},
+		{[]string{"--attr", "=red"}, ErrATTR},
+		{[]string{"--tag", "a|b"}, ErrTAGN},
+		{[]string{"--tag", "a,,b"}, ErrTAGN},
+	}
+	for _, tt := range tests {
+		if _, _, err := ParseAttributes(tt.args); err != tt.err {
+			t.Errorf("ParseAttributes(%q) = %v, want %v", tt.args, err, tt.err)
+		}
+	}
+	if _, _, err := ParseAttributes([]string{"--tag"}); err == nil {
+		t.Errorf("flag without value accepted")
+	}
+}
+
+func TestApplyAttributes(t *testing.T) {
+	product := ProductListing{Attributes: map[string]string{"color": "black", "size": "m"},
+		Tags: []string{"film", "retro"}}
+	changes, _, err := ParseAttributes([]string{"--attr", "color=", "--attr", "brand=acme",
+		"--tag", "vintage,retro", "--untag", "film"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := encodeAttributes(product.Attributes)
+	changes.Apply(&product)
+	if got := encodeAttributes(product.Attributes); got != "brand=acme;size=m" {
+		t.Errorf("attributes = %s", got)
+	}
+	if got := encodeTags(product.Tags); got != "retro,vintage" {
+		t.Errorf("tags = %s", got)
+	}
+	if before != "color=black;size=m" {
+		t.Errorf("apply changed the attributes it was given: %s", before)
+	}
+	if changes.empty() || !(AttrChanges{}).empty() {
+		t.Errorf("empty() wrong for changes %v", changes)
+	}
+}
+
+func TestEncodeAttributes(t *testing.T) {
+	attrs := map[string]string{"size": "m", "brand": "acme corp"}
+	entry := encodeAttributes(attrs)
+	if entry != "brand=acme corp;size=m" {
+		t.Errorf("encoded = %s", entry)
+	}
+	if got := decodeAttributes(entry); !reflect.DeepEqual(got, attrs) {
+		t.Errorf("decoded = %v", got)
+	}
+	if decodeAttributes("") != nil || decodeTags("") != nil {
+		t.Errorf("empty entries decode to values")
+	}
+	if got := decodeTags(encodeTags([]string{"b", "a"})); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("tags = %q", got)
+	}
+}
+
+func TestRequiredAttributes(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	manageCategories(t,
+		[]string{"add", "Electronics"},
+		[]string{"add", "Phones", "electronics"},
+		[]string{"require", "electronics", "Brand"},
+		[]string{"require", "phones", "condition,brand"})
+
+	if err := ManageCategory(adminUser, "require", []string{"phones", "bad key"}); err != ErrATTR {
+		t.Errorf("require a bad key: %v, want %v", err, ErrATTR)
+	}
+
+	product := ProductListing{Username: "user1", Title: "Old phone", Description: "Works",
+		Price: Money{Amount: 5000, Currency: DefaultCurrency}, Category: "phones",
+		CreatedAt: time.Now().Format(timeFormat)}
+	_, err := CreateCSVProduct(product)
+	if err == nil || !strings.Contains(err.Error(), "Electronics > Phones requires the attributes brand, condition") {
+		t.Errorf("create without the attributes: %v", err)
+	}
+
+	product.Attributes = map[string]string{"brand": "acme", "condition": "used"}
+	id, err := CreateCSVProduct(product)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UpdateCSVItem("user1", id, []string{"user1", "id", "--attr", "brand="})
+	if err == nil || !strings.Contains(err.Error(), "requires the attributes brand") {
+		t.Errorf("update dropping a required attribute: %v", err)
+	}
+	updateListing(t, "user1", id, "--attr", "color=black")
+
+	// Lifting the requirement lets the attribute go
+	manageCategories(t, []string{"require", "phones"}, []string{"require", "electronics"})
+	updateListing(t, "user1", id, "--attr", "brand=")
+	if p := getListing(t, id); p.Attributes["brand"] != "" || p.Attributes["color"] != "black" {
+		t.Errorf("attributes = %v", p.Attributes)
+	}
+}
+
+func TestAttrFilter(t *testing.T) {
+	product := ProductListing{Attributes: map[string]string{"color": "Black", "brand": "acme"},
+		Tags: []string{"retro", "vintage"}}
+
+	tests := []struct {
+		flags [][2]string
+		match bool
+	}{
+		{nil, true},
+		{[][2]string{{"--attr", "color=black"}}, true},
+		{[][2]string{{"--attr", "color"}, {"--tag", "vintage"}}, true},
+		{[][2]string{{"--attr", "color=red"}}, false},
+		{[][2]string{{"--attr", "size"}}, false},
+		{[][2]string{{"--tag", "retro,boxed"}}, false},
+	}
+	for _, tt := range tests {
+		var f attrFilter
+		for _, flag := range tt.flags {
+			if err := f.add(flag[0], flag[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := f.match(product); got != tt.match {
+			t.Errorf("filter %q matched %v, want %v", tt.flags, got, tt.match)
+		}
+		if f.empty() != (len(tt.flags) == 0) {
+			t.Errorf("filter %q empty %v", tt.flags, f.empty())
+		}
+	}
+}
@@ -0,0 +1,431 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	auditPath = "/tmp/audit.log"
+
+	ErrAUDT = errors.New("Error - audit log has been tampered with")
+
+	// listingCommands - Commands whose argument after the user is the ID
+	//                   of a listing
+	listingCommands = map[string]bool{
+		"get_listing": true, "update_listing": true, "delete_listing": true,
+		"restore_listing": true, "purge": true, "attach_image": true,
+		"detach_image": true, "listing_history": true, "listing_diff": true,
+		"revert_listing": true, "mark_sold": true, "reserve": true,
+		"relist": true, "archive": true, "watch": true, "unwatch": true,
+		"make_offer": true, "list_offers": true, "send_message": true,
+		"thread": true, "review": true,
+	}
+)
+
+// auditRecord - A command run by the shell. Each record hashes the hash
+//               of the previous one with its own fields, so changing or
+//               dropping a record breaks the hashes of all that follow.
+type auditRecord struct {
+	seq     int
+	hash    string
+	at      string
+	pid     int
+	actor   string
+	command string
+	outcome string
+	args    string
+}
+
+func (r auditRecord) body() string {
+	return fmt.Sprintf("%d|%s|%d|%s|%s|%s|%s", r.seq, r.at, r.pid,
+		r.actor, r.command, r.outcome, r.args)
+}
+
+// chain - The hash of the record after the record hashed as prev
+func (r auditRecord) chain(prev string) string {
+	sum := sha256.Sum256([]byte(prev + "|" + r.body()))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r auditRecord) encode() []string {
+	return []string{fmt.Sprintf("%d|%s|%s|%d|%s|%s|%s|%s", r.seq, r.hash,
+		r.at, r.pid, r.actor, r.command, r.outcome, r.args)}
+}
+
+func decodeAuditRecord(line []string) (auditRecord, error) {
+	splEntry := strings.SplitN(line[0], "|", 8)
+	if len(line) != 1 || len(splEntry) != 8 {
+		return auditRecord{}, ErrAUDT
+	}
+
+	seq, err := strconv.Atoi(splEntry[0])
+	if err != nil {
+		return auditRecord{}, ErrAUDT
+	}
+	pid, err := strconv.Atoi(splEntry[3])
+	if err != nil {
+		return auditRecord{}, ErrAUDT
+	}
+
+	return auditRecord{seq: seq, hash: splEntry[1], at: splEntry[2], pid: pid,
+		actor: splEntry[4], command: splEntry[5], outcome: splEntry[6],
+		args: splEntry[7]}, nil
+}
+
+// readAudit - Read every record of the audit log
+func readAudit() ([]auditRecord, error) {
+	var records []auditRecord
+
+	file, err := os.Open(auditPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, ErrAUDT
+	}
+
+	for _, line := range lines {
+		record, err := decodeAuditRecord(line)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// auditHead - The seq and hash of the last record, anchored in the
+//             metadata file so a new record does not read the whole log
+//             and a log removed or cut short is noticed. ok is false when
+//             no record was anchored yet.
+func auditHead() (seq int, hash string, ok bool) {
+	splEntry := strings.SplitN(readMeta()["audit"], "|", 2)
+	seq, err := strconv.Atoi(splEntry[0])
+	if err != nil || len(splEntry) != 2 {
+		return 0, "", false
+	}
+
+	return seq, splEntry[1], true
+}
+
+// walkAudit - Check the hash chain of the records, returns the last seq
+//             and hash or the first record that does not match
+func walkAudit(records []auditRecord) (int, string, error) {
+	prev := ""
+	for i, r := range records {
+		if r.seq != i+1 || r.hash != r.chain(prev) {
+			return i, prev, fmt.Errorf("%s at record %d", ErrAUDT, i+1)
+		}
+		prev = r.hash
+	}
+
+	return len(records), prev, nil
+}
+
+// writeAudit - Chain a record to the one hashed as prev, append it to the
+//              log and anchor it, returns its hash
+func writeAudit(r auditRecord, prev string) (string, error) {
+	r.hash = r.chain(prev)
+
+	file, err := os.OpenFile(auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write(r.encode())
+	w.Flush()
+	if err = w.Error(); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return r.hash, setMeta("audit", fmt.Sprintf("%d|%s", r.seq, r.hash))
+}
+
+// AppendAudit - Record a command run by the shell, who ran it, in which
+//               process, with which arguments and how it went. A log
+//               without an anchor whose chain holds is anchored again,
+//               behind a record that says so.
+func AppendAudit(pid int, actor string, command string, args []string, outcome string) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := time.Now().Format(timeFormat)
+	seq, prev, ok := auditHead()
+	if !ok && fileSize(auditPath) > 0 {
+		records, err := readAudit()
+		if err == nil {
+			seq, prev, err = walkAudit(records)
+		}
+		if err != nil {
+			return err
+		}
+
+		seq++
+		prev, err = writeAudit(auditRecord{seq: seq, at: now, pid: os.Getpid(),
+			actor: adminUser, command: "audit", outcome: "recovered",
+			args: "anchor lost"}, prev)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = writeAudit(auditRecord{seq: seq + 1, at: now, pid: pid,
+		actor: canonicalUsername(actor), command: command,
+		outcome: strings.Replace(outcome, "|", "/", -1),
+		args:    strings.Join(args, " ")}, prev)
+
+	return err
+}
+
+// VerifyAudit - Walk the hash chain of the audit log, returns how many
+//               records it holds or the first record that does not match
+func VerifyAudit(username string) (int, error) {
+	if !IsAdmin(username) {
+		return 0, ErrPERM
+	}
+
+	records, err := readAudit()
+	if err != nil {
+		return 0, err
+	}
+
+	n, prev, err := walkAudit(records)
+	if err != nil {
+		return n, err
+	}
+
+	seq, hash, ok := auditHead()
+	if (ok || n > 0) && (seq != n || hash != prev) {
+		return n, fmt.Errorf("%s after record %d", ErrAUDT, n)
+	}
+
+	return n, nil
+}
+
+// AuditQuery - Select records of the audit log by user, listing and time
+type AuditQuery struct {
+	user    string
+	listing string
+	since   time.Time
+	until   time.Time
+}
+
+// ParseAuditQuery - Take --user, --listing, --since and --until out of
+//                   the arguments
+func ParseAuditQuery(args []string) (q AuditQuery, rest []string, err error) {
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		if !strings.HasPrefix(flag, "--") {
+			rest = append(rest, flag)
+			continue
+		}
+		if i+1 >= len(args) {
+			return q, nil, ErrBADA
+		}
+		value := trimQuotes(args[i+1])
+		i++
+
+		switch flag {
+		case "--user":
+			q.user = canonicalUsername(value)
+		case "--listing":
+			_, err = strconv.Atoi(value)
+			q.listing = value
+		case "--since":
+			q.since, err = parseDate(value, false)
+		case "--until":
+			q.until, err = parseDate(value, true)
+		default:
+			err = ErrBADA
+		}
+		if err != nil {
+			return q, nil, ErrBADA
+		}
+	}
+
+	return q, rest, nil
+}
+
+// words - The arguments of a record without their quotes
+func (r auditRecord) words() []string {
+	return strings.Fields(trimQuotes(r.args))
+}
+
+// concerns - Whether a record was run by an user or on its behalf, the
+//            first argument of a command is the user it acts for
+func (r auditRecord) concerns(username string) bool {
+	words := r.words()
+	return sameUser(r.actor, username) || (len(words) > 0 && sameUser(words[0], username))
+}
+
+// match - Whether a record is selected by the query
+func (q AuditQuery) match(r auditRecord) bool {
+	if len(q.user) > 0 && !r.concerns(q.user) {
+		return false
+	}
+	if len(q.listing) > 0 {
+		words := r.words()
+		found := r.command == "create_listing" && r.outcome == "ok "+q.listing
+		if listingCommands[r.command] && len(words) > 1 && words[1] == q.listing {
+			found = true
+		}
+		if !found {
+			return false
+		}
+	}
+
+	at, err := time.ParseInLocation(timeFormat, r.at, time.Local)
+	if !q.since.IsZero() && (err != nil || at.Before(q.since)) {
+		return false
+	}
+	if !q.until.IsZero() && (err != nil || at.After(q.until)) {
+		return false
+	}
+
+	return true
+}
+
+// PrintAudit - Show the records of the audit log selected by the query as
+//              seq|time|pid|actor|command arguments|outcome, the admin
+//              sees every record and the users the records that concern
+//              them
+func PrintAudit(username string, q AuditQuery, page Page) error {
+	if !IsUsernameExist(username) {
+		return ErrUNKU
+	}
+
+	records, err := readAudit()
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, r := range records {
+		if (!IsAdmin(username) && !r.concerns(username)) || !q.match(r) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%d|%s|%d|%s|%s|%s", r.seq, r.at,
+			r.pid, r.actor, strings.TrimSpace(r.command+" "+r.args), r.outcome))
+	}
+	if len(lines) == 0 {
+		return errors.New("Error - no audit records found")
+	}
+
+	start, end, next := page.window(len(lines))
+	for _, line := range lines[start:end] {
+		fmt.Println(line)
+	}
+	page.printNext(next)
+
+	return nil
+}
+
+// Outcome - Watch the output of a command for its outcome. Commands print
+//           their errors and exit successfully, so the first line that
+//           starts with Error is taken as the failure.
+type Outcome struct {
+	line   []byte
+	first  string
+	failed string
+	lines  int
+}
+
+// Write - Look at the output a line at a time
+func (o *Outcome) Write(p []byte) (int, error) {
+	o.line = append(o.line, p...)
+	for {
+		i := bytes.IndexByte(o.line, '\n')
+		if i < 0 {
+			break
+		}
+		o.see(string(o.line[:i]))
+		o.line = o.line[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (o *Outcome) see(line string) {
+	line = strings.TrimSpace(line)
+	if o.lines == 0 {
+		o.first = line
+	}
+	o.lines++
+	if len(o.failed) == 0 && strings.HasPrefix(line, "Error") {
+		o.failed = line
+	}
+}
+
+// Result - The outcome of the command given the error it exited with,
+//          ok followed by the ID a command printed alone on success,
+//          as create_listing does, or failed with the reason
+func (o *Outcome) Result(err error) string {
+	if len(o.line) > 0 {
+		o.see(string(o.line))
+		o.line = nil
+	}
+
+	switch {
+	case err != nil:
+		return "failed " + err.Error()
+	case len(o.failed) > 0:
+		return "failed " + strings.TrimPrefix(o.failed, "Error - ")
+	}
+	if _, err := strconv.Atoi(o.first); err == nil && o.lines == 1 {
+		return "ok " + o.first
+	}
+
+	return "ok"
+}
@@ -0,0 +1,213 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendAudit - Record commands the way the shell does, as user1
+func appendAudit(t *testing.T, commands ...string) {
+	t.Helper()
+
+	for _, command := range commands {
+		words := strings.Fields(command)
+		outcome := "ok"
+		if i := strings.Index(command, " => "); i >= 0 {
+			words, outcome = strings.Fields(command[:i]), command[i+4:]
+		}
+		err := AppendAudit(1234, "user1", words[0], words[1:], outcome)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	resetData(t)
+	appendAudit(t, "register user1", "get_listing user1 1", "exit")
+
+	if _, err := VerifyAudit("user1"); err != ErrPERM {
+		t.Errorf("verify by a user: %v, want %v", err, ErrPERM)
+	}
+	if n, err := VerifyAudit("admin"); err != nil || n != 3 {
+		t.Errorf("verified %d: %v, want 3", n, err)
+	}
+
+	// A record changed in place breaks the chain from there
+	records, err := readAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records[1].args = "user1 2"
+	var lines [][]string
+	for _, r := range records {
+		lines = append(lines, r.encode())
+	}
+	if err := writeCSVAtomic(auditPath, lines); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := VerifyAudit("admin"); err == nil || n != 1 {
+		t.Errorf("changed record verified %d: %v", n, err)
+	}
+}
+
+func TestAuditLogRemoved(t *testing.T) {
+	resetData(t)
+	appendAudit(t, "register user1", "exit")
+
+	if err := os.Remove(auditPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyAudit("admin"); err == nil {
+		t.Errorf("removed log verified")
+	}
+
+	// Records written after the removal do not start a new chain
+	appendAudit(t, "register user2")
+	if _, err := VerifyAudit("admin"); err == nil {
+		t.Errorf("log written after the removal verified")
+	}
+}
+
+func TestAuditAnchorLost(t *testing.T) {
+	resetData(t)
+	appendAudit(t, "register user1", "exit")
+
+	if err := setMeta("audit", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyAudit("admin"); err == nil {
+		t.Errorf("log without an anchor verified")
+	}
+
+	// The next command anchors the log again behind a visible record
+	appendAudit(t, "get_listing user1 1")
+	records, err := readAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[2].outcome != "recovered" {
+		t.Fatalf("records after recovery = %v", records)
+	}
+	if n, err := VerifyAudit("admin"); err != nil || n != 4 {
+		t.Errorf("verified %d: %v, want 4", n, err)
+	}
+}
+
+func TestAuditAnchorKeptOnRestore(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	path := testDir + "/backup.tar.gz"
+	if _, err := BackupData("admin", path); err != nil {
+		t.Fatal(err)
+	}
+	appendAudit(t, "backup admin", "get_listing user1 1")
+
+	if _, err := RestoreData("admin", path, true); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := VerifyAudit("admin"); err != nil || n != 2 {
+		t.Errorf("verified %d after restore: %v, want 2", n, err)
+	}
+}
+
+func TestAuditQueryListing(t *testing.T) {
+	resetData(t)
+	appendAudit(t,
+		"create_listing user1 'Phone' 'Black' 100 'Electronics' => ok 3",
+		"get_listing user1 3",
+		"update_listing user1 1 --price 3",
+		"make_offer user2 1 3",
+		"search user1 3",
+		"accept_offer user1 3 => ok 3",
+		"send_message user2 3 hello")
+
+	q, rest, err := ParseAuditQuery([]string{"--listing", "3", "--user", "User1"})
+	if err != nil || len(rest) != 0 || q.user != "user1" {
+		t.Fatalf("query %v, rest %v: %v", q, rest, err)
+	}
+	q.user = ""
+
+	records, err := readAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var matched []string
+	for _, r := range records {
+		if q.match(r) {
+			matched = append(matched, r.command)
+		}
+	}
+	want := "create_listing get_listing send_message"
+	if got := strings.Join(matched, " "); got != want {
+		t.Errorf("--listing 3 matched %q, want %q", got, want)
+	}
+
+	if _, _, err := ParseAuditQuery([]string{"--listing"}); err != ErrBADA {
+		t.Errorf("flag without value: %v, want %v", err, ErrBADA)
+	}
+}
+
+// TestAuditQueryLocalTime - --since and --until are local times, as the
+//                           time of the records
+func TestAuditQueryLocalTime(t *testing.T) {
+	for _, hours := range testZones {
+		func() {
+			defer inZone(hours)()
+
+			resetData(t)
+			appendAudit(t, "register user1")
+			records, err := readAudit()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			before := time.Now().Add(-30 * time.Minute).Format("2006-01-02T15:04")
+			q, _, err := ParseAuditQuery([]string{"--since", before})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !q.match(records[0]) {
+				t.Errorf("UTC%+d: record at %s not since %s", hours, records[0].at, before)
+			}
+			q, _, err = ParseAuditQuery([]string{"--until", before})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.match(records[0]) {
+				t.Errorf("UTC%+d: record at %s until %s", hours, records[0].at, before)
+			}
+		}()
+	}
+}
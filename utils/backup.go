@@ -0,0 +1,542 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// archiveFormat - Layout of the backup archive, bumped when the
+	//                 manifest or the archive entries change. Format 2
+	//                 adds the image blobs.
+	archiveFormat = 2
+
+	manifestName = "manifest.json"
+	backupPrefix = "/tmp/carousell-backup-"
+	backupTime   = "20060102-150405"
+)
+
+var (
+	ErrARCH = errors.New("Error - Invalid backup archive")
+	ErrNEWS = errors.New("Error - The archive has a newer schema than this marketplace")
+	ErrNEMP = errors.New("Error - The marketplace has data, use --force to overwrite it")
+	ErrNBAK = errors.New("Error - Only a backup archive can be restored")
+)
+
+// dataFiles - Files holding the state of the marketplace, the search
+//             index is left out since it is rebuilt from the items
+func dataFiles() []string {
+	return []string{csvUserPath, csvItemsPath, csvTrashPath,
+		csvRevisionsPath, csvRatesPath, csvImportPath, csvWatchPath,
+		csvOffersPath, csvMessagesPath, csvBlocksPath, csvReviewsPath,
+		csvCategoriesPath, csvImagesPath, csvMetaPath}
+}
+
+// manifestFile - A file of the archive, its size and sha256 checksum
+type manifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+	Rows   int    `json:"rows"`
+}
+
+// Manifest - What an archive holds. A backup holds every data file, an
+//            export only the rows of one user.
+type Manifest struct {
+	Format   int            `json:"format"`
+	Schema   int            `json:"schema"`
+	Kind     string         `json:"kind"`
+	Username string         `json:"username,omitempty"`
+	Created  string         `json:"created"`
+	NextId   int            `json:"next_id"`
+	Files    []manifestFile `json:"files"`
+}
+
+// DefaultBackupPath - Archive path used when none is given
+func DefaultBackupPath() string {
+	return backupPrefix + time.Now().Format(backupTime) + ".tar.gz"
+}
+
+// encodeRows - Rows as the bytes of a csv file
+func encodeRows(lines [][]string) []byte {
+	var buf bytes.Buffer
+
+	w := csv.NewWriter(&buf)
+	w.WriteAll(lines)
+
+	return buf.Bytes()
+}
+
+// writeArchive - Write the manifest and the files as a gzip compressed
+//                tar archive, the manifest comes first
+func writeArchive(path string, m *Manifest, files map[string][]byte) error {
+	for _, name := range sortedNames(files) {
+		sum := sha256.Sum256(files[name])
+		var rows [][]string
+		if !isBlobEntry(name) {
+			rows, _ = csv.NewReader(bytes.NewReader(files[name])).ReadAll()
+		}
+		m.Files = append(m.Files, manifestFile{Name: name,
+			Size: int64(len(files[name])), Sha256: hex.EncodeToString(sum[:]),
+			Rows: len(rows)})
+	}
+
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	entries := append([]string{manifestName}, sortedNames(files)...)
+	files[manifestName] = raw
+	for _, name := range entries {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])),
+			ModTime: time.Now()}
+		err = tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = tw.Write(files[name])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(trimQuotes(path), buf.Bytes())
+}
+
+// sortedNames - Names of the files in the order of dataFiles, then the
+//               blobs by name
+func sortedNames(files map[string][]byte) []string {
+	var names, blobs []string
+	for _, path := range dataFiles() {
+		if _, ok := files[filepath.Base(path)]; ok {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	for name := range files {
+		if isBlobEntry(name) {
+			blobs = append(blobs, name)
+		}
+	}
+	sort.Strings(blobs)
+
+	return append(names, blobs...)
+}
+
+// writeFileAtomic - Write data to a temporary file and rename it over path
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// BackupData - Write every data file of the marketplace and the image
+//              blobs to an archive, only the admin can take a backup
+func BackupData(username string, path string) (Manifest, error) {
+	m := Manifest{Format: archiveFormat, Schema: SchemaVersion, Kind: "backup",
+		Created: time.Now().Format(timeFormat)}
+	if !IsAdmin(username) {
+		return m, ErrPERM
+	}
+
+	// The files are read under the data lock, a write cannot land halfway
+	unlock, err := lockData()
+	if err != nil {
+		return m, err
+	}
+	defer unlock()
+
+	nextId, err := LastProductId()
+	if err != nil {
+		return m, err
+	}
+	m.NextId = nextId
+
+	files := make(map[string][]byte)
+	for _, path := range dataFiles() {
+		if path == csvItemsPath && Backend() == BackendKV {
+			entries, err := ReadCSVProduct()
+			if err != nil {
+				return m, err
+			}
+			files[filepath.Base(path)] = encodeRows(entries)
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return m, err
+		}
+		files[filepath.Base(path)] = data
+	}
+	err = readBlobs(loadImages(), files)
+	if err != nil {
+		return m, err
+	}
+
+	return m, writeArchive(path, &m, files)
+}
+
+// ExportData - Write the profile, items, deleted items, revisions and
+//              images of an user to an archive
+func ExportData(username string, path string) (Manifest, error) {
+	m := Manifest{Format: archiveFormat, Schema: SchemaVersion, Kind: "export",
+		Created: time.Now().Format(timeFormat)}
+
+	unlock, err := lockData()
+	if err != nil {
+		return m, err
+	}
+	defer unlock()
+
+	user, ok := FindUser(username)
+	if !ok {
+		return m, ErrUNKU
+	}
+	m.Username = user.Username
+	nextId, err := LastProductId()
+	if err != nil {
+		return m, err
+	}
+	m.NextId = nextId
+
+	products, err := loadProducts()
+	if err != nil {
+		return m, err
+	}
+	owned := make(map[int]bool)
+	var items, trash, revisions [][]string
+	for _, product := range products {
+		if sameUser(product.Username, user.Username) {
+			owned[product.Id] = true
+			items = append(items, []string{productRecord(product)})
+		}
+	}
+	for _, t := range readTrash() {
+		if sameUser(t.product.Username, user.Username) {
+			owned[t.product.Id] = true
+			trash = append(trash, []string{t.deletedAt + "|" + productRecord(t.product)})
+		}
+	}
+	for _, line := range readCSVRows(csvRevisionsPath) {
+		id, _ := strconv.Atoi(strings.SplitN(line[0], "|", 2)[0])
+		if owned[id] {
+			revisions = append(revisions, line)
+		}
+	}
+	var offers [][]string
+	for _, o := range loadOffers() {
+		if owned[o.Listing] || sameUser(o.Buyer, user.Username) {
+			offers = append(offers, []string{offerRecord(o)})
+		}
+	}
+	var messages [][]string
+	for _, m := range loadMessages() {
+		if sameUser(m.from, user.Username) || sameUser(m.to, user.Username) {
+			messages = append(messages, []string{messageRecord(m)})
+		}
+	}
+	var blocks [][]string
+	for _, b := range loadBlocks() {
+		if sameUser(b[0], user.Username) {
+			blocks = append(blocks, []string{b[0] + "|" + b[1]})
+		}
+	}
+	var reviews [][]string
+	for _, r := range loadReviews() {
+		if sameUser(r.buyer, user.Username) || sameUser(r.seller, user.Username) {
+			reviews = append(reviews, []string{reviewRecord(r)})
+		}
+	}
+	var images []listingImage
+	var imageRows [][]string
+	for _, img := range loadImages() {
+		if owned[img.listing] {
+			images = append(images, img)
+			imageRows = append(imageRows, []string{imageRecord(img)})
+		}
+	}
+	var watches [][]string
+	for _, line := range readCSVRows(csvWatchPath) {
+		if sameUser(strings.SplitN(line[0], "|", 2)[0], user.Username) {
+			watches = append(watches, line)
+		}
+	}
+
+	files := map[string][]byte{
+		filepath.Base(csvUserPath):      encodeRows([][]string{userRecord(user)}),
+		filepath.Base(csvItemsPath):     encodeRows(items),
+		filepath.Base(csvTrashPath):     encodeRows(trash),
+		filepath.Base(csvRevisionsPath): encodeRows(revisions),
+		filepath.Base(csvWatchPath):     encodeRows(watches),
+		filepath.Base(csvOffersPath):    encodeRows(offers),
+		filepath.Base(csvMessagesPath):  encodeRows(messages),
+		filepath.Base(csvBlocksPath):    encodeRows(blocks),
+		filepath.Base(csvReviewsPath):   encodeRows(reviews),
+		filepath.Base(csvImagesPath):    encodeRows(imageRows),
+	}
+	err = readBlobs(images, files)
+	if err != nil {
+		return m, err
+	}
+
+	return m, writeArchive(path, &m, files)
+}
+
+// readArchive - Read and validate an archive, every file listed by the
+//               manifest must be there with its size and checksum
+func readArchive(path string) (Manifest, map[string][]byte, error) {
+	var m Manifest
+	files := make(map[string][]byte)
+
+	path = trimQuotes(path)
+	file, err := os.Open(path)
+	if err != nil {
+		return m, nil, fmt.Errorf("Error - Cannot read %s", path)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return m, nil, ErrARCH
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return m, nil, ErrARCH
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return m, nil, ErrARCH
+		}
+		files[hdr.Name] = data
+	}
+
+	raw, ok := files[manifestName]
+	if !ok || json.Unmarshal(raw, &m) != nil {
+		return m, nil, fmt.Errorf("%s, missing %s", ErrARCH, manifestName)
+	}
+	delete(files, manifestName)
+
+	if m.Format < 1 || m.Format > archiveFormat {
+		return m, nil, fmt.Errorf("%s, unknown format %d", ErrARCH, m.Format)
+	}
+	// The archives written before the schema versions say schema 1,
+	// their rows already had the user profiles of schema 2
+	if m.Format == 1 && m.Schema == 1 {
+		m.Schema = 2
+	}
+	if m.Schema > SchemaVersion {
+		return m, nil, ErrNEWS
+	}
+
+	known := make(map[string]bool)
+	for _, path := range dataFiles() {
+		known[filepath.Base(path)] = true
+	}
+	listed := make(map[string]bool)
+	for _, f := range m.Files {
+		data, ok := files[f.Name]
+		if !ok || (!known[f.Name] && !isBlobEntry(f.Name)) {
+			return m, nil, fmt.Errorf("%s, missing %s", ErrARCH, f.Name)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != f.Size || hex.EncodeToString(sum[:]) != f.Sha256 {
+			return m, nil, fmt.Errorf("%s, checksum mismatch on %s", ErrARCH, f.Name)
+		}
+		listed[f.Name] = true
+	}
+	for name := range files {
+		if !listed[name] {
+			return m, nil, fmt.Errorf("%s, unexpected %s", ErrARCH, name)
+		}
+	}
+
+	return m, files, nil
+}
+
+// hasData - Check if any data file of the marketplace holds rows, the
+//           metadata alone is no data
+func hasData() bool {
+	for _, path := range dataFiles() {
+		if path != csvMetaPath && fileSize(path) > 0 {
+			return true
+		}
+	}
+
+	return fileSize(kvItemsPath) > 0
+}
+
+// RestoreData - Replace the data files with the ones of a validated
+//               archive and migrate them to the current schema. Only the
+//               admin can restore and data is only overwritten when forced.
+func RestoreData(username string, path string, force bool) (Manifest, error) {
+	if !IsAdmin(username) {
+		return Manifest{}, ErrPERM
+	}
+
+	unlock, err := lockData()
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer unlock()
+
+	m, files, err := readArchive(path)
+	if err != nil {
+		return m, err
+	}
+	if m.Kind != "backup" {
+		return m, ErrNBAK
+	}
+	if hasData() && !force {
+		return m, ErrNEMP
+	}
+	nextId, err := LastProductId()
+	if err != nil {
+		return m, err
+	}
+	// The audit log is not restored, its anchor stays with it
+	anchor := readMeta()["audit"]
+
+	for _, path := range dataFiles() {
+		data, ok := files[filepath.Base(path)]
+		if ok {
+			err = writeFileAtomic(path, data)
+		} else if err = os.Remove(path); os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+	err = restoreBlobs(files)
+	if err != nil {
+		return m, err
+	}
+	rates = nil
+	err = syncItemStore()
+	if err != nil {
+		return m, err
+	}
+
+	// The pending changes of the journal were made to the replaced data
+	err = os.Remove(journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return m, err
+	}
+
+	// Rows of an older schema are brought up to date by the migrations
+	err = writeSchemaVersion(m.Schema)
+	for i := m.Schema; err == nil && i < SchemaVersion; i++ {
+		_, err = migrations[i].run(true)
+		if err == nil {
+			err = writeSchemaVersion(i + 1)
+		}
+	}
+	if err != nil {
+		return m, err
+	}
+
+	// An ID given before the restore is not given again
+	restored, err := LastProductId()
+	if err != nil {
+		return m, err
+	}
+	for _, id := range []int{m.NextId, restored} {
+		if id > nextId {
+			nextId = id
+		}
+	}
+	err = setMeta("next_id", strconv.Itoa(nextId))
+	if err == nil {
+		err = setMeta("audit", anchor)
+	}
+	if err != nil {
+		return m, err
+	}
+
+	return m, RebuildSearchIndex()
+}
+
+// PrintManifest - Show what an archive holds, one file per line
+func PrintManifest(path string, m Manifest) {
+	fmt.Println(fmt.Sprintf("%s|%s|format %d|schema %d|next id %d|%s",
+		trimQuotes(path), m.Kind, m.Format, m.Schema, m.NextId, m.Created))
+	for _, f := range m.Files {
+		fmt.Println(fmt.Sprintf("%s|%d rows|%d bytes|%s", f.Name, f.Rows, f.Size, f.Sha256))
+	}
+}
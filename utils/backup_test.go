@@ -0,0 +1,139 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	kept := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	deleted := createListing(t, "user1", "Running shoes", "50", "Sports")
+	if err := DeleteCSVItem("user1", deleted); err.Error() != "Success" {
+		t.Fatal(err)
+	}
+
+	// Given quoted by the shell, with its case and a space
+	path := "'" + filepath.Join(testDir, "My Backup.tar.gz") + "'"
+	if _, err := BackupData("user1", path); err != ErrPERM {
+		t.Errorf("backup by an user: %v, want %v", err, ErrPERM)
+	}
+	m, err := BackupData(adminUser, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.NextId != deleted+1 {
+		t.Errorf("next id %d, want %d", m.NextId, deleted+1)
+	}
+
+	if _, err := RestoreData(adminUser, path, false); err != ErrNEMP {
+		t.Errorf("restore over data: %v, want %v", err, ErrNEMP)
+	}
+
+	// Changes made after the backup are gone once it is restored, the
+	// IDs they took are not given again
+	createListing(t, "user1", "Red hat", "5", "Fashion")
+	_, err = beginJournal("user1", JournalCreate, "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := nextId(t)
+
+	if _, err := RestoreData(adminUser, path, true); err != nil {
+		t.Fatal(err)
+	}
+	products := listings(t)
+	if len(products) != 1 || products[0].Id != kept {
+		t.Errorf("restored listings = %v", products)
+	}
+	if trash := readTrash(); len(trash) != 1 || trash[0].product.Id != deleted {
+		t.Errorf("restored trash = %v", trash)
+	}
+	if nextId(t) != next {
+		t.Errorf("next id after restore %d, want %d", nextId(t), next)
+	}
+	if records, _, _ := readJournal(); len(records) != 0 {
+		t.Errorf("journal kept after restore: %v", records)
+	}
+}
+
+func TestRestoreRefusesExport(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	path := filepath.Join(testDir, "user1.tar.gz")
+	if _, err := ExportData("user1", path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreData(adminUser, path, true); err != ErrNBAK {
+		t.Errorf("restore of an export: %v, want %v", err, ErrNBAK)
+	}
+	if len(listings(t)) != 1 {
+		t.Errorf("listings changed by a refused restore")
+	}
+}
+
+func TestRestoreFormatOne(t *testing.T) {
+	resetData(t)
+
+	// Format 1 wrote schema 1 for rows that already had the profiles
+	files := map[string][]byte{
+		filepath.Base(csvUserPath): encodeRows([][]string{userRecord(newUser("user1"))}),
+		filepath.Base(csvItemsPath): encodeRows([][]string{
+			{"1|user1|Camera|Old camera|100 SGD|Electronics|2019-06-01 10:00:00|sold"}}),
+	}
+	path := filepath.Join(testDir, "format1.tar.gz")
+	err := writeArchive(path, &Manifest{Format: 1, Schema: 1, Kind: "backup", NextId: 2}, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := RestoreData(adminUser, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Schema != 2 {
+		t.Errorf("format 1 schema read as %d, want 2", m.Schema)
+	}
+	if readMeta()["schema"] != strconv.Itoa(SchemaVersion) {
+		t.Errorf("schema after restore %q", readMeta()["schema"])
+	}
+	if user, ok := FindUser("user1"); !ok || user.DisplayName != "user1" {
+		t.Errorf("restored user = %v, %v", user, ok)
+	}
+	if p := getListing(t, 1); p.Status != StatusSold {
+		t.Errorf("restored status %q, want %q", p.Status, StatusSold)
+	}
+}
@@ -0,0 +1,124 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrCNF = errors.New("Error - category not found")
+)
+
+// BrowseCSVCategory - Show the items of a category from every seller
+//                     matching the filter, --seller narrows it to one
+func BrowseCSVCategory(category string, filter Filter, page Page) error {
+	var items []ProductListing
+
+	products, err := visibleProducts()
+	if err != nil {
+		return err
+	}
+	products = page.restrict(products)
+	if len(products) == 0 {
+		return ErrPLE
+	}
+
+	inCategory, ok := categoryMatcher(category, filter.descendants)
+	if !ok {
+		category = strings.ToLower(trimQuotes(category))
+		inCategory = func(product ProductListing) bool {
+			return category == strings.ToLower(product.Category)
+		}
+	}
+	for _, product := range products {
+		if inCategory(product) && filter.match(product) {
+			items = append(items, product)
+		}
+	}
+
+	if len(items) == 0 {
+		return ErrCNF
+	}
+
+	sortProducts(items, filter)
+	scores := sellerScores()
+	start, end, next := page.window(len(items))
+	for _, item := range items[start:end] {
+		fmt.Println(listingLine(item) + "|" + scoreOf(scores, item.Username).String())
+	}
+	page.printNext(next)
+
+	return nil
+}
+
+// BrowseCSVTopCategory - Show the categories of all sellers ranked by
+//                        number of active items
+func BrowseCSVTopCategory(page Page) error {
+	top := make(map[string]int)
+
+	products, err := visibleProducts()
+	if err != nil {
+		return err
+	}
+	products = page.restrict(products)
+	if len(products) == 0 {
+		return ErrPLE
+	}
+
+	tax := loadTaxonomy()
+	for _, product := range products {
+		if product.state() == StatusActive {
+			top[strings.ToLower(tax.label(product.Category))]++
+		}
+	}
+
+	categories := make([]string, 0, len(top))
+	for k := range top {
+		categories = append(categories, k)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if top[categories[i]] != top[categories[j]] {
+			return top[categories[i]] > top[categories[j]]
+		}
+		return categories[i] < categories[j]
+	})
+
+	start, end, next := page.window(len(categories))
+	for _, k := range categories[start:end] {
+		fmt.Println(fmt.Sprintf("%s|%d", k, top[k]))
+	}
+	page.printNext(next)
+
+	return nil
+}
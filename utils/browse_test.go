@@ -0,0 +1,110 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"testing"
+)
+
+func TestBrowseAcrossSellers(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2", "user3")
+	createListing(t, "user1", "Phone", "100", "Electronics")
+	createListing(t, "user2", "Laptop", "900", "electronics")
+	createListing(t, "user3", "Shoes", "50", "Sports")
+
+	var err error
+	lines := captureOutput(t, func() {
+		err = BrowseCSVCategory("ELECTRONICS", Filter{}, Page{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || !hasLine(lines, "Phone", "user1") || !hasLine(lines, "Laptop", "user2") {
+		t.Errorf("browse electronics = %q", lines)
+	}
+
+	filter, _, err := ParseFilter([]string{"--seller", "user2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = captureOutput(t, func() {
+		err = BrowseCSVCategory("electronics", filter, Page{})
+	})
+	if err != nil || len(lines) != 1 || !hasLine(lines, "Laptop") {
+		t.Errorf("browse --seller user2 = %q, %v", lines, err)
+	}
+
+	captureOutput(t, func() {
+		err = BrowseCSVCategory("garden", Filter{}, Page{})
+	})
+	if err != ErrCNF {
+		t.Errorf("browse garden: %v, want %v", err, ErrCNF)
+	}
+}
+
+func TestBrowseHidesInactiveSellers(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	createListing(t, "user1", "Phone", "100", "Electronics")
+	createListing(t, "user2", "Laptop", "900", "Electronics")
+
+	err := SetUserActive("user2", "user2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := captureOutput(t, func() {
+		err = BrowseCSVCategory("electronics", Filter{}, Page{})
+	})
+	if err != nil || len(lines) != 1 || hasLine(lines, "Laptop") {
+		t.Errorf("browse with user2 deactivated = %q, %v", lines, err)
+	}
+}
+
+func TestBrowseTopCategory(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	createListing(t, "user1", "Shoes", "50", "Sports")
+	createListing(t, "user1", "Phone", "100", "Electronics")
+	createListing(t, "user2", "Laptop", "900", "electronics")
+
+	var err error
+	lines := captureOutput(t, func() {
+		err = BrowseCSVTopCategory(Page{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"electronics|2", "sports|1"}
+	if len(lines) != len(want) || lines[0] != want[0] || lines[1] != want[1] {
+		t.Errorf("top categories = %q, want %q", lines, want)
+	}
+}
@@ -0,0 +1,578 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// categorySep - Separates the levels of a category path
+	categorySep = ">"
+)
+
+var (
+	csvCategoriesPath = "/tmp/categories.csv"
+
+	ErrCATU = errors.New("Error - Unknown category, see CATEGORY user1")
+	ErrCATA = errors.New("Error - Category name or alias is already in use under the same parent")
+	ErrCATM = errors.New("Error - Category name is in several places of the tree, use its path or ID")
+	ErrCATN = errors.New("Error - Invalid category name, it cannot be empty or contain |, , or >")
+	ErrCATC = errors.New("Error - Cannot move a category under itself")
+
+	// labelTax, labelInfo - The category tree categoryLabel read and the
+	//                       state of its file then
+	labelTax  *taxonomy
+	labelInfo os.FileInfo
+)
+
+// category - A node of the category tree. Its ID never changes, listings
+//            hold it and a merged category is kept to send its ID to the
+//            category it went into. Listings in it must have the required
+//            attributes. Names and aliases are unique among siblings.
+type category struct {
+	id       int
+	parent   int
+	name     string
+	aliases  []string
+	merged   int
+	required []string
+}
+
+// taxonomy - The category tree, empty until the admin adds a category,
+//            then every new listing must be in it
+type taxonomy struct {
+	categories []category
+	byId       map[int]int
+	byKey      map[string][]int
+}
+
+// categoryKey - Normal form of a category name, without quotes, in lower
+//               case and with single spaces
+func categoryKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(trimQuotes(name)), " "))
+}
+
+// parseCategory - Parse a row of the csv category file, each row is
+//                 id|parent|name|alias,alias|merged into|key,key
+func parseCategory(entry string) (category, error) {
+	splEntry := strings.Split(entry, "|")
+	if len(splEntry) != 5 && len(splEntry) != 6 {
+		return category{}, ErrMALF
+	}
+
+	id, err := strconv.Atoi(splEntry[0])
+	if err != nil {
+		return category{}, ErrMALF
+	}
+	parent, _ := strconv.Atoi(splEntry[1])
+	merged, _ := strconv.Atoi(splEntry[4])
+	c := category{id: id, parent: parent, name: splEntry[2], merged: merged}
+	if len(splEntry[3]) > 0 {
+		c.aliases = strings.Split(splEntry[3], ",")
+	}
+	// Rows written before the attribute schemas have no required keys
+	if len(splEntry) == 6 && len(splEntry[5]) > 0 {
+		c.required = strings.Split(splEntry[5], ",")
+	}
+
+	return c, nil
+}
+
+// categoryRecord - Format a category as a row of the csv category file
+func categoryRecord(c category) string {
+	return fmt.Sprintf("%d|%d|%s|%s|%d|%s", c.id, c.parent, c.name,
+		strings.Join(c.aliases, ","), c.merged, strings.Join(c.required, ","))
+}
+
+// loadTaxonomy - Read the category tree from the csv category file
+func loadTaxonomy() *taxonomy {
+	tax := &taxonomy{}
+	for _, line := range readCSVRows(csvCategoriesPath) {
+		c, err := parseCategory(line[0])
+		if err == nil {
+			tax.categories = append(tax.categories, c)
+		}
+	}
+	tax.index()
+
+	return tax
+}
+
+// index - Map the IDs, names and aliases to the categories
+func (tax *taxonomy) index() {
+	tax.byId = make(map[int]int)
+	tax.byKey = make(map[string][]int)
+	for i, c := range tax.categories {
+		tax.byId[c.id] = i
+		if c.merged != 0 {
+			continue
+		}
+		for _, key := range c.keys() {
+			tax.byKey[key] = append(tax.byKey[key], i)
+		}
+	}
+}
+
+// keys - The names and aliases of a category in normal form
+func (c *category) keys() []string {
+	keys := []string{categoryKey(c.name)}
+	for _, alias := range c.aliases {
+		keys = append(keys, categoryKey(alias))
+	}
+
+	return keys
+}
+
+// named - Whether a name or alias of a category is key
+func (c *category) named(key string) bool {
+	for _, k := range c.keys() {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// save - Regenerates the csv category file as a change of the journal
+func (tax *taxonomy) save(actor string) error {
+	var lines [][]string
+	for _, c := range tax.categories {
+		lines = append(lines, []string{categoryRecord(c)})
+	}
+
+	return saveRows(actor, "categories", lines)
+}
+
+// get - A category by ID, following merges
+func (tax *taxonomy) get(id int) (*category, bool) {
+	for seen := 0; seen <= len(tax.categories); seen++ {
+		i, ok := tax.byId[id]
+		if !ok {
+			return nil, false
+		}
+		if tax.categories[i].merged == 0 {
+			return &tax.categories[i], true
+		}
+		id = tax.categories[i].merged
+	}
+
+	return nil, false
+}
+
+// resolve - Find a category by ID, name, alias or path as
+//           Electronics > Phones > Smartphones. A name used under
+//           several parents needs enough of its path to tell them apart.
+func (tax *taxonomy) resolve(name string) (*category, error) {
+	if id, err := strconv.Atoi(trimQuotes(name)); err == nil {
+		if c, ok := tax.get(id); ok {
+			return c, nil
+		}
+		return nil, ErrCATU
+	}
+
+	levels := strings.Split(trimQuotes(name), categorySep)
+	var found []*category
+	for _, i := range tax.byKey[categoryKey(levels[len(levels)-1])] {
+		c := &tax.categories[i]
+
+		// Every level of a path must be an ancestor of the next one
+		parent, ok := c, true
+		for l := len(levels) - 2; ok && l >= 0; l-- {
+			parent, ok = tax.get(parent.parent)
+			ok = ok && parent.named(categoryKey(levels[l]))
+		}
+		if ok {
+			found = append(found, c)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, ErrCATU
+	case 1:
+		return found[0], nil
+	}
+
+	return nil, ErrCATM
+}
+
+// path - The names from the root of the tree down to a category
+func (tax *taxonomy) path(c *category) string {
+	names := []string{c.name}
+	for parent, ok := tax.get(c.parent); ok && len(names) <= len(tax.categories); parent, ok = tax.get(parent.parent) {
+		names = append([]string{parent.name}, names...)
+	}
+
+	return strings.Join(names, " "+categorySep+" ")
+}
+
+// subtree - A category and, with descendants, every category below it
+func (tax *taxonomy) subtree(c *category, descendants bool) []*category {
+	tree := []*category{c}
+	for i := 0; descendants && i < len(tree); i++ {
+		for j := range tax.categories {
+			child := &tax.categories[j]
+			if child.merged == 0 && child.parent == tree[i].id {
+				tree = append(tree, child)
+			}
+		}
+	}
+
+	return tree
+}
+
+// required - Attribute keys a listing in a category must have, its own
+//            and those of the categories above it
+func (tax *taxonomy) required(c *category) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for n := 0; c != nil && n <= len(tax.categories); n++ {
+		for _, key := range c.required {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		parent, ok := tax.get(c.parent)
+		if !ok {
+			break
+		}
+		c = parent
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// listingCategory - The category of the tree a listing is in. Listings
+//                   hold its ID, the ones created while the tree was empty
+//                   hold a name that may be in the tree since.
+func (tax *taxonomy) listingCategory(value string) (*category, bool) {
+	c, err := tax.resolve(value)
+
+	return c, err == nil
+}
+
+// label - Name of the category of a listing, the text the listing holds
+//         when it is not in the tree
+func (tax *taxonomy) label(value string) string {
+	if c, ok := tax.listingCategory(value); ok {
+		return c.name
+	}
+
+	return strings.TrimSpace(trimQuotes(value))
+}
+
+// categoryLabel - Name of the category of a listing for its output. The
+//                 tree is read again only once its file changed.
+func categoryLabel(value string) string {
+	if _, err := strconv.Atoi(trimQuotes(value)); err != nil {
+		return strings.TrimSpace(trimQuotes(value))
+	}
+
+	info, _ := os.Stat(csvCategoriesPath)
+	if labelTax == nil || !sameFileState(info, labelInfo) {
+		labelTax, labelInfo = loadTaxonomy(), info
+	}
+
+	return labelTax.label(value)
+}
+
+// categoryMatcher - Check if a listing is in a category of the tree, or
+//                   with descendants in a category below it, false when
+//                   the category is not in the tree
+func categoryMatcher(name string, descendants bool) (func(ProductListing) bool, bool) {
+	tax := loadTaxonomy()
+	c, err := tax.resolve(name)
+	if err != nil {
+		return nil, false
+	}
+
+	ids := make(map[int]bool)
+	for _, node := range tax.subtree(c, descendants) {
+		ids[node.id] = true
+	}
+
+	return func(product ProductListing) bool {
+		c, ok := tax.listingCategory(product.Category)
+		return ok && ids[c.id]
+	}, true
+}
+
+// CheckCategory - The ID of the category of the tree a listing goes in,
+//                 any category name is kept while the tree is empty
+func CheckCategory(name string) (string, error) {
+	tax := loadTaxonomy()
+	if len(tax.categories) == 0 {
+		return name, nil
+	}
+
+	c, err := tax.resolve(name)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.Itoa(c.id), nil
+}
+
+// taken - Whether a name or alias is used by a child of parent other
+//         than the skipped categories
+func (tax *taxonomy) taken(key string, parent int, skip ...int) bool {
+	for _, i := range tax.byKey[key] {
+		c := tax.categories[i]
+		found := c.parent == parent
+		for _, id := range skip {
+			found = found && c.id != id
+		}
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// categoryName - Check a new category name or alias is valid and unused
+//                by the children of parent but the skipped categories
+func (tax *taxonomy) categoryName(name string, parent int, skip ...int) (string, error) {
+	name = strings.Join(strings.Fields(trimQuotes(name)), " ")
+	if len(name) == 0 || strings.ContainsAny(name, "|,"+categorySep) {
+		return "", ErrCATN
+	}
+	if tax.taken(categoryKey(name), parent, skip...) {
+		return "", ErrCATA
+	}
+	if _, err := strconv.Atoi(name); err == nil {
+		return "", ErrCATN
+	}
+
+	return name, nil
+}
+
+// fits - Whether the names and aliases of the categories are free under
+//        parent, the skipped categories aside
+func (tax *taxonomy) fits(categories []*category, parent int, skip ...int) bool {
+	for _, c := range categories {
+		for _, key := range c.keys() {
+			if tax.taken(key, parent, append(skip, c.id)...) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// ManageCategory - Change the category tree, only the admin can:
+//                  add name [parent], rename category name,
+//                  alias category alias, merge category into,
+//                  move category {parent|root} and require category
+//                  [key,key], which sets the attributes its listings
+//                  must have
+func ManageCategory(username string, action string, args []string) error {
+	if !IsAdmin(username) {
+		return ErrPERM
+	}
+
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tax := loadTaxonomy()
+	need := map[string]int{"add": 1, "rename": 2, "alias": 2, "merge": 2, "move": 2,
+		"require": 1}
+	if n, ok := need[action]; !ok || len(args) < n {
+		return errors.New("Error - Use add, rename, alias, merge, move or require, see CATEGORY -h")
+	}
+
+	var c *category
+	if action != "add" {
+		c, err = tax.resolve(args[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	switch action {
+	case "add":
+		parent := 0
+		if len(args) > 1 {
+			p, err := tax.resolve(args[1])
+			if err != nil {
+				return err
+			}
+			parent = p.id
+		}
+		name, err := tax.categoryName(args[0], parent)
+		if err != nil {
+			return err
+		}
+		next := 1
+		for _, other := range tax.categories {
+			if other.id >= next {
+				next = other.id + 1
+			}
+		}
+		tax.categories = append(tax.categories, category{id: next, parent: parent, name: name})
+		return tax.save(username)
+	case "rename":
+		name, err := tax.categoryName(args[1], c.parent, c.id)
+		if err != nil {
+			return err
+		}
+		if categoryKey(name) != categoryKey(c.name) {
+			c.aliases = append(c.aliases, c.name)
+		}
+		c.name = name
+		return tax.save(username)
+	case "alias":
+		alias, err := tax.categoryName(args[1], c.parent)
+		if err != nil {
+			return err
+		}
+		c.aliases = append(c.aliases, alias)
+		return tax.save(username)
+	case "merge":
+		into, err := tax.resolve(args[1])
+		if err != nil {
+			return err
+		}
+		if into.id == c.id {
+			return ErrCATC
+		}
+		for a, ok := tax.get(into.parent); ok; a, ok = tax.get(a.parent) {
+			if a.id == c.id {
+				return ErrCATC
+			}
+		}
+		// The names of the category and its children go under new parents
+		if !tax.fits([]*category{c}, into.parent, into.id) ||
+			!tax.fits(tax.children(c.id), into.id, c.id) {
+			return ErrCATA
+		}
+		for _, name := range append([]string{c.name}, c.aliases...) {
+			if !into.named(categoryKey(name)) {
+				into.aliases = append(into.aliases, name)
+			}
+		}
+		c.merged = into.id
+		c.aliases = nil
+		for i := range tax.categories {
+			if tax.categories[i].parent == c.id {
+				tax.categories[i].parent = into.id
+			}
+		}
+		return tax.save(username)
+	case "move":
+		parent := 0
+		if categoryKey(args[1]) != "root" {
+			p, err := tax.resolve(args[1])
+			if err != nil {
+				return err
+			}
+			for a, ok := p, true; ok; a, ok = tax.get(a.parent) {
+				if a.id == c.id {
+					return ErrCATC
+				}
+			}
+			parent = p.id
+		}
+		if !tax.fits([]*category{c}, parent) {
+			return ErrCATA
+		}
+		c.parent = parent
+		return tax.save(username)
+	case "require":
+		var keys []string
+		if len(args) > 1 {
+			for _, key := range strings.Split(args[1], ",") {
+				key, err = attrKey(key)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+		}
+		c.required = keys
+		return tax.save(username)
+	}
+
+	return nil
+}
+
+// children - The categories right below a category, by name
+func (tax *taxonomy) children(id int) []*category {
+	var children []*category
+	for i := range tax.categories {
+		c := &tax.categories[i]
+		if _, ok := tax.get(c.parent); c.merged == 0 && c.id != id &&
+			(c.parent == id || (id == 0 && !ok)) {
+			children = append(children, c)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return categoryKey(children[i].name) < categoryKey(children[j].name)
+	})
+
+	return children
+}
+
+// PrintCategories - Show the category tree as id|path|aliases|required
+//                   attributes, each category right after its parent
+func PrintCategories(username string) error {
+	if !IsUsernameExist(username) {
+		return ErrUNKU
+	}
+
+	tax := loadTaxonomy()
+	tree := tax.children(0)
+	if len(tree) == 0 {
+		return errors.New("Error - No categories, any category is accepted")
+	}
+
+	for len(tree) > 0 {
+		c := tree[0]
+		fmt.Println(fmt.Sprintf("%d|%s|%s|%s", c.id, tax.path(c),
+			strings.Join(c.aliases, ","), strings.Join(c.required, ",")))
+		tree = append(tax.children(c.id), tree[1:]...)
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// manageCategories - Change the category tree as the admin, each change
+//                    is an action and its arguments
+func manageCategories(t *testing.T, changes ...[]string) {
+	t.Helper()
+
+	for _, change := range changes {
+		if err := ManageCategory(adminUser, change[0], change[1:]); err != nil {
+			t.Fatalf("category %q: %s", change, err)
+		}
+	}
+}
+
+// categoryId - Resolve a category, failing the test on error
+func categoryId(t *testing.T, name string) int {
+	t.Helper()
+
+	c, err := loadTaxonomy().resolve(name)
+	if err != nil {
+		t.Fatalf("category %s: %s", name, err)
+	}
+
+	return c.id
+}
+
+func TestCategorySiblingNames(t *testing.T) {
+	resetData(t)
+	manageCategories(t,
+		[]string{"add", "Electronics"},
+		[]string{"add", "Phones", "electronics"},
+		[]string{"add", "Fashion"},
+		[]string{"add", "Accessories", "phones"},
+		[]string{"add", "Accessories", "fashion"})
+
+	if err := ManageCategory("user1", "add", []string{"Toys"}); err != ErrPERM {
+		t.Errorf("add by a user: %v, want %v", err, ErrPERM)
+	}
+	tests := [][]string{
+		{"add", "accessories", "'electronics > phones'"},
+		{"add", "ELECTRONICS"},
+		{"alias", "electronics", "fashion"},
+		{"rename", "fashion", "Electronics"},
+	}
+	for _, args := range tests {
+		if err := ManageCategory(adminUser, args[0], args[1:]); err != ErrCATA {
+			t.Errorf("category %q: %v, want %v", args, err, ErrCATA)
+		}
+	}
+
+	tax := loadTaxonomy()
+	if _, err := tax.resolve("accessories"); err != ErrCATM {
+		t.Errorf("ambiguous name: %v, want %v", err, ErrCATM)
+	}
+	phones, err := tax.resolve("phones > accessories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := tax.resolve("'Electronics > Phones > Accessories'")
+	if err != nil || full.id != phones.id {
+		t.Errorf("full path = %v, %v, want %d", full, err, phones.id)
+	}
+	if c, err := tax.resolve("fashion > accessories"); err != nil || c.id == phones.id {
+		t.Errorf("fashion > accessories = %v, %v", c, err)
+	}
+	if _, err := tax.resolve("fashion > phones"); err != ErrCATU {
+		t.Errorf("wrong path: %v, want %v", err, ErrCATU)
+	}
+	if _, err := CheckCategory("accessories"); err != ErrCATM {
+		t.Errorf("listing in an ambiguous category: %v, want %v", err, ErrCATM)
+	}
+
+	// A case change is no conflict with the category itself
+	manageCategories(t, []string{"rename", "fashion", "FASHION"})
+	if c, _ := loadTaxonomy().resolve("fashion"); c == nil || c.name != "FASHION" || len(c.aliases) != 0 {
+		t.Errorf("renamed category = %v", c)
+	}
+}
+
+func TestMoveAndMergeConflicts(t *testing.T) {
+	resetData(t)
+	manageCategories(t,
+		[]string{"add", "Electronics"},
+		[]string{"add", "Phones", "electronics"},
+		[]string{"add", "Mobiles", "electronics"},
+		[]string{"add", "Cases", "phones"},
+		[]string{"add", "Cases", "mobiles"},
+		[]string{"add", "Fashion"})
+
+	if err := ManageCategory(adminUser, "move", []string{"phones > cases", "mobiles"}); err != ErrCATA {
+		t.Errorf("move next to a sibling of the same name: %v, want %v", err, ErrCATA)
+	}
+	if err := ManageCategory(adminUser, "merge", []string{"phones", "mobiles"}); err != ErrCATA {
+		t.Errorf("merge with children of the same name: %v, want %v", err, ErrCATA)
+	}
+
+	manageCategories(t,
+		[]string{"move", "phones > cases", "fashion"},
+		[]string{"merge", "phones", "mobiles"})
+	tax := loadTaxonomy()
+	mobiles, err := tax.resolve("phones")
+	if err != nil || mobiles.name != "Mobiles" {
+		t.Fatalf("merged name = %v, %v", mobiles, err)
+	}
+	if c, err := tax.resolve("fashion > cases"); err != nil || c.parent != categoryId(t, "fashion") {
+		t.Errorf("moved category = %v, %v", c, err)
+	}
+}
+
+// TestListingsKeepCategoryId - Listings hold the category ID, so a rename
+//                              or merge does not rewrite them
+func TestListingsKeepCategoryId(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	manageCategories(t,
+		[]string{"add", "Electronics"},
+		[]string{"add", "Phones", "electronics"},
+		[]string{"add", "Mobiles", "electronics"})
+	id := createListing(t, "user1", "Old phone", "50", "'electronics > phones'")
+
+	phones := categoryId(t, "phones")
+	if p := getListing(t, id); p.Category != strconv.Itoa(phones) {
+		t.Fatalf("listing category %q, want %d", p.Category, phones)
+	}
+	rows := itemRows(t)
+
+	manageCategories(t, []string{"rename", "phones", "'Smart Phones'"})
+	if got := itemRows(t); !reflect.DeepEqual(got, rows) {
+		t.Errorf("rename rewrote the items: %v", got)
+	}
+	if line := listingLine(getListing(t, id)); !hasLine([]string{line}, "|Smart Phones|user1") {
+		t.Errorf("listing after rename = %s", line)
+	}
+
+	manageCategories(t, []string{"merge", "smart phones", "mobiles"})
+	if got := itemRows(t); !reflect.DeepEqual(got, rows) {
+		t.Errorf("merge rewrote the items: %v", got)
+	}
+	for _, name := range []string{"mobiles", "phones", "electronics"} {
+		inCategory, ok := categoryMatcher(name, true)
+		if !ok || !inCategory(getListing(t, id)) {
+			t.Errorf("listing not in %s after the merge", name)
+		}
+	}
+	if label := categoryLabel(getListing(t, id).Category); label != "Mobiles" {
+		t.Errorf("label after merge = %s, want Mobiles", label)
+	}
+}
+
+// TestListingCategoryText - Listings created before the tree keep their
+//                           text and match the category added with it
+func TestListingCategoryText(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Old phone", "50", "Phones")
+	if p := getListing(t, id); p.Category != "Phones" {
+		t.Fatalf("listing category %q, want Phones", p.Category)
+	}
+
+	manageCategories(t, []string{"add", "phones"})
+	inCategory, ok := categoryMatcher("phones", false)
+	if !ok || !inCategory(getListing(t, id)) {
+		t.Errorf("listing with the category text not in it")
+	}
+	if label := categoryLabel("Phones"); label != "Phones" {
+		t.Errorf("label = %s, want Phones", label)
+	}
+}
@@ -30,28 +30,28 @@
 package utils
 
 import (
-	"bufio"
 	"encoding/csv"
 	"errors"
 	"fmt"
-	"io"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	csvUserPath  = "/tmp/users.csv"
-	csvItemsPath = "/tmp/items.csv"
-	timeFormat   = "02-01-2006-15:04PM"
+	timeFormat = "02-01-2006-15:04PM"
 )
 
 var (
+	// The data files are variables so the tests can keep them out of /tmp
+	csvUserPath  = "/tmp/users.csv"
+	csvItemsPath = "/tmp/items.csv"
+
 	ErrPAE  = errors.New("Error - Product already exist")
 	ErrUNKU = errors.New("Error - Unknow user")
 	ErrPLE  = errors.New("Error - Product list is empty")
+	ErrMALF = errors.New("Error - Malformed product entry")
 )
 
 // ProductListing - Structure used to organize the item
@@ -60,9 +60,12 @@ type ProductListing struct {
 	Username    string
 	Title       string
 	Description string
-	Price       int
+	Price       Money
 	Category    string
 	CreatedAt   string
+	Status      string
+	Attributes  map[string]string
+	Tags        []string
 }
 
 func trimQuotes(word string) string {
@@ -72,223 +75,333 @@ func trimQuotes(word string) string {
 	return word
 }
 
-func sortMap(data map[int]string, args ...string) {
-	product := []ProductListing{}
+// parseProduct - Parse a row from the csv item file
+func parseProduct(entry string) (ProductListing, error) {
+	splEntry := strings.Split(entry, "|")
+	if len(splEntry) < 7 {
+		return ProductListing{}, ErrMALF
+	}
 
-	for _, v := range data {
-		splEntry := strings.Split(v, "|")
-		_price, _ := strconv.Atoi(splEntry[2])
-		n := ProductListing{Title: splEntry[0], Description: splEntry[1],
-			Price: _price, CreatedAt: splEntry[3]}
-		product = append(product, n)
+	id, err := strconv.Atoi(splEntry[0])
+	if err != nil {
+		return ProductListing{}, ErrMALF
+	}
+	price, err := ParseMoney(splEntry[4])
+	if err != nil {
+		return ProductListing{}, ErrMALF
 	}
 
-	if len(args) >= 2 {
-		if args[0] == "sort_price" && args[1] == "dsc" {
-			sort.SliceStable(product, func(i, j int) bool {
-				return product[i].Price < product[j].Price
-			})
-		}
+	// Rows written before the listing lifecycle have no status
+	status := StatusActive
+	if len(splEntry) > 7 && len(splEntry[7]) > 0 {
+		status = splEntry[7]
+	}
 
-		if args[0] == "sort_price" && args[1] == "asc" {
-			sort.SliceStable(product, func(i, j int) bool {
-				return product[i].Price > product[j].Price
-			})
-		}
+	product := ProductListing{Id: id, Username: splEntry[1],
+		Title: splEntry[2], Description: splEntry[3],
+		Price: price, Category: splEntry[5],
+		CreatedAt: splEntry[6], Status: status}
 
-		if args[0] == "sort_time" && args[1] == "dsc" {
-			sort.SliceStable(product, func(i, j int) bool {
-				ti, _ := time.Parse(timeFormat, product[i].CreatedAt)
-				tj, _ := time.Parse(timeFormat, product[j].CreatedAt)
-				return ti.Before(tj)
-			})
-		}
-		if args[0] == "sort_time" && args[1] == "asc" {
-			sort.SliceStable(product, func(i, j int) bool {
-				ti, _ := time.Parse(timeFormat, product[i].CreatedAt)
-				tj, _ := time.Parse(timeFormat, product[j].CreatedAt)
-				return ti.After(tj)
-			})
-		}
+	// Rows written before the attributes and tags have neither
+	if len(splEntry) > 9 {
+		product.Attributes = decodeAttributes(splEntry[8])
+		product.Tags = decodeTags(splEntry[9])
 	}
 
-	for i := 0; i < len(product); i++ {
-		fmt.Println(string(fmt.Sprintf("%s|%s|%d|%s",
-			product[i].Title, product[i].Description,
-			product[i].Price, product[i].CreatedAt)))
-	}
+	return product, nil
 }
 
-// DoesProductExist - Verify if a product exist
-func DoesProductExist(product ProductListing) bool {
-	entries := ReadCSVProduct()
-	if len(entries) == 0 {
-		return false
+// productRecord - Format a product as a row of the csv item file
+func productRecord(product ProductListing) string {
+	if len(product.Status) == 0 {
+		product.Status = StatusActive
 	}
 
+	return fmt.Sprintf("%d|%s|%s|%s|%s|%s|%s|%s|%s|%s",
+		product.Id,
+		trimQuotes(product.Username),
+		trimQuotes(product.Title),
+		trimQuotes(product.Description),
+		product.Price,
+		trimQuotes(product.Category),
+		trimQuotes(product.CreatedAt),
+		product.Status,
+		encodeAttributes(product.Attributes),
+		encodeTags(product.Tags))
+}
+
+// loadProducts - Read and parse all items from the item store
+func loadProducts() ([]ProductListing, error) {
+	var products []ProductListing
+
+	entries, err := ReadCSVProduct()
+	if err != nil {
+		return nil, err
+	}
 	for _, entry := range entries {
-		splEntry := strings.Split(entry[0], "|")
-		title := splEntry[2]
-		desc := splEntry[3]
-		cat := splEntry[5]
-		if trimQuotes(product.Title) == trimQuotes(title) &&
-			trimQuotes(product.Description) == trimQuotes(desc) &&
-			trimQuotes(product.Category) == trimQuotes(cat) {
-
-			return true
+		product, err := parseProduct(entry[0])
+		if err != nil {
+			continue
 		}
+		products = append(products, product)
 	}
 
-	return false
+	return products, nil
+}
+
+// listingLine - Format a product with its id and seller for listing output
+func listingLine(p ProductListing) string {
+	return fmt.Sprintf("%d|%s|%s|%s|%s|%s|%s",
+		p.Id, p.Title, p.Description, p.Price,
+		p.CreatedAt, categoryLabel(p.Category), p.Username)
 }
 
-// LastProductId - Gets the latest product ID
-func LastProductId() int {
-	var lastID int = 1
-	file, err := os.Open(csvItemsPath)
+// DoesProductExist - Verify if a product exist
+func DoesProductExist(product ProductListing) (bool, error) {
+	id, err := duplicateOf(product)
+
+	return id != 0, err
+}
+
+// duplicateOf - ID of another item with the same title, description and
+//               category, 0 if there is none. The product itself, matched
+//               by its ID, is not a duplicate.
+func duplicateOf(product ProductListing) (int, error) {
+	store, err := currentStore()
 	if err != nil {
-		return lastID
+		return 0, err
 	}
-	defer file.Close()
 
-	csv := csv.NewReader(file)
-	csv.LazyQuotes = false
-	for {
-		record, err := csv.Read()
-		if err == io.EOF {
-			break
+	return store.duplicateOf(product), nil
+}
+
+// LastProductId - Gets the next free product ID. The metadata file keeps
+//                 it counting so the ID of a purged item is never given
+//                 again, offers, messages and reviews point at it. Data
+//                 from before the counter starts one past the highest ID
+//                 in use or in the trash.
+func LastProductId() (int, error) {
+	var lastID int
+	for _, trashed := range readTrash() {
+		if trashed.product.Id > lastID {
+			lastID = trashed.product.Id
 		}
-		lastID, _ = strconv.Atoi(strings.Split(record[0], "|")[0])
 	}
 
-	return lastID + 1
+	store, err := currentStore()
+	if err != nil {
+		return 0, err
+	}
+	if id := store.lastId(); id > lastID {
+		lastID = id
+	}
+
+	if next, err := strconv.Atoi(readMeta()["next_id"]); err == nil && next > lastID {
+		return next, nil
+	}
+
+	return lastID + 1, nil
 }
 
-// IsUsernameExist - Check if user exist
-func IsUsernameExist(username string) bool {
-	file, err := os.Open(csvUserPath)
+// takeProductIds - Reserve n IDs for new items and return the first one,
+//                  the caller holds the data lock
+func takeProductIds(n int) (int, error) {
+	first, err := LastProductId()
 	if err != nil {
-		fmt.Println("Error - csv users file does not exist")
-		return false
+		return 0, err
 	}
 
-	csv := bufio.NewScanner(file)
-	for csv.Scan() {
-		if username == csv.Text() {
-			return true
-		}
+	return first, setMeta("next_id", strconv.Itoa(first+n))
+}
+
+// IsUsernameExist - Check if user exist, usernames compare case
+//                   insensitively
+func IsUsernameExist(username string) bool {
+	if _, err := os.Stat(csvUserPath); err != nil {
+		fmt.Println("Error - csv users file does not exist")
+		return false
 	}
 
-	return false
+	_, ok := FindUser(username)
+	return ok
 }
 
 // WriteCSVProduct - Writes the item into the csv file
 func WriteCSVProduct(product ProductListing) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Check if product already exist
-	if DoesProductExist(product) {
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	if store.duplicateOf(product) != 0 {
 		return ErrPAE
 	}
 
 	// Check if user exist
-	if !IsUsernameExist(trimQuotes(product.Username)) {
+	user, ok := FindUser(product.Username)
+	if !ok {
 		return ErrUNKU
 	}
+	if !user.Active {
+		return ErrUINA
+	}
+	product.Username = user.Username
 
-	file, err := os.OpenFile(csvItemsPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	seq, err := beginJournal(product.Username, JournalCreate, productRecord(product))
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	wr := csv.NewWriter(file)
-	defer wr.Flush()
+	err = store.add(product)
+	if err == nil {
+		stored, _ := parseProduct(productRecord(product))
+		err = indexProduct(stored)
+	}
 
-	item := []string{fmt.Sprintf("%d|%s|%s|%s|%d|%s|%s",
-		product.Id,
-		trimQuotes(product.Username),
-		trimQuotes(product.Title),
-		trimQuotes(product.Description),
-		product.Price,
-		trimQuotes(product.Category),
-		trimQuotes(product.CreatedAt))}
+	return endJournal(seq, JournalCreate, err)
+}
 
-	res := wr.Write(item)
+// CreateCSVProduct - Give a new item the next free ID and write it into
+//                    the csv file, returns the ID
+func CreateCSVProduct(product ProductListing) (int, error) {
+	unlock, err := lockData()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	product.Category, err = CheckCategory(product.Category)
+	if err != nil {
+		return 0, err
+	}
+	err = checkAttributes(product)
+	if err != nil {
+		return 0, err
+	}
+	product.Id, err = takeProductIds(1)
+	if err != nil {
+		return 0, err
+	}
 
-	return res
+	return product.Id, WriteCSVProduct(product)
 }
 
 // ReGenerateCSVProduct - Regenerates the csv item file
 //                        for delete/update operations
 func ReGenerateCSVProduct(lines [][]string) error {
-	file, err := os.Create(csvItemsPath)
+	var kept [][]string
+	for _, line := range lines {
+		if len(line[0]) > 0 {
+			kept = append(kept, line)
+		}
+	}
+
+	store, err := currentStore()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	w := csv.NewWriter(file)
-	for _, line := range lines {
-		if len(line[0]) > 0 {
-			err = w.Write(line)
-			if err != nil {
-				return err
-			}
+	return store.replace(kept)
+}
+
+// splitCSVRecords - Split csv data into its records, each with its line
+//                   break. A line break inside quotes stays in its record.
+func splitCSVRecords(data []byte) [][]byte {
+	var records [][]byte
+
+	start, quoted := 0, false
+	for i, c := range data {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\n' && !quoted:
+			records = append(records, data[start:i+1])
+			start = i + 1
 		}
 	}
-	w.Flush()
-	return nil
+	if start < len(data) {
+		records = append(records, data[start:])
+	}
+
+	return records
 }
 
-// ReadCSVProduct - Read all items from a csv item file
-func ReadCSVProduct() [][]string {
-	file, err := os.OpenFile(csvItemsPath, os.O_RDONLY, 0644)
+// readCSVRows - All rows of a csv file, none when it does not exist
+func readCSVRows(path string) [][]string {
+	file, err := os.Open(path)
 	if err != nil {
 		return nil
 	}
-	r := csv.NewReader(file)
-	r.LazyQuotes = true
-	lines, err := r.ReadAll()
+	defer file.Close()
+
+	lines, _ := csv.NewReader(file).ReadAll()
+
+	return lines
+}
+
+// writeCSVAtomic - Write the rows to a temporary file and rename it over
+//                  path, readers see either the old or the new file and
+//                  a failed write leaves the old one untouched
+func writeCSVAtomic(path string, lines [][]string) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	if len(lines) == 0 {
-		return nil
+	w := csv.NewWriter(file)
+	err = w.WriteAll(lines)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
 	}
 
-	return lines
+	return err
 }
 
-// DeleteCSVItem - Remove an item from csv item file
-func DeleteCSVItem(username string, id int) (err error) {
-	entries := ReadCSVProduct()
-	if len(entries) == 0 {
-		return ErrPLE
+// ReadCSVProduct - Read all items from the item store
+func ReadCSVProduct() ([][]string, error) {
+	store, err := currentStore()
+	if err != nil {
+		return nil, err
 	}
 
-	for index, entry := range entries {
-		splEntry := strings.Split(entry[0], "|")
-		_id, _ := strconv.Atoi(splEntry[0])
-		_username := splEntry[1]
-		if id == _id {
-			if trimQuotes(username) != trimQuotes(_username) {
-				err = errors.New("Error - listing owner mismatch")
-				break
-			} else {
-				entries[index][0] = ""
-				err = nil
-				break
-			}
-		} else {
-			err = errors.New("Error - listing does not exist")
-		}
+	return store.rows(), nil
+}
+
+// DeleteCSVItem - Move an item from csv item file to the trash
+func DeleteCSVItem(username string, id int) (err error) {
+	unlock, err := lockData()
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
+	product, err := ownedProduct(username, id)
 	if err != nil {
 		return err
 	}
 
-	err = ReGenerateCSVProduct(entries)
+	deletedAt := time.Now().Format(timeFormat)
+	seq, err := beginJournal(username, JournalDelete, deletedAt+"|"+productRecord(product))
+	if err != nil {
+		return err
+	}
+	err = endJournal(seq, JournalDelete, trashProduct(product, deletedAt))
 	if err != nil {
 		return err
 	}
@@ -296,64 +409,176 @@ func DeleteCSVItem(username string, id int) (err error) {
 	return errors.New("Success")
 }
 
-// GetCSVItem - Find and return an item from csv item file
-func GetCSVItem(username string, id int) (err error) {
-	entries := ReadCSVProduct()
-	if len(entries) == 0 {
-		return ErrPLE
+// findProduct - Find an item in the item store
+func findProduct(id int) (ProductListing, error) {
+	store, err := currentStore()
+	if err != nil {
+		return ProductListing{}, err
 	}
 
-	for index, entry := range entries {
-		splEntry := strings.Split(entry[0], "|")
-		_id, _ := strconv.Atoi(splEntry[0])
-		_username := splEntry[1]
+	product, ok := store.get(id)
+	if !ok {
+		return product, ErrLNE
+	}
 
-		if id == _id {
-			if trimQuotes(username) != trimQuotes(_username) {
-				err = ErrUNKU
-				break
-			} else {
-				a := strings.Split(entries[index][0], "|")
-				item := string(fmt.Sprintf("%s|%s|%s|%s|%s|%s",
-					a[2], a[3], a[4], a[6], a[5], a[1]))
+	return product, nil
+}
 
-				return errors.New(item)
-			}
-		} else {
-			err = errors.New("Error - not found")
-		}
+// ownedProduct - Find an item owned by username in the item store
+func ownedProduct(username string, id int) (ProductListing, error) {
+	store, err := currentStore()
+	if err != nil {
+		return ProductListing{}, err
+	}
+	if store.lastId() == 0 {
+		return ProductListing{}, ErrPLE
+	}
+
+	product, ok := store.get(id)
+	if !ok {
+		return product, ErrLNE
+	}
+	if !sameUser(username, product.Username) {
+		return product, ErrOWN
 	}
 
+	return product, nil
+}
+
+// modifyProduct - Apply a change to a product owned by username, the
+//                 product keeps its row in the item store and the change
+//                 is recorded as a revision of the product
+func modifyProduct(username string, id int, change func(*ProductListing) error) error {
+	unlock, err := lockData()
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	return errors.New("Success")
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	before, err := ownedProduct(username, id)
+	if err != nil {
+		return err
+	}
+
+	product := before
+	err = change(&product)
+	if err != nil {
+		return err
+	}
+
+	record := productRecord(product)
+	product, err = parseProduct(record)
+	if err != nil {
+		return err
+	}
+
+	changed := changedFields(before, product)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	seq, err := beginJournal(username, JournalUpdate, record)
+	if err != nil {
+		return err
+	}
+
+	// The revision goes first and is cut off again if the item cannot
+	// be written, so both change or neither does
+	mark := fileSize(csvRevisionsPath)
+	err = recordRevision(before, product, canonicalUsername(username), changed)
+	if err == nil {
+		err = store.update(product)
+	}
+	if err != nil {
+		os.Truncate(csvRevisionsPath, mark)
+		return endJournal(seq, JournalUpdate, err)
+	}
+
+	return endJournal(seq, JournalUpdate, indexProduct(product))
+}
+
+// fileSize - Size of a file, 0 if it does not exist
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// sameFileState - Whether two stats of a file show the same content, nil
+//                 for a missing file
+func sameFileState(a os.FileInfo, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// GetCSVItem - Find and return an item from csv item file, any
+//              registered user can read the items of other sellers
+func GetCSVItem(username string, id int) (err error) {
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	if store.lastId() == 0 {
+		return ErrPLE
+	}
+
+	if !IsUsernameExist(username) {
+		return ErrUNKU
+	}
+
+	p, ok := store.get(id)
+	if !ok {
+		return errors.New("Error - not found")
+	}
+
+	// The images follow the item, one per line
+	lines := append([]string{fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s",
+		p.Title, p.Description, p.Price, p.CreatedAt, categoryLabel(p.Category),
+		p.Username, p.state(), scoreOf(sellerScores(), p.Username),
+		encodeAttributes(p.Attributes), encodeTags(p.Tags))}, imageLines(id)...)
+
+	return errors.New(strings.Join(lines, "\n"))
 }
 
-// GetCSVTopCategory - Show the top category with most items
+// GetCSVTopCategory - Show the top category with most active items
 func GetCSVTopCategory(username string) (err error) {
 	var topCategory string
+	var owned bool
 
 	top := make(map[string]int)
-	entries := ReadCSVProduct()
-	if len(entries) == 0 {
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	if store.lastId() == 0 {
 		return ErrPLE
 	}
 
-	for _, entry := range entries {
-		splEntry := strings.Split(entry[0], "|")
-		_username := strings.ToLower(splEntry[1])
-		if trimQuotes(strings.ToLower(username)) == trimQuotes(_username) {
-			category := strings.ToLower(splEntry[5])
-			top[category] = top[category] + 1
-		} else {
-			err = errors.New("Error - unknown user")
+	tax := loadTaxonomy()
+	for _, p := range store.byOwner(username) {
+		owned = true
+		if p.state() != StatusActive {
+			continue
 		}
+		category := strings.ToLower(tax.label(p.Category))
+		top[category] = top[category] + 1
 	}
 
-	if err != nil && len(top) == 0 {
-		return err
+	if len(top) == 0 {
+		if owned {
+			return ErrNOTF
+		}
+		return errors.New("Error - unknown user")
 	}
 	max := 0
 	for k, v := range top {
@@ -367,63 +592,73 @@ func GetCSVTopCategory(username string) (err error) {
 	return nil
 }
 
-// GetCSVCategory - Show items from a follow category
-func GetCSVCategory(username string, category string, args ...string) (err error) {
-	allitems := make(map[int]string)
-	entries := ReadCSVProduct()
-	if len(entries) == 0 {
+// GetCSVCategory - Show items from a follow category matching the filter,
+//                  in the order of the filter, one page at a time
+func GetCSVCategory(username string, category string, filter Filter, page Page) (err error) {
+	var items []ProductListing
+
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	if store.lastId() == 0 {
 		return ErrPLE
 	}
 
-	for index, entry := range entries {
-		splEntry := strings.Split(entry[0], "|")
-		_username := strings.ToLower(splEntry[1])
-		_category := strings.ToLower(splEntry[5])
-
-		if trimQuotes(strings.ToLower(username)) == trimQuotes(_username) {
-			if trimQuotes(strings.ToLower(category)) == trimQuotes(_category) {
-				a := strings.Split(entries[index][0], "|")
-				item := string(fmt.Sprintf("%s|%s|%s|%s",
-					a[2], a[3], a[4], a[6]))
-				allitems[index] = item
-			} else {
-				err = errors.New("Error - category not found")
-			}
-		} else {
-			if err == nil {
-				err = ErrUNKU
+	products := store.byOwnerCategory(username, category)
+	if inCategory, ok := categoryMatcher(category, filter.descendants); ok {
+		products = nil
+		for _, product := range store.byOwner(username) {
+			if inCategory(product) {
+				products = append(products, product)
 			}
 		}
 	}
 
-	if len(args) >= 2 {
-		if args[0] == "sort_price" && args[1] == "dsc" {
-			sortMap(allitems, "sort_price", "dsc")
-		}
-		if args[0] == "sort_price" && args[1] == "asc" {
-			sortMap(allitems, "sort_price", "asc")
-		}
-		if args[0] == "sort_time" && args[1] == "dsc" {
-			sortMap(allitems, "sort_time", "dsc")
-		}
-		if args[0] == "sort_time" && args[1] == "asc" {
-			sortMap(allitems, "sort_time", "asc")
+	products = page.restrict(products)
+	if len(products) == 0 {
+		if len(store.byOwner(username)) == 0 {
+			return ErrUNKU
 		}
-	} else {
-		for _, v := range allitems {
-			fmt.Println(v)
+		return ErrCNF
+	}
+
+	for _, product := range products {
+		if filter.match(product) {
+			items = append(items, product)
 		}
 	}
 
-	if len(allitems) > 0 {
-		return nil
+	if len(items) == 0 {
+		return ErrNOTF
 	}
 
-	return err
+	sortProducts(items, filter)
+	scores := sellerScores()
+	start, end, next := page.window(len(items))
+	for _, item := range items[start:end] {
+		fmt.Println(fmt.Sprintf("%s|%s|%s|%s|%s", item.Title, item.Description,
+			item.Price, item.CreatedAt, scoreOf(scores, item.Username).String()))
+	}
+	page.printNext(next)
+
+	return nil
 }
 
-// WriteCSVUser - Write username into csv user file
+// WriteCSVUser - Write a new user profile into csv user file, the
+//                username must follow the username grammar
 func WriteCSVUser(username string) error {
+	username, err := NormalizeUsername(username)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	file, err := os.OpenFile(csvUserPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		fmt.Println("Error - csv users file does not exist")
@@ -432,75 +667,70 @@ func WriteCSVUser(username string) error {
 	defer file.Close()
 
 	if IsUsernameExist(username) {
-		return errors.New("EUSERS")
+		return ErrUAE
 	}
 
-	wr := csv.NewWriter(file)
-	defer wr.Flush()
+	record := userRecord(newUser(username))
+	seq, err := beginJournal(username, JournalRegister, record[0])
+	if err != nil {
+		return err
+	}
 
-	_username := strings.Fields(username)
-	res := wr.Write(_username)
+	wr := csv.NewWriter(file)
+	wr.Write(record)
+	wr.Flush()
 
-	return res
+	return endJournal(seq, JournalRegister, wr.Error())
 }
 
-// UpdateCSVItem - Find and update an item from csv item file
+// UpdateCSVItem - Find and update an item from csv item file in place,
+//                 the item keeps its row and a revision is recorded. The
+//                 fields come by name (--price 900) or, as before, by
+//                 position after the id: title, description, price and
+//                 category. Fields not given stay unchanged. --attr
+//                 key=value, --tag and --untag change the attributes
+//                 and tags.
 func UpdateCSVItem(username string, id int, args []string) (err error) {
-	var newproduct ProductListing
-	entries := ReadCSVProduct()
-	if len(entries) == 0 {
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	if store.lastId() == 0 {
 		return errors.New("Warning - Product list is empty")
 	}
 
-	for index, entry := range entries {
-		splEntry := strings.Split(entry[0], "|")
-		_id, _ := strconv.Atoi(splEntry[0])
-		_username := splEntry[1]
-
-		if id == _id {
-			if trimQuotes(username) != trimQuotes(_username) {
-				err = errors.New("Error - unknow user")
-				break
-			} else {
-				a := strings.Split(entries[index][0], "|")
-				_price, _ := strconv.Atoi(a[4])
-				switch {
-				case len(args) == 3:
-					newproduct = ProductListing{Id: id, Username: username,
-						Title: args[2], Description: a[3],
-						Price: _price, Category: a[5],
-						CreatedAt: a[6]}
-				case len(args) == 4:
-					newproduct = ProductListing{Id: id, Username: username,
-						Title: args[2], Description: args[3],
-						Price: _price, Category: a[5],
-						CreatedAt: a[6]}
-				case len(args) == 5:
-					_price, _ := strconv.Atoi(args[4])
-					newproduct = ProductListing{Id: id, Username: username,
-						Title: args[2], Description: args[3],
-						Price: _price, Category: a[5],
-						CreatedAt: a[6]}
-				case len(args) == 6:
-					_price, _ := strconv.Atoi(args[4])
-					newproduct = ProductListing{Id: id, Username: username,
-						Title: args[2], Description: args[3],
-						Price: _price, Category: args[5],
-						CreatedAt: a[6]}
-				}
-			}
-		} else {
-			err = errors.New("Error - item not found for update")
-		}
+	changes, args, err := ParseAttributes(args[2:])
+	if err != nil {
+		return err
+	}
+	fields, err := parseFields(args)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 && changes.empty() {
+		return errors.New("Error - Nothing to update")
 	}
 
+	err = modifyProduct(username, id, func(product *ProductListing) error {
+		err := applyFields(product, fields)
+		if err != nil {
+			return err
+		}
+		changes.Apply(product)
+		err = checkAttributes(*product)
+		if err != nil {
+			return err
+		}
+		dup, err := duplicateOf(*product)
+		if err == nil && dup != 0 {
+			err = ErrPAE
+		}
+
+		return err
+	})
 	if err != nil {
 		return err
-	} else {
-		_ = DeleteCSVItem(username, id)
-		_ = WriteCSVProduct(newproduct)
-		err = errors.New("Item updated")
 	}
 
-	return err
+	return errors.New("Item updated")
 }
@@ -0,0 +1,104 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestUpdateListingInPlace - An update keeps the row of the item and the
+//                            item itself is no duplicate of the update
+func TestUpdateListingInPlace(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	first := createListing(t, "user1", "Phone", "100", "Electronics")
+	second := createListing(t, "user1", "Laptop", "900", "Electronics")
+
+	updateListing(t, "user1", first, "--price", "80")
+	updateListing(t, "user1", first, "--price", "80", "--title", "Phone")
+
+	rows := itemRows(t)
+	if len(rows) != 2 || !strings.HasPrefix(rows[0][0], "1|") {
+		t.Errorf("rows after update %q", rows)
+	}
+
+	err := UpdateCSVItem("user1", second, []string{"user1", "id", "--title", "Phone",
+		"--description", "about Phone"})
+	if err != ErrPAE {
+		t.Errorf("update into a duplicate: %v, want %v", err, ErrPAE)
+	}
+	if err := UpdateCSVItem("user1", first, []string{"user1", "id"}); err == nil ||
+		err.Error() != "Error - Nothing to update" {
+		t.Errorf("empty update: %v", err)
+	}
+}
+
+func TestDuplicateExcludesItself(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Phone", "100", "Electronics")
+	product := getListing(t, id)
+
+	if other, _ := duplicateOf(product); other != 0 {
+		t.Errorf("item is a duplicate of %d", other)
+	}
+	product.Id = 0
+	if other, _ := duplicateOf(product); other != id {
+		t.Errorf("copy is a duplicate of %d, want %d", other, id)
+	}
+}
+
+// TestWriteAtomicKeepsOldFile - A failed write leaves the file as it was
+//                               and no temporary file behind
+func TestWriteAtomicKeepsOldFile(t *testing.T) {
+	resetData(t)
+	path := filepath.Join(testDir, "rows.csv")
+	err := writeCSVAtomic(path, [][]string{{"a|b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := readCSVRows(path); len(rows) != 1 || rows[0][0] != "a|b" {
+		t.Fatalf("rows %q", rows)
+	}
+
+	dir := filepath.Join(testDir, "dir.csv")
+	if err := os.MkdirAll(filepath.Join(dir, "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCSVAtomic(dir, [][]string{{"c"}}); err == nil {
+		t.Error("rename over a directory succeeded")
+	}
+	if _, err := os.Stat(dir + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// listingFields - Fields of a product set by name, in the order of
+	//                 the positional form of UPDATE_LISTING
+	listingFields = []string{"title", "description", "price", "category"}
+)
+
+// parseFields - Read --field value (or --field=value) pairs, or the
+//               positional values in the order of listingFields
+func parseFields(args []string) (map[string]string, error) {
+	fields := make(map[string]string)
+
+	if len(args) == 0 || !strings.HasPrefix(args[0], "--") {
+		if len(args) > len(listingFields) {
+			return nil, fmt.Errorf("Error - Too many fields, expected at most %d", len(listingFields))
+		}
+		for i, value := range args {
+			fields[listingFields[i]] = value
+		}
+		return fields, nil
+	}
+
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimPrefix(args[i], "--")
+		if name == args[i] {
+			return nil, fmt.Errorf("Error - Expected a --field, got %s", args[i])
+		}
+
+		var value string
+		if kv := strings.SplitN(name, "=", 2); len(kv) == 2 {
+			name, value = kv[0], kv[1]
+		} else if i+1 < len(args) {
+			value = args[i+1]
+			i++
+		} else {
+			return nil, fmt.Errorf("Error - Missing value for --%s", name)
+		}
+
+		if !isListingField(name) {
+			return nil, fmt.Errorf("Error - Unknown field %s, use %s",
+				name, strings.Join(listingFields, ", "))
+		}
+		if _, ok := fields[name]; ok {
+			return nil, fmt.Errorf("Error - Field %s given twice", name)
+		}
+		fields[name] = value
+	}
+
+	return fields, nil
+}
+
+func isListingField(name string) bool {
+	for _, field := range listingFields {
+		if field == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateText - A text field must not be empty nor hold the csv item
+//                file separator
+func validateText(field string, value string) error {
+	value = strings.TrimSpace(trimQuotes(value))
+	if len(value) == 0 {
+		return fmt.Errorf("Error - Invalid %s, it cannot be empty", field)
+	}
+	if strings.Contains(value, "|") {
+		return fmt.Errorf("Error - Invalid %s, it cannot contain |", field)
+	}
+
+	return nil
+}
+
+// applyFields - Validate and set the given fields of a product
+func applyFields(product *ProductListing, fields map[string]string) error {
+	for _, field := range listingFields {
+		value, ok := fields[field]
+		if !ok {
+			continue
+		}
+
+		if field == "price" {
+			price, err := ParseMoney(value)
+			if err != nil {
+				return err
+			}
+			product.Price = price
+			continue
+		}
+
+		err := validateText(field, value)
+		if err != nil {
+			return err
+		}
+
+		value = strings.TrimSpace(trimQuotes(value))
+		switch field {
+		case "title":
+			product.Title = value
+		case "description":
+			product.Description = value
+		case "category":
+			product.Category, err = CheckCategory(value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateProduct - Check every field set by the seller
+func ValidateProduct(product ProductListing) error {
+	for _, field := range []string{"title", "description", "category"} {
+		err := validateText(field, fieldValue(product, field))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	tests := []struct {
+		args []string
+		want map[string]string
+	}{
+		{[]string{"--price", "900", "--category", "Phones"},
+			map[string]string{"price": "900", "category": "Phones"}},
+		{[]string{"--title=Red phone"}, map[string]string{"title": "Red phone"}},
+		{[]string{"Phone", "Black", "100"},
+			map[string]string{"title": "Phone", "description": "Black", "price": "100"}},
+		{nil, map[string]string{}},
+	}
+	for _, tt := range tests {
+		got, err := parseFields(tt.args)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFields(%q) = %v, %v, want %v", tt.args, got, err, tt.want)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"a", "b", "c", "d", "e"},
+		{"--price"},
+		{"--color", "red"},
+		{"--price", "1", "--price", "2"},
+		{"--price", "1", "title"},
+	} {
+		if _, err := parseFields(args); err == nil {
+			t.Errorf("parseFields(%q) accepted", args)
+		}
+	}
+}
+
+func TestApplyFields(t *testing.T) {
+	resetData(t)
+	product := ProductListing{Title: "Phone", Description: "Black", Price: Money{100, "SGD"},
+		Category: "Electronics"}
+
+	err := applyFields(&product, map[string]string{"price": "'9.50 USD'", "title": " 'Red phone' "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Title != "Red phone" || product.Price != (Money{950, "USD"}) ||
+		product.Description != "Black" {
+		t.Errorf("applied %v", product)
+	}
+
+	for field, value := range map[string]string{"title": "  ", "description": "a|b",
+		"price": "cheap"} {
+		p := product
+		if err := applyFields(&p, map[string]string{field: value}); err == nil {
+			t.Errorf("%s %q accepted", field, value)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBADS = errors.New("Error - Invalid sort, use field:{asc|desc} with price, created, title or id")
+	ErrBADA = errors.New("Error - Invalid filter argument")
+)
+
+// sortKey - One field of a multi key sort
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+// Filter - Conditions and order of a list command, set by --min-price,
+//          --max-price, --since, --until, --seller, --status, --sort,
+//          --descendants, --attr and --tag
+type Filter struct {
+	minPrice Money
+	maxPrice Money
+	hasMin   bool
+	hasMax   bool
+	since    time.Time
+	until    time.Time
+	seller   string
+	status   string
+	sort     []sortKey
+	attrs    attrFilter
+
+	// descendants - Take in the categories below the category asked for
+	descendants bool
+}
+
+// createdTime - Creation time of a product, zero when it cannot be parsed
+func createdTime(product ProductListing) time.Time {
+	t, _ := time.ParseInLocation(timeFormat, product.CreatedAt, time.Local)
+	return t
+}
+
+// parseDate - Parse 2006-01-02 or 2006-01-02T15:04, a bare date is
+//             extended to the end of the day when used as an upper bound
+func parseDate(value string, upper bool) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02T15:04", strings.ToUpper(value), time.Local)
+	if err == nil {
+		return t, nil
+	}
+
+	t, err = time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, ErrBADA
+	}
+	if upper {
+		t = t.Add(24*time.Hour - time.Minute)
+	}
+
+	return t, nil
+}
+
+// parseSort - Parse price:asc,created:desc into sort keys
+func parseSort(value string) ([]sortKey, error) {
+	var keys []sortKey
+
+	for _, spec := range strings.Split(value, ",") {
+		kv := strings.SplitN(spec, ":", 2)
+		key := sortKey{field: strings.ToLower(kv[0])}
+		switch key.field {
+		case "time":
+			key.field = "created"
+		case "price", "created", "title", "id":
+		default:
+			return nil, ErrBADS
+		}
+
+		if len(kv) == 2 {
+			switch strings.ToLower(kv[1]) {
+			case "asc":
+			case "desc", "dsc":
+				key.desc = true
+			default:
+				return nil, ErrBADS
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// ParseFilter - Take the filter and sort flags out of the arguments. The
+//               positional {sort_price|sort_time} {asc|dsc} form is kept.
+func ParseFilter(args []string) (filter Filter, rest []string, err error) {
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+
+		if (flag == "sort_price" || flag == "sort_time") && i+1 < len(args) {
+			field := "price"
+			if flag == "sort_time" {
+				field = "created"
+			}
+			keys, err := parseSort(field + ":" + args[i+1])
+			if err != nil {
+				return filter, nil, err
+			}
+			filter.sort = append(filter.sort, keys...)
+			i++
+			continue
+		}
+
+		if !strings.HasPrefix(flag, "--") {
+			rest = append(rest, flag)
+			continue
+		}
+		if flag == "--descendants" {
+			filter.descendants = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return filter, nil, ErrBADA
+		}
+		value := trimQuotes(args[i+1])
+		i++
+
+		switch flag {
+		case "--min-price":
+			filter.minPrice, err = ParseMoney(value)
+			filter.hasMin = true
+		case "--max-price":
+			filter.maxPrice, err = ParseMoney(value)
+			filter.hasMax = true
+		case "--since":
+			filter.since, err = parseDate(value, false)
+		case "--until":
+			filter.until, err = parseDate(value, true)
+		case "--seller":
+			filter.seller = canonicalUsername(value)
+		case "--status":
+			filter.status, err = parseStatus(value)
+		case "--sort":
+			var keys []sortKey
+			keys, err = parseSort(value)
+			filter.sort = append(filter.sort, keys...)
+		case "--attr", "--tag":
+			err = filter.attrs.add(flag, value)
+		default:
+			err = ErrBADA
+		}
+		if err != nil {
+			if err != ErrBADS && err != ErrBADU && err != ErrBADM &&
+				err != ErrATTR && err != ErrTAGN {
+				err = ErrBADA
+			}
+			return filter, nil, err
+		}
+	}
+
+	return filter, rest, nil
+}
+
+// match - Check a product against the conditions of the filter, only
+//         active products match unless --status says otherwise
+func (filter Filter) match(product ProductListing) bool {
+	if !matchStatus(product, filter.status) {
+		return false
+	}
+	if filter.hasMin {
+		c, ok := product.Price.Compare(filter.minPrice)
+		if !ok || c < 0 {
+			return false
+		}
+	}
+	if filter.hasMax {
+		c, ok := product.Price.Compare(filter.maxPrice)
+		if !ok || c > 0 {
+			return false
+		}
+	}
+	if len(filter.seller) > 0 && !sameUser(filter.seller, product.Username) {
+		return false
+	}
+	if !filter.attrs.match(product) {
+		return false
+	}
+
+	if !filter.since.IsZero() || !filter.until.IsZero() {
+		created := createdTime(product)
+		if !filter.since.IsZero() && created.Before(filter.since) {
+			return false
+		}
+		if !filter.until.IsZero() && created.After(filter.until) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compareField - Three way comparison of a single field of two products
+func compareField(field string, a ProductListing, b ProductListing) int {
+	switch field {
+	case "price":
+		// Prices without an exchange rate come after the others, by
+		// currency code then amount, so the order stays transitive
+		va, oka := a.Price.inDefault()
+		vb, okb := b.Price.inDefault()
+		switch {
+		case oka && okb:
+			return va.Cmp(vb)
+		case oka != okb:
+			if oka {
+				return -1
+			}
+			return 1
+		}
+		if c := strings.Compare(a.Price.Currency, b.Price.Currency); c != 0 {
+			return c
+		}
+		if a.Price.Amount != b.Price.Amount {
+			if a.Price.Amount < b.Price.Amount {
+				return -1
+			}
+			return 1
+		}
+	case "created":
+		ta, tb := createdTime(a), createdTime(b)
+		if ta.Before(tb) {
+			return -1
+		} else if ta.After(tb) {
+			return 1
+		}
+	case "title":
+		return strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	case "id":
+		return a.Id - b.Id
+	}
+
+	return 0
+}
+
+// less - Compare two products by the sort keys of the filter, asc puts
+//        the lowest price or the oldest item first and desc the opposite.
+//        ID ascending is the default order and breaks ties.
+func (filter Filter) less(a ProductListing, b ProductListing) bool {
+	for _, key := range filter.sort {
+		c := compareField(key.field, a, b)
+		if c != 0 {
+			if key.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+	}
+
+	return a.Id < b.Id
+}
+
+// sortProducts - Sort products with the order of the filter
+func sortProducts(products []ProductListing, filter Filter) {
+	sort.SliceStable(products, func(i, j int) bool {
+		return filter.less(products[i], products[j])
+	})
+}
@@ -0,0 +1,227 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// filterProducts - Items priced and created apart, ID 1 is the cheapest
+//                  and the oldest
+func filterProducts() []ProductListing {
+	return []ProductListing{
+		{Id: 1, Title: "b", Price: Money{1000, "SGD"}, CreatedAt: "20-02-2019-10:00AM", Status: StatusActive},
+		{Id: 2, Title: "a", Price: Money{3000, "SGD"}, CreatedAt: "22-02-2019-11:30PM", Status: StatusActive},
+		{Id: 3, Title: "c", Price: Money{2000, "SGD"}, CreatedAt: "21-02-2019-10:00AM", Status: StatusActive},
+		{Id: 4, Title: "a", Price: Money{1000, "SGD"}, CreatedAt: "23-02-2019-10:00AM", Status: StatusActive},
+	}
+}
+
+func sortedIds(t *testing.T, args ...string) []int {
+	t.Helper()
+
+	filter, _, err := ParseFilter(args)
+	if err != nil {
+		t.Fatalf("ParseFilter(%q): %s", args, err)
+	}
+	products := filterProducts()
+	sortProducts(products, filter)
+
+	var ids []int
+	for _, p := range products {
+		ids = append(ids, p.Id)
+	}
+
+	return ids
+}
+
+func TestSortDirection(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []int
+	}{
+		{nil, []int{1, 2, 3, 4}},
+		{[]string{"sort_price", "asc"}, []int{1, 4, 3, 2}},
+		{[]string{"sort_price", "dsc"}, []int{2, 3, 1, 4}},
+		{[]string{"sort_time", "asc"}, []int{1, 3, 2, 4}},
+		{[]string{"sort_time", "dsc"}, []int{4, 2, 3, 1}},
+		{[]string{"--sort", "price:desc"}, []int{2, 3, 1, 4}},
+		{[]string{"--sort", "time"}, []int{1, 3, 2, 4}},
+		{[]string{"--sort", "created:desc"}, []int{4, 2, 3, 1}},
+		{[]string{"--sort", "title"}, []int{2, 4, 1, 3}},
+		{[]string{"--sort", "id:desc"}, []int{4, 3, 2, 1}},
+	}
+
+	for _, tt := range tests {
+		if got := sortedIds(t, tt.args...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sort %q = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSortMultiKey(t *testing.T) {
+	tests := []struct {
+		sort string
+		want []int
+	}{
+		{"price:asc,created:desc", []int{4, 1, 3, 2}},
+		{"price:asc,created:asc", []int{1, 4, 3, 2}},
+		{"title,price:desc", []int{2, 4, 1, 3}},
+		{"title:desc,id:desc", []int{3, 1, 4, 2}},
+	}
+
+	for _, tt := range tests {
+		if got := sortedIds(t, "--sort", tt.sort); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("--sort %s = %v, want %v", tt.sort, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"price:up", "color", ""} {
+		if _, _, err := ParseFilter([]string{"--sort", bad}); err != ErrBADS {
+			t.Errorf("--sort %q: %v, want %v", bad, err, ErrBADS)
+		}
+	}
+}
+
+func TestFilterBounds(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []int
+	}{
+		{[]string{"--min-price", "20"}, []int{2, 3}},
+		{[]string{"--max-price", "20"}, []int{1, 3, 4}},
+		{[]string{"--min-price", "10", "--max-price", "10.00"}, []int{1, 4}},
+		{[]string{"--since", "2019-02-21"}, []int{2, 3, 4}},
+		{[]string{"--since", "2019-02-22T23:30"}, []int{2, 4}},
+		{[]string{"--until", "2019-02-21"}, []int{1, 3}},
+		{[]string{"--until", "2019-02-22"}, []int{1, 2, 3}},
+		{[]string{"--until", "2019-02-22T23:29"}, []int{1, 3}},
+		{[]string{"--since", "2019-02-21", "--until", "2019-02-22", "--max-price", "25"}, []int{3}},
+	}
+
+	for _, tt := range tests {
+		// The items are past the listing TTL, they are expired
+		filter, _, err := ParseFilter(append([]string{"--status", "all"}, tt.args...))
+		if err != nil {
+			t.Fatalf("ParseFilter(%q): %s", tt.args, err)
+		}
+		var got []int
+		for _, p := range filterProducts() {
+			if filter.match(p) {
+				got = append(got, p.Id)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("filter %q = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+
+	for _, args := range [][]string{{"--since", "yesterday"}, {"--min-price"}, {"--color", "red"}} {
+		if _, _, err := ParseFilter(args); err != ErrBADA {
+			t.Errorf("ParseFilter(%q): %v, want %v", args, err, ErrBADA)
+		}
+	}
+}
+
+func TestParseDateUpperBound(t *testing.T) {
+	until, err := parseDate("2019-02-22", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2019, 2, 22, 23, 59, 0, 0, time.Local); !until.Equal(want) {
+		t.Errorf("until = %s, want %s", until, want)
+	}
+}
+
+// TestFilterLocalTime - Dates given to --since and --until are local
+//                       times, as the creation time of the items
+func TestFilterLocalTime(t *testing.T) {
+	for _, hours := range testZones {
+		func() {
+			defer inZone(hours)()
+
+			now := time.Now()
+			product := ProductListing{CreatedAt: now.Format(timeFormat)}
+			if created := createdTime(product); now.Sub(created) < 0 || now.Sub(created) > 2*time.Minute {
+				t.Errorf("UTC%+d: created %s read as %s", hours, product.CreatedAt, created)
+			}
+
+			before := now.Add(-30 * time.Minute).Format("2006-01-02T15:04")
+			since, err := parseDate(before, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := now.Sub(since); d < 29*time.Minute || d > 31*time.Minute {
+				t.Errorf("UTC%+d: --since %s is %s before now", hours, before, d)
+			}
+		}()
+	}
+}
+
+// TestSortPriceTransitive - Prices without an exchange rate sort after the
+//                           others, whatever their currency code
+func TestSortPriceTransitive(t *testing.T) {
+	resetData(t)
+	err := SetExchangeRate("USD", "1.35")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	products := []ProductListing{
+		{Id: 1, Price: Money{1000, "TWD"}},
+		{Id: 2, Price: Money{100, "USD"}},
+		{Id: 3, Price: Money{200, "SGD"}},
+		{Id: 4, Price: Money{500, "EUR"}},
+		{Id: 5, Price: Money{100, "TWD"}},
+	}
+	for _, a := range products {
+		for _, b := range products {
+			for _, c := range products {
+				ab, bc := compareField("price", a, b), compareField("price", b, c)
+				if ab < 0 && bc < 0 && compareField("price", a, c) >= 0 {
+					t.Errorf("%v < %v < %v but not %v < %v", a.Price, b.Price,
+						c.Price, a.Price, c.Price)
+				}
+			}
+		}
+	}
+
+	filter, _, _ := ParseFilter([]string{"--sort", "price"})
+	sortProducts(products, filter)
+	var ids []int
+	for _, p := range products {
+		ids = append(ids, p.Id)
+	}
+	if want := []int{2, 3, 4, 5, 1}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("sort price = %v, want %v", ids, want)
+	}
+}
@@ -32,10 +32,41 @@ package utils
 import (
 	"errors"
 	"path/filepath"
+	"regexp"
+	"strings"
 )
 
 var cmdpath string = "./commands/"
 
+var (
+	// commandWords - A word of a command line, quoted words stay whole
+	commandWords = regexp.MustCompile("'.*?'|\".*?\"|\\S+")
+
+	// pathCommands - Commands taking a file path, their arguments after
+	//                the username keep their case
+	pathCommands = map[string]bool{"attach_image": true, "import_listings": true,
+		"backup": true, "export": true, "restore": true}
+)
+
+// SplitCommand - Split a command line into its words in lower case. The
+//                arguments of a command taking a file path keep their
+//                case, files are told apart by it, its flags do not.
+func SplitCommand(line string) []string {
+	words := commandWords.FindAllString(strings.TrimSuffix(line, "\n"), -1)
+	if len(words) == 0 {
+		return nil
+	}
+
+	keep := pathCommands[strings.ToLower(words[0])]
+	for i, word := range words {
+		if !keep || i < 2 || strings.HasPrefix(word, "--") {
+			words[i] = strings.ToLower(word)
+		}
+	}
+
+	return words
+}
+
 // FindCmd - Find a command inside ./commands CWD
 func FindCmd(command []string) (fullpath string, err error) {
 	for _, v := range command {
@@ -0,0 +1,66 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"GET_LISTING User1 3\n", []string{"get_listing", "user1", "3"}},
+		{"ATTACH_IMAGE User1 3 /Photos/Camera.PNG\n",
+			[]string{"attach_image", "user1", "3", "/Photos/Camera.PNG"}},
+		{"attach_image user1 3 '/My Photos/IMG_01.jpg'",
+			[]string{"attach_image", "user1", "3", "'/My Photos/IMG_01.jpg'"}},
+		{"IMPORT_LISTINGS User1 /Data/Items.CSV --DRY-RUN",
+			[]string{"import_listings", "user1", "/Data/Items.CSV", "--dry-run"}},
+		{"IMPORT_LISTINGS alice --DRY-RUN Listings.csv --Format JSON",
+			[]string{"import_listings", "alice", "--dry-run", "Listings.csv", "--format", "JSON"}},
+		{"BACKUP Admin /Backups/Monday.tar", []string{"backup", "admin", "/Backups/Monday.tar"}},
+		{"RESTORE admin --FORCE Backup.tar", []string{"restore", "admin", "--force", "Backup.tar"}},
+		{"EXPORT User1 '/Exports/User 1.tar.gz'",
+			[]string{"export", "user1", "'/Exports/User 1.tar.gz'"}},
+		{"CREATE_LISTING User1 'Vintage Camera' 'Old' 100 'Electronics'",
+			[]string{"create_listing", "user1", "'vintage camera'", "'old'", "100", "'electronics'"}},
+		{"\n", nil},
+	}
+
+	for _, tt := range tests {
+		got := SplitCommand(tt.line)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitCommand(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// blobPrefix - Directory of the blobs inside a backup archive
+	blobPrefix = "blobs/"
+
+	maxImageSize   = 5 << 20
+	maxImagePixels = 40000000
+	maxImages      = 8
+	thumbSize      = 160
+)
+
+var (
+	csvImagesPath = "/tmp/images.csv"
+
+	// blobDir - Content addressed store of the images, a blob is named
+	//           after the sha256 of its content
+	blobDir = "/tmp/blobs"
+
+	ErrIMGF = errors.New("Error - Unsupported image, use a jpeg, png or gif file")
+	ErrIMGS = fmt.Errorf("Error - Image too large, the limit is %dMB and %d megapixels",
+		maxImageSize>>20, maxImagePixels/1000000)
+	ErrIMGD = errors.New("Error - The image is already attached to this listing")
+	ErrIMGM = fmt.Errorf("Error - A listing has at most %d images", maxImages)
+	ErrIMGN = errors.New("Error - No such image on this listing, see GET_LISTING")
+
+	// imageExtensions - Blob file extension of the supported formats
+	imageExtensions = map[string]string{"jpeg": "jpg", "png": "png", "gif": "gif"}
+)
+
+// listingImage - An image attached to a listing
+type listingImage struct {
+	listing    int
+	sum        string
+	format     string
+	width      int
+	height     int
+	size       int
+	attachedAt string
+}
+
+// blob - File name of the image in the blob directory
+func (img listingImage) blob() string {
+	return img.sum + "." + imageExtensions[img.format]
+}
+
+// thumb - File name of the thumbnail of the image in the blob directory
+func (img listingImage) thumb() string {
+	return img.sum + ".thumb.png"
+}
+
+// parseImage - Parse a row of the csv image file, each row is
+//              listing|sha256|format|width|height|size|attached at
+func parseImage(entry string) (listingImage, error) {
+	splEntry := strings.Split(entry, "|")
+	if len(splEntry) != 7 {
+		return listingImage{}, ErrMALF
+	}
+
+	var n [4]int
+	for i, field := range []string{splEntry[0], splEntry[3], splEntry[4], splEntry[5]} {
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return listingImage{}, ErrMALF
+		}
+		n[i] = v
+	}
+	if _, ok := imageExtensions[splEntry[2]]; !ok {
+		return listingImage{}, ErrMALF
+	}
+
+	return listingImage{listing: n[0], sum: splEntry[1], format: splEntry[2],
+		width: n[1], height: n[2], size: n[3], attachedAt: splEntry[6]}, nil
+}
+
+// imageRecord - Format an image as a row of the csv image file
+func imageRecord(img listingImage) string {
+	return fmt.Sprintf("%d|%s|%s|%d|%d|%d|%s", img.listing, img.sum, img.format,
+		img.width, img.height, img.size, img.attachedAt)
+}
+
+// loadImages - Read the images of every listing, in the order attached
+func loadImages() []listingImage {
+	var images []listingImage
+	for _, line := range readCSVRows(csvImagesPath) {
+		img, err := parseImage(line[0])
+		if err == nil {
+			images = append(images, img)
+		}
+	}
+
+	return images
+}
+
+// imageRows - Rows of the csv image file
+func imageRows(images []listingImage) [][]string {
+	var lines [][]string
+	for _, img := range images {
+		lines = append(lines, []string{imageRecord(img)})
+	}
+
+	return lines
+}
+
+// saveImages - Regenerates the csv image file and removes the blobs no
+//              image refers to anymore
+func saveImages(images []listingImage) error {
+	err := writeCSVAtomic(csvImagesPath, imageRows(images))
+	if err == nil {
+		dropBlobs(images)
+	}
+
+	return err
+}
+
+// dropBlobs - Remove the blobs no image refers to anymore
+func dropBlobs(images []listingImage) {
+	used := make(map[string]bool)
+	for _, img := range images {
+		used[img.blob()] = true
+		used[img.thumb()] = true
+	}
+
+	names, _ := ioutil.ReadDir(blobDir)
+	for _, f := range names {
+		if !used[f.Name()] {
+			os.Remove(filepath.Join(blobDir, f.Name()))
+		}
+	}
+}
+
+// journalImages - Regenerates the csv image file as a change of the
+//                 journal, then removes the blobs no image refers to
+func journalImages(actor string, images []listingImage) error {
+	err := saveRows(actor, "images", imageRows(images))
+	if err == nil {
+		dropBlobs(images)
+	}
+
+	return err
+}
+
+// listingImages - The images of a listing, in the order attached
+func listingImages(images []listingImage, id int) []listingImage {
+	var mine []listingImage
+	for _, img := range images {
+		if img.listing == id {
+			mine = append(mine, img)
+		}
+	}
+
+	return mine
+}
+
+// readImageFile - Read and check an image file, giving its content and
+//                 its format and size
+func readImageFile(path string) ([]byte, image.Config, string, error) {
+	var config image.Config
+
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, config, "", fmt.Errorf("Error - Cannot read %s", path)
+	}
+	if info.Size() > maxImageSize {
+		return nil, config, "", ErrIMGS
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, config, "", fmt.Errorf("Error - Cannot read %s", path)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if _, ok := imageExtensions[format]; err != nil || !ok {
+		return nil, config, "", ErrIMGF
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, config, "", ErrIMGF
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, config, "", ErrIMGS
+	}
+
+	return data, config, format, nil
+}
+
+// thumbnail - Scale an image down to fit in thumbSize pixels, each pixel
+//             of the thumbnail is the average of the pixels it covers
+func thumbnail(src image.Image) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > thumbSize || h > thumbSize {
+		if w >= h {
+			tw, th = thumbSize, h*thumbSize/w
+		} else {
+			tw, th = w*thumbSize/h, thumbSize
+		}
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n),
+				uint16(bl / n), uint16(a / n)})
+		}
+	}
+
+	return dst
+}
+
+// writeBlob - Store data in the blob directory under name, a blob that
+//             is already there has the same content
+func writeBlob(name string, data []byte) error {
+	path := filepath.Join(blobDir, name)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	err := os.MkdirAll(blobDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// AttachImage - Copy an image file into the blob directory, with its
+//               thumbnail, and attach it to a listing of the user
+func AttachImage(username string, id int, path string) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	product, err := findProduct(id)
+	if err != nil {
+		return err
+	}
+	if !sameUser(username, product.Username) {
+		return ErrOWN
+	}
+
+	data, config, format, err := readImageFile(trimQuotes(path))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	img := listingImage{listing: id, sum: hex.EncodeToString(sum[:]),
+		format: format, width: config.Width, height: config.Height,
+		size: len(data), attachedAt: time.Now().Format(timeFormat)}
+
+	images := loadImages()
+	mine := listingImages(images, id)
+	for _, other := range mine {
+		if other.sum == img.sum {
+			return ErrIMGD
+		}
+	}
+	if len(mine) >= maxImages {
+		return ErrIMGM
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ErrIMGF
+	}
+	var thumb bytes.Buffer
+	err = png.Encode(&thumb, thumbnail(src))
+	if err != nil {
+		return err
+	}
+
+	err = writeBlob(img.blob(), data)
+	if err == nil {
+		err = writeBlob(img.thumb(), thumb.Bytes())
+	}
+	if err == nil {
+		err = journalImages(username, append(images, img))
+	}
+
+	return err
+}
+
+// DetachImage - Remove an image from a listing of the user, given by its
+//               number on the listing or a prefix of its sha256. The blob
+//               goes once no listing has the image.
+func DetachImage(username string, id int, which string) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	product, err := findProduct(id)
+	if err != nil {
+		return err
+	}
+	if !sameUser(username, product.Username) {
+		return ErrOWN
+	}
+
+	// A number is the image number when the listing has that many images,
+	// otherwise it is a prefix of the sha256 made of digits only
+	which = strings.ToLower(trimQuotes(which))
+	images := loadImages()
+	n, err := strconv.Atoi(which)
+	if err != nil || n < 1 || n > len(listingImages(images, id)) {
+		n = 0
+	}
+	var kept []listingImage
+	found, number := 0, 0
+	for _, img := range images {
+		if img.listing == id {
+			number++
+			if number == n || (n == 0 && len(which) >= 6 && strings.HasPrefix(img.sum, which)) {
+				found++
+				continue
+			}
+		}
+		kept = append(kept, img)
+	}
+	if found == 0 {
+		return ErrIMGN
+	}
+	if found > 1 {
+		return errors.New("Error - More than one image matches, give more of the sha256")
+	}
+
+	return journalImages(username, kept)
+}
+
+// imageLines - The images of a listing as
+//              number|blob|thumbnail|format|widthxheight|size
+func imageLines(id int) []string {
+	var lines []string
+	for i, img := range listingImages(loadImages(), id) {
+		lines = append(lines, fmt.Sprintf("%d|%s|%s|%s|%dx%d|%d bytes", i+1,
+			filepath.Join(blobDir, img.blob()), filepath.Join(blobDir, img.thumb()),
+			img.format, img.width, img.height, img.size))
+	}
+
+	return lines
+}
+
+// dropImages - Remove the images of purged products and their blobs
+func dropImages(ids map[int]bool) error {
+	var kept []listingImage
+	images := loadImages()
+	for _, img := range images {
+		if !ids[img.listing] {
+			kept = append(kept, img)
+		}
+	}
+	if len(kept) == len(images) {
+		return nil
+	}
+
+	return saveImages(kept)
+}
+
+// isBlobEntry - Check if an archive entry is a blob, blobs/ and a plain
+//               file name
+func isBlobEntry(name string) bool {
+	base := strings.TrimPrefix(name, blobPrefix)
+
+	return base != name && len(base) > 0 && base != "." && base != ".." &&
+		!strings.ContainsAny(base, "/\\")
+}
+
+// readBlobs - Blobs of the images as archive entries
+func readBlobs(images []listingImage, files map[string][]byte) error {
+	for _, img := range images {
+		for _, name := range []string{img.blob(), img.thumb()} {
+			data, err := ioutil.ReadFile(filepath.Join(blobDir, name))
+			if err != nil {
+				return err
+			}
+			files[blobPrefix+name] = data
+		}
+	}
+
+	return nil
+}
+
+// restoreBlobs - Replace the blob directory with the blobs of an archive
+func restoreBlobs(files map[string][]byte) error {
+	err := os.RemoveAll(blobDir)
+	if err != nil {
+		return err
+	}
+
+	for name, data := range files {
+		if !isBlobEntry(name) {
+			continue
+		}
+		err = writeBlob(strings.TrimPrefix(name, blobPrefix), data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,243 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writePNG - Write a png image of the given size and colour under the
+//            scratch directory and return its path
+func writePNG(t *testing.T, name string, width int, height int, c color.Color) string {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	path := filepath.Join(testDir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// blobExists - Check if a blob is in the blob directory
+func blobExists(name string) bool {
+	_, err := os.Stat(filepath.Join(blobDir, name))
+	return err == nil
+}
+
+func TestAttachImage(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	path := writePNG(t, "Camera.PNG", 400, 200, color.RGBA{200, 0, 0, 255})
+
+	if err := AttachImage("user2", id, path); err != ErrOWN {
+		t.Errorf("attach by another user: %v, want %v", err, ErrOWN)
+	}
+	if err := AttachImage("user1", id, filepath.Join(testDir, "camera.png")); err == nil {
+		t.Error("attach with the case of the path changed succeeded")
+	}
+	if err := AttachImage("user1", id, "'"+path+"'"); err != nil {
+		t.Fatalf("attach %s: %s", path, err)
+	}
+	if err := AttachImage("user1", id, path); err != ErrIMGD {
+		t.Errorf("attach twice: %v, want %v", err, ErrIMGD)
+	}
+
+	lines := imageLines(id)
+	if len(lines) != 1 {
+		t.Fatalf("images %q, want one", lines)
+	}
+	if fields := strings.Split(lines[0], "|"); fields[0] != "1" ||
+		fields[3] != "png" || fields[4] != "400x200" {
+		t.Errorf("image line %q", lines[0])
+	}
+	img := listingImages(loadImages(), id)[0]
+	if !blobExists(img.blob()) || !blobExists(img.thumb()) {
+		t.Errorf("blob or thumbnail of %s missing", img.sum)
+	}
+
+	f, err := os.Open(filepath.Join(blobDir, img.thumb()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	config, err := png.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != thumbSize || config.Height != thumbSize/2 {
+		t.Errorf("thumbnail %dx%d, want %dx%d", config.Width, config.Height,
+			thumbSize, thumbSize/2)
+	}
+}
+
+func TestAttachImageErrors(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	text := filepath.Join(testDir, "Notes.txt")
+	if err := ioutil.WriteFile(text, []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := AttachImage("user1", id, text); err != ErrIMGF {
+		t.Errorf("attach a text file: %v, want %v", err, ErrIMGF)
+	}
+	if err := AttachImage("user1", id+1, text); err != ErrLNE {
+		t.Errorf("attach to a missing listing: %v, want %v", err, ErrLNE)
+	}
+
+	for i := 0; i < maxImages; i++ {
+		path := writePNG(t, "Shot.png", 8, 8, color.Gray{uint8(i * 10)})
+		if err := AttachImage("user1", id, path); err != nil {
+			t.Fatalf("attach image %d: %s", i+1, err)
+		}
+	}
+	path := writePNG(t, "Shot.png", 8, 8, color.Gray{255})
+	if err := AttachImage("user1", id, path); err != ErrIMGM {
+		t.Errorf("attach image %d: %v, want %v", maxImages+1, err, ErrIMGM)
+	}
+}
+
+func TestDetachImage(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	first := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	second := createListing(t, "user1", "Camera bag", "20", "Electronics")
+	red := writePNG(t, "Red.png", 16, 16, color.RGBA{255, 0, 0, 255})
+	blue := writePNG(t, "Blue.png", 16, 16, color.RGBA{0, 0, 255, 255})
+
+	for _, attach := range []struct {
+		id   int
+		path string
+	}{{first, red}, {first, blue}, {second, red}} {
+		if err := AttachImage("user1", attach.id, attach.path); err != nil {
+			t.Fatalf("attach %s to %d: %s", attach.path, attach.id, err)
+		}
+	}
+	images := listingImages(loadImages(), first)
+	redImg, blueImg := images[0], images[1]
+
+	if err := DetachImage("user2", first, "1"); err != ErrOWN {
+		t.Errorf("detach by another user: %v, want %v", err, ErrOWN)
+	}
+	if err := DetachImage("user1", first, "3"); err != ErrIMGN {
+		t.Errorf("detach image 3: %v, want %v", err, ErrIMGN)
+	}
+	if err := DetachImage("user1", first, redImg.sum[:5]); err != ErrIMGN {
+		t.Errorf("detach by a short prefix: %v, want %v", err, ErrIMGN)
+	}
+
+	if err := DetachImage("user1", first, strings.ToUpper(blueImg.sum[:8])); err != nil {
+		t.Fatalf("detach by sha256 prefix: %s", err)
+	}
+	if blobExists(blueImg.blob()) || blobExists(blueImg.thumb()) {
+		t.Error("blob of a detached image kept")
+	}
+
+	if err := DetachImage("user1", first, "1"); err != nil {
+		t.Fatalf("detach image 1: %s", err)
+	}
+	if len(imageLines(first)) != 0 {
+		t.Errorf("images left on %d: %q", first, imageLines(first))
+	}
+	if !blobExists(redImg.blob()) {
+		t.Error("blob still attached to another listing removed")
+	}
+
+	if err := DetachImage("user1", second, "1"); err != nil {
+		t.Fatalf("detach image 1 of %d: %s", second, err)
+	}
+	if blobExists(redImg.blob()) {
+		t.Error("blob of an image no listing has kept")
+	}
+}
+
+// TestDetachImageDigitPrefix - A sha256 prefix made of digits only is not
+//                              taken for an image number
+func TestDetachImageDigitPrefix(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	var path, prefix string
+	for i := 0; i < 4096 && len(prefix) == 0; i++ {
+		path = writePNG(t, "Digits.png", 4, 4, color.RGBA{uint8(i), uint8(i >> 8), 0, 255})
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		if n, err := strconv.Atoi(hex.EncodeToString(sum[:])[:6]); err == nil && n > maxImages {
+			prefix = hex.EncodeToString(sum[:])[:6]
+		}
+	}
+	if len(prefix) == 0 {
+		t.Fatal("no image with a sha256 starting with digits")
+	}
+
+	other := writePNG(t, "Other.png", 4, 4, color.White)
+	for _, p := range []string{other, path} {
+		if err := AttachImage("user1", id, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := DetachImage("user1", id, prefix); err != nil {
+		t.Fatalf("detach by sha256 prefix %s: %s", prefix, err)
+	}
+	images := listingImages(loadImages(), id)
+	if len(images) != 1 || strings.HasPrefix(images[0].sum, prefix) {
+		t.Errorf("images left %v, want the one not starting with %s", images, prefix)
+	}
+}
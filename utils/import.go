@@ -0,0 +1,574 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	csvImportPath = "/tmp/import.csv"
+
+	ErrBADI = errors.New("Error - Invalid import option, use --format csv|json|ndjson, " +
+		"--map column=field, --batch N, --dry-run or --restart")
+	ErrFMT = errors.New("Error - Unknown file format, use --format csv|json|ndjson")
+
+	// importAliases - Column names understood without --map
+	importAliases = map[string]string{
+		"title":       "title",
+		"name":        "title",
+		"description": "description",
+		"desc":        "description",
+		"details":     "description",
+		"price":       "price",
+		"amount":      "price",
+		"currency":    "currency",
+		"category":    "category",
+		"tags":        "tags",
+	}
+)
+
+// Import - How IMPORT_LISTINGS reads a file and commits its rows. Without
+//          Batch every row commits at once or none does. With Batch the
+//          rows commit Batch at a time and the progress is kept, so a
+//          failed import resumes after the last committed batch.
+type Import struct {
+	Path    string
+	Format  string
+	Mapping map[string]string
+	Batch   int
+	DryRun  bool
+	Restart bool
+}
+
+// importRow - A record of the imported file, its line and its columns
+type importRow struct {
+	line    int
+	columns map[string]string
+}
+
+// ParseImport - Read the file and the options of IMPORT_LISTINGS
+func ParseImport(args []string) (imp Import, err error) {
+	imp.Mapping = make(map[string]string)
+
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		switch flag {
+		case "--dry-run":
+			imp.DryRun = true
+			continue
+		case "--restart":
+			imp.Restart = true
+			continue
+		case "--format", "--map", "--batch":
+		default:
+			if strings.HasPrefix(flag, "--") || len(imp.Path) > 0 {
+				return imp, ErrBADI
+			}
+			imp.Path = trimQuotes(flag)
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return imp, ErrBADI
+		}
+		value := trimQuotes(args[i+1])
+		i++
+
+		switch flag {
+		case "--format":
+			imp.Format = strings.ToLower(value)
+		case "--batch":
+			imp.Batch, err = strconv.Atoi(value)
+			if err != nil || imp.Batch < 1 {
+				return imp, ErrBADI
+			}
+		case "--map":
+			for _, pair := range strings.Split(value, ",") {
+				kv := strings.SplitN(strings.ToLower(pair), "=", 2)
+				if len(kv) != 2 || (!isListingField(kv[1]) && !isImportExtra(kv[1])) {
+					return imp, ErrBADI
+				}
+				imp.Mapping[kv[0]] = kv[1]
+			}
+		}
+	}
+
+	if len(imp.Path) == 0 {
+		return imp, errors.New("Error - You need to specify the file to import")
+	}
+
+	if len(imp.Format) == 0 {
+		imp.Format = strings.TrimPrefix(strings.ToLower(filepath.Ext(imp.Path)), ".")
+		if imp.Format == "jsonl" {
+			imp.Format = "ndjson"
+		}
+	}
+	if imp.Format != "csv" && imp.Format != "json" && imp.Format != "ndjson" {
+		return imp, ErrFMT
+	}
+
+	return imp, nil
+}
+
+// jsonColumns - Turn a JSON object into columns, numbers keep their text
+func jsonColumns(raw []byte) (map[string]string, error) {
+	var object map[string]interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err := dec.Decode(&object)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]string)
+	for key, value := range object {
+		switch v := value.(type) {
+		case string:
+			columns[key] = v
+		case json.Number:
+			columns[key] = v.String()
+		case nil:
+		default:
+			return nil, fmt.Errorf("%s is not a text or a number", key)
+		}
+	}
+
+	return columns, nil
+}
+
+// csvRecordLines - Line where each record of a csv file starts. Quoted
+//                  fields may hold line breaks and empty lines are skipped,
+//                  the same as the csv reader does.
+func csvRecordLines(data []byte) []int {
+	var lines []int
+
+	line := 1
+	for _, record := range splitCSVRecords(data) {
+		if len(bytes.TrimRight(record, "\r\n")) > 0 {
+			lines = append(lines, line)
+		}
+		line += bytes.Count(record, []byte("\n"))
+	}
+
+	return lines
+}
+
+// readImportCSV - Rows of a csv file, its first line names the columns
+func readImportCSV(data []byte) ([]importRow, error) {
+	var rows []importRow
+
+	r := csv.NewReader(bytes.NewReader(data))
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Error - Line 1 - %s", err)
+	}
+
+	lines := csvRecordLines(data)
+	for n := 1; ; n++ {
+		record, err := r.Read()
+		if err != nil {
+			if perr, ok := err.(*csv.ParseError); ok {
+				return nil, fmt.Errorf("Error - Line %d - %s", perr.Line, perr.Err)
+			}
+			break
+		}
+		line := 0
+		if n < len(lines) {
+			line = lines[n]
+		}
+		columns := make(map[string]string)
+		for i, value := range record {
+			columns[header[i]] = value
+		}
+		rows = append(rows, importRow{line, columns})
+	}
+
+	return rows, nil
+}
+
+// readImportNDJSON - Rows of a file with one JSON object per line
+func readImportNDJSON(data []byte) ([]importRow, error) {
+	var rows []importRow
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		columns, err := jsonColumns(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("Error - Line %d - %s", line, err)
+		}
+		rows = append(rows, importRow{line, columns})
+	}
+
+	return rows, scanner.Err()
+}
+
+// countingReader - Reader counting the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readImportJSON - Rows of a file holding a JSON array of objects, the
+//                  line of a row is where its object starts
+func readImportJSON(data []byte) ([]importRow, error) {
+	var rows []importRow
+
+	lineAt := func(offset int64) int {
+		for offset < int64(len(data)) && strings.ContainsRune(" \t\r\n,", rune(data[offset])) {
+			offset++
+		}
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+
+	// The decoder reads ahead, its offset is what it read less what
+	// it holds in its buffer
+	in := &countingReader{r: bytes.NewReader(data)}
+	dec := json.NewDecoder(in)
+	offset := func() int64 {
+		buffered, _ := ioutil.ReadAll(dec.Buffered())
+		return in.n - int64(len(buffered))
+	}
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, errors.New("Error - Line 1 - expected an array of objects")
+	}
+	for dec.More() {
+		line := lineAt(offset())
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err != nil {
+			return nil, fmt.Errorf("Error - Line %d - %s", line, err)
+		}
+		columns, err := jsonColumns(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Error - Line %d - %s", line, err)
+		}
+		rows = append(rows, importRow{line, columns})
+	}
+
+	return rows, nil
+}
+
+// fields - Map the columns of a row to listing fields, a currency column
+//          completes the price
+func (imp Import) fields(row importRow) map[string]string {
+	fields := make(map[string]string)
+
+	for column, value := range row.columns {
+		field, ok := imp.Mapping[strings.ToLower(column)]
+		if !ok {
+			field, ok = importAliases[strings.ToLower(strings.TrimSpace(column))]
+		}
+		if !ok && strings.HasPrefix(strings.ToLower(column), "attr.") {
+			field, ok = strings.ToLower(strings.TrimSpace(column)), true
+		}
+		if ok {
+			fields[field] = value
+		}
+	}
+
+	if currency, ok := fields["currency"]; ok {
+		fields["price"] = fields["price"] + " " + currency
+		delete(fields, "currency")
+	}
+
+	return fields
+}
+
+// importProduct - Validate a row and build its product
+func importProduct(username string, fields map[string]string) (ProductListing, error) {
+	product := ProductListing{Username: username,
+		CreatedAt: time.Now().Format(timeFormat)}
+
+	for _, field := range listingFields {
+		if len(strings.TrimSpace(fields[field])) == 0 {
+			return product, fmt.Errorf("Error - Missing %s", field)
+		}
+	}
+
+	err := applyFields(&product, fields)
+	if err != nil {
+		return product, err
+	}
+
+	changes, err := importAttributes(fields)
+	if err != nil {
+		return product, err
+	}
+	changes.Apply(&product)
+	err = checkAttributes(product)
+	if err != nil {
+		return product, err
+	}
+
+	return product, ValidateProduct(product)
+}
+
+// isImportExtra - Fields of a row besides listingFields: the currency of
+//                 the price, the tags and the attr.key attributes
+func isImportExtra(field string) bool {
+	return field == "currency" || field == "tags" || strings.HasPrefix(field, "attr.")
+}
+
+// importAttributes - Attributes from the attr.key fields and tags from the
+//                    tags field of a row
+func importAttributes(fields map[string]string) (AttrChanges, error) {
+	var args []string
+	for field, value := range fields {
+		if len(strings.TrimSpace(value)) == 0 {
+			continue
+		}
+		if strings.HasPrefix(field, "attr.") {
+			args = append(args, "--attr", strings.TrimPrefix(field, "attr.")+"="+value)
+		} else if field == "tags" {
+			args = append(args, "--tag", value)
+		}
+	}
+
+	changes, _, err := ParseAttributes(args)
+
+	return changes, err
+}
+
+// productKey - What makes two items duplicates, see duplicateOf
+func productKey(product ProductListing) string {
+	return trimQuotes(product.Title) + "|" + trimQuotes(product.Description) +
+		"|" + trimQuotes(product.Category)
+}
+
+// importProgress - Rows of a file already committed by a batched import
+func importProgress(username string, path string) int {
+	for _, line := range readCSVRows(csvImportPath) {
+		splEntry := strings.Split(line[0], "|")
+		if len(splEntry) == 3 && splEntry[0] == username && splEntry[1] == path {
+			done, _ := strconv.Atoi(splEntry[2])
+			return done
+		}
+	}
+
+	return 0
+}
+
+// saveImportProgress - Record the committed rows of a batched import,
+//                      a finished import drops its record
+func saveImportProgress(username string, path string, done int, finished bool) error {
+	var kept [][]string
+	for _, line := range readCSVRows(csvImportPath) {
+		if !strings.HasPrefix(line[0], username+"|"+path+"|") {
+			kept = append(kept, line)
+		}
+	}
+	if !finished {
+		kept = append(kept, []string{fmt.Sprintf("%s|%s|%d", username, path, done)})
+	}
+
+	return writeCSVAtomic(csvImportPath, kept)
+}
+
+// commitProducts - Add products to the item store in one atomic write
+//                  and refresh the search index
+func commitProducts(products []ProductListing) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The IDs are given again under the lock, another command may have
+	// taken some since the rows were validated
+	nextId, err := takeProductIds(len(products))
+	if err != nil {
+		return err
+	}
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	var seqs []int
+	for i := range products {
+		products[i].Id = nextId + i
+		seq, err := beginJournal(products[i].Username, JournalCreate, productRecord(products[i]))
+		if err != nil {
+			return err
+		}
+		seqs = append(seqs, seq)
+	}
+
+	err = store.update(products...)
+	for _, seq := range seqs {
+		if jerr := endJournal(seq, JournalCreate, err); jerr != err {
+			return jerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if RebuildSearchIndex() != nil {
+		return dropSearchIndex()
+	}
+
+	return nil
+}
+
+// ImportCSVItems - Import the listings of a file for username. Every row
+//                  is validated and its errors are printed with its line.
+//                  Returns how many listings were imported, or would be
+//                  on a dry run.
+func ImportCSVItems(username string, imp Import) (imported int, err error) {
+	user, ok := FindUser(username)
+	if !ok {
+		return 0, ErrUNKU
+	}
+	if !user.Active {
+		return 0, ErrUINA
+	}
+
+	data, err := ioutil.ReadFile(imp.Path)
+	if err != nil {
+		return 0, fmt.Errorf("Error - Cannot read %s", imp.Path)
+	}
+
+	var rows []importRow
+	switch imp.Format {
+	case "csv":
+		rows, err = readImportCSV(data)
+	case "json":
+		rows, err = readImportJSON(data)
+	case "ndjson":
+		rows, err = readImportNDJSON(data)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	done := 0
+	if imp.Batch > 0 && !imp.Restart {
+		done = importProgress(user.Username, imp.Path)
+		if done > len(rows) {
+			done = 0
+		}
+	}
+
+	products, err := loadProducts()
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool)
+	for _, product := range products {
+		seen[productKey(product)] = true
+	}
+
+	size := imp.Batch
+	if size == 0 {
+		size = len(rows)
+	}
+
+	nextId, err := LastProductId()
+	if err != nil {
+		return 0, err
+	}
+	failed := 0
+	for start := done; start < len(rows); start += size {
+		end := start + size
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var batch []ProductListing
+		for _, row := range rows[start:end] {
+			product, err := importProduct(user.Username, imp.fields(row))
+			if err == nil && seen[productKey(product)] {
+				err = ErrPAE
+			}
+			if err != nil {
+				fmt.Println(fmt.Sprintf("Line %d - %s", row.line, err))
+				failed++
+				continue
+			}
+			seen[productKey(product)] = true
+			product.Id = nextId
+			nextId++
+			batch = append(batch, product)
+		}
+
+		// Once a row failed the following batches are only validated
+		if imp.DryRun {
+			imported += len(batch)
+			continue
+		}
+		if failed > 0 {
+			continue
+		}
+
+		err = commitProducts(batch)
+		if err == nil && imp.Batch > 0 {
+			err = saveImportProgress(user.Username, imp.Path, end, end == len(rows))
+		}
+		if err != nil {
+			return imported, err
+		}
+		imported += len(batch)
+	}
+
+	if failed > 0 && imp.DryRun {
+		return imported, fmt.Errorf("Error - %d rows failed, %d listings are valid", failed, imported)
+	} else if failed > 0 && imp.Batch > 0 {
+		return imported, fmt.Errorf("Error - %d rows failed, %d listings imported, "+
+			"fix them and run the import again to resume", failed, imported)
+	} else if failed > 0 {
+		return 0, fmt.Errorf("Error - %d rows failed, nothing imported", failed)
+	}
+
+	return imported, nil
+}
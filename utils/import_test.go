@@ -0,0 +1,196 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeImport - Write a file to import into the test directory
+func writeImport(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(testDir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestCSVRecordLines(t *testing.T) {
+	data := "title,description\n\nphone,\"two\nlines\"\r\nshoes,plain\n"
+	if got := csvRecordLines([]byte(data)); !reflect.DeepEqual(got, []int{1, 3, 5}) {
+		t.Errorf("record lines = %v, want [1 3 5]", got)
+	}
+}
+
+func TestReadImportLines(t *testing.T) {
+	rows, err := readImportCSV([]byte("title,price\n\"Red\nphone\",10\n\nshoes,20\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].line != 2 || rows[1].line != 5 {
+		t.Errorf("csv rows = %v", rows)
+	}
+
+	rows, err = readImportJSON([]byte("[\n  {\"title\": \"phone\"},\n\n  {\"title\": \"shoes\",\n" +
+		"   \"price\": 20}\n]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].line != 2 || rows[1].line != 4 {
+		t.Errorf("json rows = %v", rows)
+	}
+	if rows[1].columns["price"] != "20" {
+		t.Errorf("json number = %q, want 20", rows[1].columns["price"])
+	}
+
+	rows, err = readImportNDJSON([]byte("{\"title\": \"phone\"}\n\n{\"title\": \"shoes\"}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].line != 1 || rows[1].line != 3 {
+		t.Errorf("ndjson rows = %v", rows)
+	}
+
+	_, err = readImportJSON([]byte("[\n {\"title\": \"phone\"},\n {\"title\": [1]}\n]"))
+	if err == nil || err.Error() != "Error - Line 3 - title is not a text or a number" {
+		t.Errorf("json error = %v", err)
+	}
+}
+
+func TestParseImport(t *testing.T) {
+	imp, err := ParseImport([]string{"'/data/Listings.JSONL'", "--map", "Name=title",
+		"--batch", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.Path != "/data/Listings.JSONL" || imp.Format != "ndjson" || imp.Batch != 2 ||
+		imp.Mapping["name"] != "title" {
+		t.Errorf("import = %+v", imp)
+	}
+
+	// Flags before the file, as the shell splits them
+	words := SplitCommand("IMPORT_LISTINGS alice --DRY-RUN --map Name=Title Listings.CSV")
+	imp, err = ParseImport(words[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.Path != "Listings.CSV" || imp.Format != "csv" || !imp.DryRun ||
+		imp.Mapping["name"] != "title" {
+		t.Errorf("import = %+v", imp)
+	}
+
+	if _, err := ParseImport([]string{"items.xml"}); err != ErrFMT {
+		t.Errorf("xml: %v, want %v", err, ErrFMT)
+	}
+	if _, err := ParseImport([]string{"items.csv", "--batch", "0"}); err != ErrBADI {
+		t.Errorf("batch 0: %v, want %v", err, ErrBADI)
+	}
+}
+
+func TestImportAllOrNothing(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	path := writeImport(t, "listings.csv", "title,description,price,category\n"+
+		"Phone,Brand new,100,Electronics\n"+
+		"Shoes,,50,Sports\n")
+
+	var err error
+	out := captureOutput(t, func() {
+		_, err = ImportCSVItems("user1", Import{Path: path, Format: "csv"})
+	})
+	if err == nil {
+		t.Fatal("import with a bad row succeeded")
+	}
+	if !hasLine(out, "Line 3", "description") {
+		t.Errorf("bad row not reported with its line: %q", out)
+	}
+	if len(listings(t)) != 0 {
+		t.Errorf("rows imported although one failed")
+	}
+
+	path = writeImport(t, "listings.csv", "title,description,price,category\n"+
+		"Phone,Brand new,100,Electronics\n"+
+		"Shoes,Running shoes,50,Sports\n")
+	n, err := ImportCSVItems("user1", Import{Path: path, Format: "csv"})
+	if err != nil || n != 2 {
+		t.Fatalf("imported %d: %v", n, err)
+	}
+
+	// The same rows again are duplicates
+	captureOutput(t, func() {
+		n, err = ImportCSVItems("user1", Import{Path: path, Format: "csv"})
+	})
+	if err == nil || len(listings(t)) != 2 {
+		t.Errorf("duplicates imported: %d, %v", len(listings(t)), err)
+	}
+}
+
+func TestImportBatchResume(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	path := writeImport(t, "listings.ndjson",
+		"{\"title\": \"Phone\", \"description\": \"New\", \"price\": 100, \"category\": \"Electronics\"}\n"+
+			"{\"title\": \"Shoes\", \"description\": \"Red\", \"price\": 50, \"category\": \"Sports\"}\n"+
+			"{\"title\": \"Hat\", \"price\": 5, \"category\": \"Fashion\"}\n")
+
+	var n int
+	var err error
+	captureOutput(t, func() {
+		n, err = ImportCSVItems("user1", Import{Path: path, Format: "ndjson", Batch: 2})
+	})
+	if err == nil || n != 2 {
+		t.Fatalf("first run imported %d: %v", n, err)
+	}
+	if done := importProgress("user1", path); done != 2 {
+		t.Errorf("progress = %d, want 2", done)
+	}
+
+	path = writeImport(t, "listings.ndjson",
+		"{\"title\": \"Phone\", \"description\": \"New\", \"price\": 100, \"category\": \"Electronics\"}\n"+
+			"{\"title\": \"Shoes\", \"description\": \"Red\", \"price\": 50, \"category\": \"Sports\"}\n"+
+			"{\"title\": \"Hat\", \"description\": \"Wool\", \"price\": 5, \"category\": \"Fashion\"}\n")
+	n, err = ImportCSVItems("user1", Import{Path: path, Format: "ndjson", Batch: 2})
+	if err != nil || n != 1 {
+		t.Fatalf("resumed run imported %d: %v", n, err)
+	}
+	if len(listings(t)) != 3 {
+		t.Errorf("%d listings, want 3", len(listings(t)))
+	}
+	if done := importProgress("user1", path); done != 0 {
+		t.Errorf("progress kept after a finished import: %d", done)
+	}
+}
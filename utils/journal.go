@@ -0,0 +1,646 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// journalCompactAt - Finished changes that trigger a compaction
+	journalCompactAt = 1000
+
+	JournalRegister = "register"
+	JournalCreate   = "create"
+	JournalUpdate   = "update"
+	JournalDelete   = "delete"
+	JournalRestore  = "restore"
+	JournalPurge    = "purge"
+
+	JournalRenameUser = "rename_user"
+	JournalDeleteUser = "delete_user"
+	JournalProfile    = "profile"
+
+	// JournalRows - Rows put in or dropped from a data file of rowFiles
+	JournalRows = "rows"
+	// JournalAcceptOffer - An accepted offer and the listing it reserves
+	JournalAcceptOffer = "accept_offer"
+
+	journalBegin      = "begin"
+	journalCommit     = "commit"
+	journalAbort      = "abort"
+	journalCheckpoint = "checkpoint"
+)
+
+var (
+	journalPath = "/tmp/journal.log"
+	lockPath    = "/tmp/carousell.lock"
+
+	ErrJCOR = errors.New("Error - journal is corrupted")
+
+	// lockFile, lockDepth - The data lock held by this process and how
+	//                       many callers hold it, so it can be nested
+	lockFile  *os.File
+	lockDepth int
+
+	// journalSeq - Last seq of the journal, known while the lock is held
+	journalSeq int
+)
+
+// rowFile - A data file changed row by row through the journal, key
+//           tells its rows apart
+type rowFile struct {
+	path *string
+	key  func(row string) string
+}
+
+// rowFiles - The data files changed row by row, by their name in the
+//            journal
+var rowFiles = map[string]rowFile{
+	"watches":    {&csvWatchPath, watchKey},
+	"offers":     {&csvOffersPath, leadingKey(1)},
+	"messages":   {&csvMessagesPath, leadingKey(1)},
+	"blocks":     {&csvBlocksPath, leadingKey(2)},
+	"reviews":    {&csvReviewsPath, leadingKey(1)},
+	"categories": {&csvCategoriesPath, leadingKey(1)},
+	"images":     {&csvImagesPath, leadingKey(2)},
+}
+
+// leadingKey - Key of rows told apart by their first n fields
+func leadingKey(n int) func(string) string {
+	return func(row string) string {
+		fields := strings.SplitN(row, "|", n+1)
+		if len(fields) > n {
+			fields = fields[:n]
+		}
+		return strings.Join(fields, "|")
+	}
+}
+
+// journalRecord - A row of the journal. A change writes a begin record
+//                 with the state it leads to before touching the data
+//                 files, then a commit or abort record with the same seq.
+type journalRecord struct {
+	seq     int
+	at      string
+	actor   string
+	op      string
+	phase   string
+	payload string
+}
+
+func (r journalRecord) body() string {
+	return fmt.Sprintf("%d|%s|%s|%s|%s|%s", r.seq, r.at, r.actor, r.op, r.phase, r.payload)
+}
+
+// encode - The record as a journal row, its crc32 follows the seq
+func (r journalRecord) encode() []string {
+	return []string{fmt.Sprintf("%d|%08x|%s|%s|%s|%s|%s", r.seq,
+		crc32.ChecksumIEEE([]byte(r.body())), r.at, r.actor, r.op, r.phase, r.payload)}
+}
+
+func decodeJournalRecord(line []string) (r journalRecord, ok bool) {
+	splEntry := strings.SplitN(line[0], "|", 7)
+	if len(line) != 1 || len(splEntry) != 7 {
+		return r, false
+	}
+
+	seq, err := strconv.Atoi(splEntry[0])
+	if err != nil {
+		return r, false
+	}
+	r = journalRecord{seq: seq, at: splEntry[2], actor: splEntry[3], op: splEntry[4],
+		phase: splEntry[5], payload: splEntry[6]}
+
+	return r, fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(r.body()))) == splEntry[1]
+}
+
+// lockData - Take the exclusive lock of the data files, a process that
+//            already holds it takes it again. The item store drops what
+//            it read before, another process may have changed it.
+func lockData() (unlock func(), err error) {
+	unlock = func() {
+		// The journal grew, it is compacted before the lock goes
+		if lockDepth == 1 && journalSeq != 0 {
+			compactJournal(false)
+		}
+		lockDepth--
+		if lockDepth == 0 {
+			syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+			lockFile.Close()
+			lockFile = nil
+			journalSeq = 0
+		}
+	}
+
+	if lockDepth > 0 {
+		lockDepth++
+		return unlock, nil
+	}
+
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	lockFile = file
+	lockDepth = 1
+
+	err = refreshStore()
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	return unlock, nil
+}
+
+// readJournal - Read the journal and the size of its valid part. A bad
+//               last record is a write cut short by a crash and ends the
+//               journal, a bad record followed by good ones is corruption.
+func readJournal() ([]journalRecord, int64, error) {
+	var records []journalRecord
+
+	data, err := ioutil.ReadFile(journalPath)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	var valid int64
+	lines := splitCSVRecords(data)
+	for i, raw := range lines {
+		line, err := csv.NewReader(bytes.NewReader(raw)).Read()
+		if err == io.EOF {
+			valid += int64(len(raw))
+			continue
+		}
+		record, ok := journalRecord{}, false
+		if err == nil {
+			record, ok = decodeJournalRecord(line)
+		}
+		if !ok {
+			if i < len(lines)-1 {
+				return nil, 0, ErrJCOR
+			}
+			break
+		}
+		records = append(records, record)
+		valid += int64(len(raw))
+	}
+
+	return records, valid, nil
+}
+
+// appendJournal - Append a record and flush it to the disk
+func appendJournal(record journalRecord) error {
+	file, err := os.OpenFile(journalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write(record.encode())
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// beginJournal - Record a change and the state it leads to before it is
+//                applied, the caller holds the data lock
+func beginJournal(actor string, op string, payload string) (int, error) {
+	if journalSeq == 0 {
+		records, _, err := readJournal()
+		if err != nil {
+			return 0, err
+		}
+		if len(records) > 0 {
+			journalSeq = records[len(records)-1].seq
+		}
+	}
+
+	journalSeq++
+	return journalSeq, appendJournal(journalRecord{seq: journalSeq,
+		at: time.Now().Format(timeFormat), actor: canonicalUsername(actor),
+		op: op, phase: journalBegin, payload: payload})
+}
+
+// endJournal - Record whether a change was applied. err is the outcome of
+//              the change and is returned unless the journal fails.
+func endJournal(seq int, op string, err error) error {
+	phase, payload := journalCommit, ""
+	if err != nil {
+		phase, payload = journalAbort, err.Error()
+	}
+
+	jerr := appendJournal(journalRecord{seq: seq, at: time.Now().Format(timeFormat),
+		op: op, phase: phase, payload: payload})
+	if jerr != nil {
+		return jerr
+	}
+
+	return err
+}
+
+// saveRows - Rewrite a data file of rowFiles as a change of the journal.
+//            The begin record holds the rows put in and the keys of the
+//            rows dropped, a crash halfway is finished on the next start.
+func saveRows(actor string, name string, lines [][]string) error {
+	file := rowFiles[name]
+	payload, changed := rowChanges(name, file, readCSVRows(*file.path), lines)
+	if !changed {
+		return nil
+	}
+
+	seq, err := beginJournal(actor, JournalRows, payload)
+	if err != nil {
+		return err
+	}
+
+	return endJournal(seq, JournalRows, writeCSVAtomic(*file.path, lines))
+}
+
+// rowChanges - The payload of a rows change, the name of the file then
+//              +row for each row put in and -key for each row dropped
+func rowChanges(name string, file rowFile, before [][]string, after [][]string) (string, bool) {
+	old := make(map[string]string)
+	for _, line := range before {
+		old[file.key(line[0])] = line[0]
+	}
+
+	fields := []string{name}
+	kept := make(map[string]bool)
+	for _, line := range after {
+		key := file.key(line[0])
+		if row, ok := old[key]; !ok || row != line[0] {
+			fields = append(fields, "+"+line[0])
+		}
+		kept[key] = true
+	}
+	for _, line := range before {
+		if key := file.key(line[0]); !kept[key] {
+			fields = append(fields, "-"+key)
+			kept[key] = true
+		}
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(fields)
+	w.Flush()
+
+	return strings.TrimSuffix(buf.String(), "\n"), len(fields) > 1
+}
+
+// replayRows - Put in and drop the rows of a change again, a row put in
+//              replaces the row of the same key
+func replayRows(payload string) error {
+	fields, err := csv.NewReader(strings.NewReader(payload)).Read()
+	if err != nil || len(fields) == 0 {
+		return ErrJCOR
+	}
+	file, ok := rowFiles[fields[0]]
+	if !ok {
+		return ErrJCOR
+	}
+
+	put := make(map[string]string)
+	drop := make(map[string]bool)
+	var order []string
+	for _, field := range fields[1:] {
+		switch {
+		case strings.HasPrefix(field, "+"):
+			key := file.key(field[1:])
+			put[key] = field[1:]
+			order = append(order, key)
+		case strings.HasPrefix(field, "-"):
+			drop[field[1:]] = true
+		default:
+			return ErrJCOR
+		}
+	}
+
+	var lines [][]string
+	for _, line := range readCSVRows(*file.path) {
+		key := file.key(line[0])
+		if row, ok := put[key]; ok {
+			lines = append(lines, []string{row})
+			delete(put, key)
+		} else if !drop[key] {
+			lines = append(lines, line)
+		}
+	}
+	for _, key := range order {
+		if row, ok := put[key]; ok {
+			lines = append(lines, []string{row})
+			delete(put, key)
+		}
+	}
+
+	return writeCSVAtomic(*file.path, lines)
+}
+
+// ended - Whether a record ends a change
+func (r journalRecord) ended() bool {
+	return r.phase == journalCommit || r.phase == journalAbort
+}
+
+// replayRecord - Apply the state recorded by a change again, the states
+//                are whole rows so applying one twice changes nothing
+func replayRecord(r journalRecord) error {
+	switch r.op {
+	case JournalRegister:
+		user := parseUser([]string{r.payload})
+		users, _ := loadUsers()
+		for _, u := range users {
+			if sameUser(u.Username, user.Username) {
+				return nil
+			}
+		}
+		return saveUsers(append(users, user))
+	case JournalCreate, JournalUpdate:
+		product, err := parseProduct(r.payload)
+		if err != nil {
+			return err
+		}
+		store, err := currentStore()
+		if err == nil {
+			err = store.update(product)
+		}
+		if err != nil {
+			return err
+		}
+		return indexProduct(product)
+	case JournalDelete:
+		splEntry := strings.SplitN(r.payload, "|", 2)
+		if len(splEntry) != 2 {
+			return ErrJCOR
+		}
+		product, err := parseProduct(splEntry[1])
+		if err != nil {
+			return err
+		}
+		return trashProduct(product, splEntry[0])
+	case JournalRestore:
+		product, err := parseProduct(r.payload)
+		if err != nil {
+			return err
+		}
+		return restoreProduct(product)
+	case JournalPurge:
+		ids := make(map[int]bool)
+		for _, field := range strings.Split(r.payload, ",") {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return ErrJCOR
+			}
+			ids[id] = true
+		}
+		return purgeProducts(ids)
+	case JournalRenameUser:
+		splEntry := strings.SplitN(r.payload, "|", 2)
+		if len(splEntry) != 2 {
+			return ErrJCOR
+		}
+		return renameUser(splEntry[0], splEntry[1])
+	case JournalDeleteUser:
+		splEntry := strings.SplitN(r.payload, "|", 3)
+		if len(splEntry) != 3 {
+			return ErrJCOR
+		}
+		return deleteUser(splEntry[0], splEntry[1], splEntry[2])
+	case JournalProfile:
+		// A row that is gone has nothing left to change
+		err := replaceUser(parseUser([]string{r.payload}))
+		if err == ErrUNKU {
+			return nil
+		}
+		return err
+	case JournalRows:
+		return replayRows(r.payload)
+	case JournalAcceptOffer:
+		id, err := strconv.Atoi(r.payload)
+		if err != nil {
+			return ErrJCOR
+		}
+		return settleOffer(id)
+	}
+
+	return nil
+}
+
+// ReplayJournal - Finish the changes a crash left between their begin and
+//                 end records, returns how many were replayed
+func ReplayJournal() (int, error) {
+	unlock, err := lockData()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	records, valid, err := readJournal()
+	if err != nil {
+		return 0, err
+	}
+	if fileSize(journalPath) > valid {
+		err = os.Truncate(journalPath, valid)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	pending := make(map[int]journalRecord)
+	var order []int
+	for _, r := range records {
+		if r.phase == journalBegin {
+			pending[r.seq] = r
+			order = append(order, r.seq)
+		} else if r.ended() {
+			delete(pending, r.seq)
+		}
+	}
+
+	replayed := 0
+	for _, seq := range order {
+		r, ok := pending[seq]
+		if !ok {
+			continue
+		}
+		err = replayRecord(r)
+		if err != nil {
+			return replayed, fmt.Errorf("Error - Cannot replay change %d of the journal, %s", seq, err)
+		}
+		err = appendJournal(journalRecord{seq: seq, at: time.Now().Format(timeFormat),
+			op: r.op, phase: journalCommit, payload: "replayed"})
+		if err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// compactJournal - Fold the finished changes into the data files, which
+//                  already hold them, by dropping them from the journal.
+//                  A checkpoint keeps the seq counting. Without force it
+//                  only runs past journalCompactAt finished changes.
+func compactJournal(force bool) (folded int, err error) {
+	unlock, err := lockData()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	records, _, err := readJournal()
+	if err != nil || len(records) == 0 {
+		return 0, err
+	}
+
+	ended := make(map[int]bool)
+	for _, r := range records {
+		ended[r.seq] = ended[r.seq] || r.ended()
+	}
+	var kept [][]string
+	for _, r := range records {
+		if r.phase != journalBegin {
+			continue
+		}
+		if ended[r.seq] {
+			folded++
+		} else {
+			kept = append(kept, r.encode())
+		}
+	}
+	if !force && folded < journalCompactAt {
+		return 0, nil
+	}
+
+	last := records[len(records)-1].seq
+	checkpoint := journalRecord{seq: last, at: time.Now().Format(timeFormat),
+		op: journalCheckpoint, phase: journalCheckpoint,
+		payload: strconv.Itoa(folded)}
+	kept = append(kept, checkpoint.encode())
+
+	return folded, writeCSVAtomic(journalPath, kept)
+}
+
+// CompactJournal - Compact the journal now, only the admin can do it
+func CompactJournal(username string) (int, error) {
+	if !IsAdmin(username) {
+		return 0, ErrPERM
+	}
+
+	return compactJournal(true)
+}
+
+// PrintJournal - Show the changes of the journal as
+//                seq|time|actor|op|outcome|state, the admin sees every
+//                change and the users the changes they made
+func PrintJournal(username string, page Page) error {
+	if !IsUsernameExist(username) {
+		return ErrUNKU
+	}
+
+	records, _, err := readJournal()
+	if err != nil {
+		return err
+	}
+
+	outcome := make(map[int]string)
+	for _, r := range records {
+		if r.ended() {
+			outcome[r.seq] = r.phase
+			if len(r.payload) > 0 {
+				outcome[r.seq] += " " + r.payload
+			}
+		}
+	}
+
+	var lines []string
+	for _, r := range records {
+		if r.phase != journalBegin || !IsAdmin(username) && !sameUser(username, r.actor) {
+			continue
+		}
+		state, ok := outcome[r.seq]
+		if !ok {
+			state = "pending"
+		}
+		lines = append(lines, fmt.Sprintf("%d|%s|%s|%s|%s|%s",
+			r.seq, r.at, r.actor, r.op, state, r.payload))
+	}
+	if len(lines) == 0 {
+		return errors.New("Error - journal is empty")
+	}
+
+	start, end, next := page.window(len(lines))
+	for _, line := range lines[start:end] {
+		fmt.Println(line)
+	}
+	page.printNext(next)
+
+	return nil
+}
+
+// Startup - Checks every command runs first: the schema version of the
+//           data files, then the replay of the changes a crash cut short
+func Startup() error {
+	err := CheckSchema()
+	if err != nil {
+		return err
+	}
+
+	replayed, err := ReplayJournal()
+	if replayed > 0 {
+		fmt.Println(fmt.Sprintf("Warning - replayed %d changes from the journal", replayed))
+	}
+
+	return err
+}
@@ -0,0 +1,369 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendJournalBytes - Write raw bytes at the end of the journal
+func appendJournalBytes(t *testing.T, data string) {
+	t.Helper()
+
+	file, err := os.OpenFile(journalPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lastJournal - The last records of the journal
+func lastJournal(t *testing.T, n int) []journalRecord {
+	t.Helper()
+
+	records, _, err := readJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) < n {
+		t.Fatalf("journal has %d records, want %d", len(records), n)
+	}
+
+	return records[len(records)-n:]
+}
+
+func TestReadJournalTornRecord(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	size := fileSize(journalPath)
+	before, valid, err := readJournal()
+	if err != nil || valid != size {
+		t.Fatalf("valid %d of %d: %v", valid, size, err)
+	}
+
+	// A crash in the middle of writing the next record
+	appendJournalBytes(t, "99|0badc0de|01-01-2019-10:00AM|user1|cre")
+	records, valid, err := readJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(before) || valid != size {
+		t.Errorf("read %d records up to %d, want %d up to %d", len(records),
+			valid, len(before), size)
+	}
+
+	if _, err := ReplayJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if fileSize(journalPath) != size {
+		t.Errorf("torn record not truncated, size %d want %d", fileSize(journalPath), size)
+	}
+}
+
+func TestReadJournalCorrupted(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+
+	appendJournalBytes(t, "garbage\n")
+	createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	if _, _, err := readJournal(); err != ErrJCOR {
+		t.Errorf("bad record before good ones: %v, want %v", err, ErrJCOR)
+	}
+}
+
+// TestReadJournalQuotedRecord - A line break inside a quoted payload is
+//                               part of the record and of its offset
+func TestReadJournalQuotedRecord(t *testing.T) {
+	resetData(t)
+
+	payload := "a,\"quoted\"\nline"
+	seq, err := beginJournal("user1", JournalCreate, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = endJournal(seq, JournalCreate, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	records, valid, err := readJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].payload != payload {
+		t.Errorf("records = %v", records)
+	}
+	if valid != fileSize(journalPath) {
+		t.Errorf("valid %d, want %d", valid, fileSize(journalPath))
+	}
+}
+
+func TestEditProfileJournaled(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+
+	if err := EditProfile("user1", []string{"--location", "Singapore"}); err != nil {
+		t.Fatal(err)
+	}
+	records := lastJournal(t, 2)
+	if records[0].op != JournalProfile || records[0].phase != journalBegin ||
+		!strings.Contains(records[0].payload, "|Singapore|") {
+		t.Errorf("begin = %v", records[0])
+	}
+	if records[1].seq != records[0].seq || records[1].phase != journalCommit {
+		t.Errorf("end = %v", records[1])
+	}
+
+	if err := SetUserActive("user1", "user1", false); err != nil {
+		t.Fatal(err)
+	}
+	if r := lastJournal(t, 2)[0]; r.op != JournalProfile || !strings.HasSuffix(r.payload, "|inactive") {
+		t.Errorf("deactivation = %v", r)
+	}
+}
+
+func TestReplayProfile(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	user, _ := FindUser("user1")
+
+	// A crash after the journal, before the csv user file
+	user.Bio = "collector"
+	if _, err := beginJournal("user1", JournalProfile, userRecord(user)[0]); err != nil {
+		t.Fatal(err)
+	}
+	// The row of a user gone since then is skipped
+	gone := User{Username: "user2", DisplayName: "user2", Active: true}
+	if _, err := beginJournal("user2", JournalProfile, userRecord(gone)[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ReplayJournal()
+	if err != nil || n != 2 {
+		t.Fatalf("replayed %d: %v", n, err)
+	}
+	if user, _ := FindUser("user1"); user.Bio != "collector" {
+		t.Errorf("bio %q after replay, want collector", user.Bio)
+	}
+	if _, ok := FindUser("user2"); ok {
+		t.Errorf("replay registered a user")
+	}
+}
+
+func TestReplayRestore(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	product := getListing(t, id)
+	deleteListing(t, "user1", id)
+
+	// A crash after the item went back to the store, before the trash
+	if _, err := beginJournal("user1", JournalRestore, productRecord(product)); err != nil {
+		t.Fatal(err)
+	}
+	store, err := currentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.update(product); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ReplayJournal()
+	if err != nil || n != 1 {
+		t.Fatalf("replayed %d: %v", n, err)
+	}
+	if !hasListing(t, id) {
+		t.Errorf("listing lost on replay")
+	}
+	if trash := readTrash(); len(trash) != 0 {
+		t.Errorf("trash after replay = %v", trash)
+	}
+	if len(listings(t)) != 1 {
+		t.Errorf("listing restored twice")
+	}
+}
+
+func TestReplayPurge(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	kept := createListing(t, "user1", "Old phone", "50", "Electronics")
+	deleteListing(t, "user1", id)
+	deleteListing(t, "user1", kept)
+
+	// A crash after the journal, before the trash was written
+	if _, err := beginJournal("admin", JournalPurge, strconv.Itoa(id)); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ReplayJournal()
+	if err != nil || n != 1 {
+		t.Fatalf("replayed %d: %v", n, err)
+	}
+	if trash := readTrash(); len(trash) != 1 || trash[0].product.Id != kept {
+		t.Errorf("trash after replay = %v", trash)
+	}
+}
+
+func TestCompactJournal(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	pending, err := beginJournal("user1", JournalProfile, "user1|user1||||collector|active")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CompactJournal("user1"); err != ErrPERM {
+		t.Errorf("compact by a user: %v, want %v", err, ErrPERM)
+	}
+	folded, err := CompactJournal("admin")
+	if err != nil || folded != 2 {
+		t.Fatalf("folded %d: %v", folded, err)
+	}
+
+	records, _, err := readJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].seq != pending || records[1].phase != journalCheckpoint {
+		t.Fatalf("journal after compaction = %v", records)
+	}
+
+	// A new process carries on after the checkpoint
+	journalSeq = 0
+	seq, err := beginJournal("user1", JournalCreate, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != pending+1 {
+		t.Errorf("seq %d after compaction, want %d", seq, pending+1)
+	}
+}
+
+func TestRowChanges(t *testing.T) {
+	before := [][]string{{"1|a"}, {"2|b"}, {"3|c"}}
+	after := [][]string{{"1|a"}, {"2|B"}, {"4|d"}}
+
+	payload, changed := rowChanges("offers", rowFiles["offers"], before, after)
+	if want := "offers,+2|B,+4|d,-3"; !changed || payload != want {
+		t.Errorf("payload = %q, want %q", payload, want)
+	}
+	if _, changed := rowChanges("offers", rowFiles["offers"], before, before); changed {
+		t.Errorf("rows left as they were are a change")
+	}
+
+	// A row with a comma or a quote is quoted as a csv field
+	payload, _ = rowChanges("offers", rowFiles["offers"], nil, [][]string{{`5|"hi", there`}})
+	if want := `offers,"+5|""hi"", there"`; payload != want {
+		t.Errorf("payload = %q, want %q", payload, want)
+	}
+}
+
+func TestReplayRows(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	other := createListing(t, "user1", "Old phone", "50", "Electronics")
+	if err := WatchCSVItem("user2", other); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash after the journal, before the watch file was written
+	watches := append(readWatches(), watch{username: "user2",
+		watchedAt: time.Now().Format(timeFormat), seen: getListing(t, id)})
+	payload, _ := rowChanges("watches", rowFiles["watches"], readCSVRows(csvWatchPath),
+		watchRows(watches))
+	for i := 0; i < 2; i++ {
+		if _, err := beginJournal("user2", JournalRows, payload); err != nil {
+			t.Fatal(err)
+		}
+		n, err := ReplayJournal()
+		if err != nil || n != 1 {
+			t.Fatalf("replayed %d: %v", n, err)
+		}
+		if got := readWatches(); len(got) != 2 || got[1].seen.Id != id {
+			t.Errorf("replay %d: watches = %v", i+1, got)
+		}
+	}
+
+	// Dropped rows go again
+	payload, _ = rowChanges("watches", rowFiles["watches"], readCSVRows(csvWatchPath),
+		watchRows(watches[1:]))
+	if _, err := beginJournal("user2", JournalRows, payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReplayJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readWatches(); len(got) != 1 || got[0].seen.Id != id {
+		t.Errorf("watches = %v, want only %d", got, id)
+	}
+}
+
+func TestStoresJournaled(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	changes := []struct {
+		name   string
+		change func() error
+	}{
+		{"watches", func() error { return WatchCSVItem("user2", id) }},
+		{"offers", func() error {
+			_, err := MakeOffer("user2", id, Money{Amount: 8000, Currency: DefaultCurrency}, time.Hour)
+			return err
+		}},
+		{"messages", func() error { return SendMessage("user2", id, "", "Still there?") }},
+		{"blocks", func() error { return BlockUser("user1", "user2", true) }},
+		{"categories", func() error { return ManageCategory(adminUser, "add", []string{"Sports"}) }},
+	}
+	for _, c := range changes {
+		if err := c.change(); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		records := lastJournal(t, 2)
+		if records[0].op != JournalRows || !strings.HasPrefix(records[0].payload, c.name+",+") ||
+			records[1].seq != records[0].seq || records[1].phase != journalCommit {
+			t.Errorf("%s journaled as %v", c.name, records)
+		}
+	}
+}
@@ -0,0 +1,737 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+const (
+	// kvPageSize - Size of a page of the kv file, the last 4 bytes of a
+	//              page hold its crc32
+	kvPageSize = 4096
+	kvUsable   = kvPageSize - 4
+
+	// kvMaxEntry - Largest key and value pair, so that the halves of a
+	//              split page always fit in a page
+	kvMaxEntry = 1024
+
+	kvTrees  = 5
+	kvMagic  = "CRSLKV01"
+	kvLeaf   = 1
+	kvBranch = 2
+
+	// kvCompactAt - Unreachable pages that trigger a compaction once they
+	//               are more than the reachable ones
+	kvCompactAt = 1024
+)
+
+var (
+	ErrKVC = errors.New("Error - kv store is corrupted")
+	ErrKVL = errors.New("Error - listing is too large for the kv store")
+)
+
+// kvNode - A page of a B+tree. Leaves hold the keys and values in order,
+//          branches hold the first key of each child. The first key of a
+//          branch stands for any key lower than the second.
+type kvNode struct {
+	leaf bool
+	keys [][]byte
+	vals [][]byte
+	kids []uint64
+}
+
+// kvChild - A page written by an insert and its first key
+type kvChild struct {
+	key []byte
+	id  uint64
+}
+
+// kvMeta - Root pages of the trees and the allocation state, written to
+//          page 0 or 1 by turns so a torn write keeps the previous one
+type kvMeta struct {
+	txid  uint64
+	pages uint64
+	freed uint64
+	roots [kvTrees]uint64
+}
+
+// kvFile - A single file holding kvTrees copy-on-write B+trees. Changed
+//          pages are written to new pages and a commit makes them visible
+//          by writing the meta page, a crash before it loses the change
+//          and nothing else.
+type kvFile struct {
+	path  string
+	file  *os.File
+	meta  kvMeta
+	nodes map[uint64]*kvNode
+	dirty map[uint64]bool
+}
+
+func (n *kvNode) size() int {
+	size := 3
+	for i, key := range n.keys {
+		if n.leaf {
+			size += 4 + len(key) + len(n.vals[i])
+		} else {
+			size += 10 + len(key)
+		}
+	}
+
+	return size
+}
+
+func (n *kvNode) clone() *kvNode {
+	c := &kvNode{leaf: n.leaf}
+	c.keys = append(c.keys, n.keys...)
+	c.vals = append(c.vals, n.vals...)
+	c.kids = append(c.kids, n.kids...)
+
+	return c
+}
+
+// slice - The entries of a node from i to j
+func (n *kvNode) slice(i int, j int) *kvNode {
+	c := &kvNode{leaf: n.leaf}
+	c.keys = append(c.keys, n.keys[i:j]...)
+	if n.leaf {
+		c.vals = append(c.vals, n.vals[i:j]...)
+	} else {
+		c.kids = append(c.kids, n.kids[i:j]...)
+	}
+
+	return c
+}
+
+// search - Position of the first key not lower than key
+func (n *kvNode) search(key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) >= 0
+	})
+}
+
+// child - Position of the child of a branch that holds key
+func (n *kvNode) child(key []byte) int {
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) > 0
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return i
+}
+
+func (n *kvNode) encode() []byte {
+	buf := make([]byte, kvPageSize)
+	buf[0] = kvBranch
+	if n.leaf {
+		buf[0] = kvLeaf
+	}
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(n.keys)))
+
+	off := 3
+	for i, key := range n.keys {
+		binary.BigEndian.PutUint16(buf[off:], uint16(len(key)))
+		off += 2
+		if n.leaf {
+			binary.BigEndian.PutUint16(buf[off:], uint16(len(n.vals[i])))
+			off += 2
+			off += copy(buf[off:], key)
+			off += copy(buf[off:], n.vals[i])
+		} else {
+			binary.BigEndian.PutUint64(buf[off:], n.kids[i])
+			off += 8
+			off += copy(buf[off:], key)
+		}
+	}
+	binary.BigEndian.PutUint32(buf[kvUsable:], crc32.ChecksumIEEE(buf[:kvUsable]))
+
+	return buf
+}
+
+func decodeKVNode(buf []byte) (*kvNode, error) {
+	if binary.BigEndian.Uint32(buf[kvUsable:]) != crc32.ChecksumIEEE(buf[:kvUsable]) ||
+		(buf[0] != kvLeaf && buf[0] != kvBranch) {
+		return nil, ErrKVC
+	}
+
+	n := &kvNode{leaf: buf[0] == kvLeaf}
+	count := int(binary.BigEndian.Uint16(buf[1:]))
+	off := 3
+	for i := 0; i < count; i++ {
+		if off+12 > kvUsable {
+			return nil, ErrKVC
+		}
+		klen := int(binary.BigEndian.Uint16(buf[off:]))
+		off += 2
+		if n.leaf {
+			vlen := int(binary.BigEndian.Uint16(buf[off:]))
+			off += 2
+			if off+klen+vlen > kvUsable {
+				return nil, ErrKVC
+			}
+			n.keys = append(n.keys, buf[off:off+klen])
+			n.vals = append(n.vals, buf[off+klen:off+klen+vlen])
+			off += klen + vlen
+		} else {
+			n.kids = append(n.kids, binary.BigEndian.Uint64(buf[off:]))
+			off += 8
+			if off+klen > kvUsable {
+				return nil, ErrKVC
+			}
+			n.keys = append(n.keys, buf[off:off+klen])
+			off += klen
+		}
+	}
+
+	return n, nil
+}
+
+func (m kvMeta) encode() []byte {
+	buf := make([]byte, kvPageSize)
+	copy(buf, kvMagic)
+	binary.BigEndian.PutUint64(buf[8:], m.txid)
+	binary.BigEndian.PutUint64(buf[16:], m.pages)
+	binary.BigEndian.PutUint64(buf[24:], m.freed)
+	for i, root := range m.roots {
+		binary.BigEndian.PutUint64(buf[32+8*i:], root)
+	}
+	binary.BigEndian.PutUint32(buf[kvUsable:], crc32.ChecksumIEEE(buf[:kvUsable]))
+
+	return buf
+}
+
+func decodeKVMeta(buf []byte) (m kvMeta, ok bool) {
+	if string(buf[:8]) != kvMagic ||
+		binary.BigEndian.Uint32(buf[kvUsable:]) != crc32.ChecksumIEEE(buf[:kvUsable]) {
+		return m, false
+	}
+
+	m.txid = binary.BigEndian.Uint64(buf[8:])
+	m.pages = binary.BigEndian.Uint64(buf[16:])
+	m.freed = binary.BigEndian.Uint64(buf[24:])
+	for i := range m.roots {
+		m.roots[i] = binary.BigEndian.Uint64(buf[32+8*i:])
+	}
+
+	return m, true
+}
+
+// openKV - Open or create a kv file
+func openKV(path string) (*kvFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := &kvFile{path: path, file: file}
+	kv.reset()
+
+	info, err := file.Stat()
+	if err == nil && info.Size() == 0 {
+		kv.meta = kvMeta{pages: 2}
+		_, err = file.WriteAt(append(kv.meta.encode(), kv.meta.encode()...), 0)
+		if err == nil {
+			err = file.Sync()
+		}
+	} else if err == nil {
+		err = kv.readMeta()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return kv, nil
+}
+
+// readMeta - Pick the newest valid meta page
+func (kv *kvFile) readMeta() error {
+	buf := make([]byte, 2*kvPageSize)
+	_, err := kv.file.ReadAt(buf, 0)
+	if err != nil {
+		return ErrKVC
+	}
+
+	m0, ok0 := decodeKVMeta(buf[:kvPageSize])
+	m1, ok1 := decodeKVMeta(buf[kvPageSize:])
+	switch {
+	case ok0 && (!ok1 || m0.txid >= m1.txid):
+		kv.meta = m0
+	case ok1:
+		kv.meta = m1
+	default:
+		return ErrKVC
+	}
+
+	return nil
+}
+
+// refresh - Drop the cached pages and read the meta page again, another
+//           process may have committed since. A compaction renamed a new
+//           file over the path, which is then opened instead.
+func (kv *kvFile) refresh() error {
+	info, err := os.Stat(kv.path)
+	if err != nil {
+		return err
+	}
+	open, err := kv.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(info, open) {
+		file, err := os.OpenFile(kv.path, os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		kv.file.Close()
+		kv.file = file
+	}
+	kv.reset()
+
+	return kv.readMeta()
+}
+
+func (kv *kvFile) reset() {
+	kv.nodes = make(map[uint64]*kvNode)
+	kv.dirty = make(map[uint64]bool)
+}
+
+func (kv *kvFile) close() error {
+	return kv.file.Close()
+}
+
+func (kv *kvFile) load(id uint64) (*kvNode, error) {
+	if n, ok := kv.nodes[id]; ok {
+		return n, nil
+	}
+	if id < 2 || id >= kv.meta.pages {
+		return nil, ErrKVC
+	}
+
+	buf := make([]byte, kvPageSize)
+	_, err := kv.file.ReadAt(buf, int64(id)*kvPageSize)
+	if err != nil {
+		return nil, ErrKVC
+	}
+	n, err := decodeKVNode(buf)
+	if err != nil {
+		return nil, err
+	}
+	kv.nodes[id] = n
+
+	return n, nil
+}
+
+// alloc - Give a node a new page, written on commit
+func (kv *kvFile) alloc(n *kvNode) uint64 {
+	id := kv.meta.pages
+	kv.meta.pages++
+	kv.nodes[id] = n
+	kv.dirty[id] = true
+
+	return id
+}
+
+// store - Write a changed node. A page written since the last commit is
+//         reused, a committed page is left for the readers of the
+//         previous meta and the node gets a new page.
+func (kv *kvFile) store(id uint64, n *kvNode) uint64 {
+	if kv.dirty[id] {
+		kv.nodes[id] = n
+		return id
+	}
+	kv.meta.freed++
+
+	return kv.alloc(n)
+}
+
+func (kv *kvFile) free(id uint64) {
+	delete(kv.dirty, id)
+	delete(kv.nodes, id)
+	kv.meta.freed++
+}
+
+// split - Store a node, in two pages when it outgrew one. A node grown at
+//         its end, as the IDs and creation times do, keeps its entries
+//         and the last one starts the new page, so pages fill up instead
+//         of staying half empty.
+func (kv *kvFile) split(id uint64, n *kvNode, atEnd bool) []kvChild {
+	size := n.size()
+	if size <= kvUsable {
+		return []kvChild{{n.keys[0], kv.store(id, n)}}
+	}
+
+	m := len(n.keys) - 1
+	if !atEnd {
+		half := 3
+		for i := range n.keys {
+			if n.leaf {
+				half += 4 + len(n.keys[i]) + len(n.vals[i])
+			} else {
+				half += 10 + len(n.keys[i])
+			}
+			if half > size/2 {
+				m = i
+				break
+			}
+		}
+	}
+	if m < 1 {
+		m = 1
+	}
+
+	left, right := n.slice(0, m), n.slice(m, len(n.keys))
+
+	return []kvChild{{left.keys[0], kv.store(id, left)},
+		{right.keys[0], kv.alloc(right)}}
+}
+
+// insert - Set a key below page id, returns the pages that replace it
+func (kv *kvFile) insert(id uint64, key []byte, val []byte) ([]kvChild, error) {
+	n, err := kv.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if !kv.dirty[id] {
+		n = n.clone()
+	}
+
+	if n.leaf {
+		i := n.search(key)
+		if i < len(n.keys) && bytes.Equal(n.keys[i], key) {
+			n.vals[i] = val
+		} else if i == len(n.keys) {
+			n.keys = append(n.keys, key)
+			n.vals = append(n.vals, val)
+		} else {
+			n.keys = append(n.keys[:i], append([][]byte{key}, n.keys[i:]...)...)
+			n.vals = append(n.vals[:i], append([][]byte{val}, n.vals[i:]...)...)
+		}
+		return kv.split(id, n, i == len(n.keys)-1), nil
+	}
+
+	i := n.child(key)
+	children, err := kv.insert(n.kids[i], key, val)
+	if err != nil {
+		return nil, err
+	}
+	if i > 0 {
+		children[0].key = n.keys[i]
+	}
+
+	var keys [][]byte
+	var kids []uint64
+	for _, c := range children {
+		keys = append(keys, c.key)
+		kids = append(kids, c.id)
+	}
+	atEnd := i == len(n.keys)-1
+	n.keys = append(n.keys[:i], append(keys, n.keys[i+1:]...)...)
+	n.kids = append(n.kids[:i], append(kids, n.kids[i+1:]...)...)
+
+	return kv.split(id, n, atEnd), nil
+}
+
+// put - Set the value of a key in a tree
+func (kv *kvFile) put(tree int, key []byte, val []byte) error {
+	if len(key)+len(val) > kvMaxEntry {
+		return ErrKVL
+	}
+
+	root := kv.meta.roots[tree]
+	if root == 0 {
+		kv.meta.roots[tree] = kv.alloc(&kvNode{leaf: true,
+			keys: [][]byte{key}, vals: [][]byte{val}})
+		return nil
+	}
+
+	children, err := kv.insert(root, key, val)
+	if err != nil {
+		return err
+	}
+	if len(children) == 1 {
+		kv.meta.roots[tree] = children[0].id
+	} else {
+		kv.meta.roots[tree] = kv.alloc(&kvNode{keys: [][]byte{children[0].key,
+			children[1].key}, kids: []uint64{children[0].id, children[1].id}})
+	}
+
+	return nil
+}
+
+// remove - Drop a key below page id, returns the new page of the node, 0
+//          once it is empty, and its first key
+func (kv *kvFile) remove(id uint64, key []byte) (uint64, []byte, bool, error) {
+	n, err := kv.load(id)
+	if err != nil {
+		return id, nil, false, err
+	}
+
+	var i int
+	if n.leaf {
+		i = n.search(key)
+		if i == len(n.keys) || !bytes.Equal(n.keys[i], key) {
+			return id, n.keys[0], false, nil
+		}
+		if !kv.dirty[id] {
+			n = n.clone()
+		}
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.vals = append(n.vals[:i], n.vals[i+1:]...)
+	} else {
+		i = n.child(key)
+		kid, first, found, err := kv.remove(n.kids[i], key)
+		if err != nil || !found {
+			return id, n.keys[0], found, err
+		}
+		if !kv.dirty[id] {
+			n = n.clone()
+		}
+		if kid == 0 {
+			n.keys = append(n.keys[:i], n.keys[i+1:]...)
+			n.kids = append(n.kids[:i], n.kids[i+1:]...)
+		} else {
+			n.kids[i] = kid
+			if i == 0 {
+				n.keys[0] = first
+			}
+		}
+	}
+
+	if len(n.keys) == 0 {
+		kv.free(id)
+		return 0, nil, true, nil
+	}
+
+	return kv.store(id, n), n.keys[0], true, nil
+}
+
+// delete - Remove a key from a tree, a root left with a single child
+//          gives way to it
+func (kv *kvFile) delete(tree int, key []byte) error {
+	root := kv.meta.roots[tree]
+	if root == 0 {
+		return nil
+	}
+
+	root, _, _, err := kv.remove(root, key)
+	if err != nil {
+		return err
+	}
+	for root != 0 {
+		n, err := kv.load(root)
+		if err != nil {
+			return err
+		}
+		if n.leaf || len(n.kids) > 1 {
+			break
+		}
+		kv.free(root)
+		root = n.kids[0]
+	}
+	kv.meta.roots[tree] = root
+
+	return nil
+}
+
+// get - Value of a key in a tree
+func (kv *kvFile) get(tree int, key []byte) ([]byte, bool, error) {
+	id := kv.meta.roots[tree]
+	for id != 0 {
+		n, err := kv.load(id)
+		if err != nil {
+			return nil, false, err
+		}
+		if !n.leaf {
+			id = n.kids[n.child(key)]
+			continue
+		}
+		i := n.search(key)
+		if i < len(n.keys) && bytes.Equal(n.keys[i], key) {
+			return n.vals[i], true, nil
+		}
+		break
+	}
+
+	return nil, false, nil
+}
+
+// scan - Walk the keys of a tree from start in order, until fn returns
+//        false
+func (kv *kvFile) scan(tree int, start []byte, fn func(key []byte, val []byte) bool) error {
+	if kv.meta.roots[tree] == 0 {
+		return nil
+	}
+	_, err := kv.walk(kv.meta.roots[tree], start, fn)
+
+	return err
+}
+
+func (kv *kvFile) walk(id uint64, start []byte, fn func([]byte, []byte) bool) (bool, error) {
+	n, err := kv.load(id)
+	if err != nil {
+		return false, err
+	}
+
+	if n.leaf {
+		for i := n.search(start); i < len(n.keys); i++ {
+			if !fn(n.keys[i], n.vals[i]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	for i := n.child(start); i < len(n.kids); i++ {
+		more, err := kv.walk(n.kids[i], start, fn)
+		if err != nil || !more {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// scanPrefix - Walk the keys of a tree starting with prefix
+func (kv *kvFile) scanPrefix(tree int, prefix []byte, fn func(key []byte, val []byte) bool) error {
+	return kv.scan(tree, prefix, func(key []byte, val []byte) bool {
+		return bytes.HasPrefix(key, prefix) && fn(key, val)
+	})
+}
+
+// last - Highest key of a tree
+func (kv *kvFile) last(tree int) ([]byte, bool, error) {
+	id := kv.meta.roots[tree]
+	for id != 0 {
+		n, err := kv.load(id)
+		if err != nil {
+			return nil, false, err
+		}
+		if n.leaf {
+			return n.keys[len(n.keys)-1], true, nil
+		}
+		id = n.kids[len(n.kids)-1]
+	}
+
+	return nil, false, nil
+}
+
+// commit - Write the changed pages, then the meta page that makes them
+//          visible. A file holding mostly unreachable pages is compacted.
+func (kv *kvFile) commit() error {
+	var ids []uint64
+	for id := range kv.dirty {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		_, err := kv.file.WriteAt(kv.nodes[id].encode(), int64(id)*kvPageSize)
+		if err != nil {
+			kv.rollback()
+			return err
+		}
+	}
+	err := kv.file.Sync()
+	if err != nil {
+		kv.rollback()
+		return err
+	}
+
+	kv.meta.txid++
+	_, err = kv.file.WriteAt(kv.meta.encode(), int64(kv.meta.txid%2)*kvPageSize)
+	if err == nil {
+		err = kv.file.Sync()
+	}
+	if err != nil {
+		kv.rollback()
+		return err
+	}
+	kv.dirty = make(map[uint64]bool)
+
+	if kv.meta.freed > kvCompactAt && 2*kv.meta.freed > kv.meta.pages {
+		return kv.compact()
+	}
+
+	return nil
+}
+
+// rollback - Drop the changes since the last commit
+func (kv *kvFile) rollback() {
+	kv.reset()
+	kv.readMeta()
+}
+
+// compact - Copy the reachable pages to a new file and rename it over
+//           the old one, the caller holds the data lock. The other
+//           processes open the new file once they take the lock.
+func (kv *kvFile) compact() error {
+	tmp := kv.path + ".tmp"
+	os.Remove(tmp)
+	out, err := openKV(tmp)
+	if err != nil {
+		return err
+	}
+
+	for tree := 0; tree < kvTrees && err == nil; tree++ {
+		var perr error
+		count := 0
+		err = kv.scan(tree, nil, func(key []byte, val []byte) bool {
+			perr = out.put(tree, key, val)
+			if count++; perr == nil && count%50000 == 0 {
+				perr = out.commit()
+			}
+			return perr == nil
+		})
+		if err == nil {
+			err = perr
+		}
+	}
+	if err == nil {
+		err = out.commit()
+	}
+	out.close()
+	if err == nil {
+		err = os.Rename(tmp, kv.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return kv.refresh()
+}
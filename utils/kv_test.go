@@ -0,0 +1,289 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestKV - A fresh kv file in the test directory
+func openTestKV(t *testing.T, name string) *kvFile {
+	t.Helper()
+
+	path := filepath.Join(testDir, name)
+	os.Remove(path)
+	kv, err := openKV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kv
+}
+
+func kvKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%06d", i))
+}
+
+func kvVal(i int) []byte {
+	return bytes.Repeat([]byte{byte('a' + i%26)}, 100)
+}
+
+// checkKV - Every key from 0 to n is there with its value, or is not
+//           when gone says so, and a scan walks them in order
+func checkKV(t *testing.T, kv *kvFile, n int, gone func(int) bool) {
+	t.Helper()
+
+	want := 0
+	for i := 0; i < n; i++ {
+		val, ok, err := kv.get(0, kvKey(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok == gone(i) || (ok && !bytes.Equal(val, kvVal(i))) {
+			t.Fatalf("key %d: found %v, value %q", i, ok, val)
+		}
+		if ok {
+			want++
+		}
+	}
+
+	var prev []byte
+	count := 0
+	err := kv.scan(0, nil, func(key []byte, val []byte) bool {
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			t.Errorf("scan out of order: %q after %q", key, prev)
+		}
+		prev = append([]byte{}, key...)
+		count++
+		return true
+	})
+	if err != nil || count != want {
+		t.Errorf("scan found %d keys: %v, want %d", count, err, want)
+	}
+}
+
+func TestKVSplit(t *testing.T) {
+	kv := openTestKV(t, "split.kv")
+	defer kv.close()
+
+	// Keys in order fill the pages, keys out of order split them in halves
+	n := 2000
+	for i := 0; i < n; i += 2 {
+		if err := kv.put(0, kvKey(i), kvVal(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := n - 1; i > 0; i -= 2 {
+		if err := kv.put(0, kvKey(i), kvVal(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kv.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := kv.load(kv.meta.roots[0])
+	if err != nil || root.leaf {
+		t.Fatalf("root after %d keys: leaf %v, %v", n, root != nil && root.leaf, err)
+	}
+	checkKV(t, kv, n, func(int) bool { return false })
+
+	last, ok, err := kv.last(0)
+	if err != nil || !ok || !bytes.Equal(last, kvKey(n-1)) {
+		t.Errorf("last key %q, %v, %v", last, ok, err)
+	}
+
+	// The pages read back from the file hold the same tree
+	again, err := openKV(kv.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.close()
+	checkKV(t, again, n, func(int) bool { return false })
+
+	if err := kv.put(0, []byte("big"), make([]byte, kvMaxEntry)); err != ErrKVL {
+		t.Errorf("oversized entry: %v, want %v", err, ErrKVL)
+	}
+}
+
+func TestKVRemove(t *testing.T) {
+	kv := openTestKV(t, "remove.kv")
+	defer kv.close()
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		if err := kv.put(0, kvKey(i), kvVal(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kv.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	gone := func(i int) bool { return i%3 != 0 }
+	for i := 0; i < n; i++ {
+		if gone(i) {
+			if err := kv.delete(0, kvKey(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := kv.delete(0, []byte("missing")); err != nil {
+		t.Errorf("removing a missing key: %v", err)
+	}
+	if err := kv.commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkKV(t, kv, n, gone)
+
+	for i := 0; i < n; i += 3 {
+		if err := kv.delete(0, kvKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kv.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if kv.meta.roots[0] != 0 {
+		t.Errorf("empty tree keeps root page %d", kv.meta.roots[0])
+	}
+}
+
+func TestKVCompact(t *testing.T) {
+	kv := openTestKV(t, "compact.kv")
+	defer kv.close()
+
+	// Another process holding the file open before the compaction
+	other, err := openKV(kv.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.close()
+
+	n := 500
+	for round := 0; round < 5; round++ {
+		for i := 0; i < n; i++ {
+			if err := kv.put(0, kvKey(i), kvVal(i)); err != nil {
+				t.Fatal(err)
+			}
+			if i%50 == 0 {
+				if err := kv.commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	if err := kv.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := kv.meta.pages
+	if err := kv.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if kv.meta.pages >= pages || kv.meta.freed != 0 {
+		t.Errorf("compaction left %d pages of %d, %d unreachable", kv.meta.pages, pages,
+			kv.meta.freed)
+	}
+	checkKV(t, kv, n, func(int) bool { return false })
+
+	// Once refreshed the other process reads the compacted file
+	if err := other.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if other.meta != kv.meta {
+		t.Errorf("other process meta %+v, want %+v", other.meta, kv.meta)
+	}
+	checkKV(t, other, n, func(int) bool { return false })
+}
+
+func TestKVMetaRecovery(t *testing.T) {
+	kv := openTestKV(t, "meta.kv")
+
+	if err := kv.put(0, kvKey(1), kvVal(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.put(0, kvKey(2), kvVal(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change never committed is lost and nothing else
+	if err := kv.put(0, kvKey(3), kvVal(3)); err != nil {
+		t.Fatal(err)
+	}
+	txid := kv.meta.txid
+	kv.close()
+
+	again, err := openKV(kv.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.meta.txid != txid {
+		t.Errorf("txid %d, want %d", again.meta.txid, txid)
+	}
+	checkKV(t, again, 4, func(i int) bool { return i == 0 || i == 3 })
+
+	// A torn write of the newest meta page falls back to the other one
+	file, err := os.OpenFile(kv.path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte("torn"), int64(txid%2)*kvPageSize+40)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := again.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if again.meta.txid != txid-1 {
+		t.Errorf("txid after a torn meta page %d, want %d", again.meta.txid, txid-1)
+	}
+	checkKV(t, again, 4, func(i int) bool { return i != 1 })
+	again.close()
+
+	// Both meta pages torn is corruption
+	file, _ = os.OpenFile(kv.path, os.O_RDWR, 0644)
+	file.WriteAt([]byte("torn"), int64((txid-1)%2)*kvPageSize+40)
+	file.Close()
+	if _, err := openKV(kv.path); err != ErrKVC {
+		t.Errorf("both meta pages torn: %v, want %v", err, ErrKVC)
+	}
+}
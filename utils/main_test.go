@@ -0,0 +1,250 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDir - Scratch directory holding the data files of the tests
+var testDir string
+
+// TestMain - Move every data file out of /tmp, the tests never touch the
+//            data of a running marketplace
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "carousell-test-")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	testDir = dir
+
+	for _, path := range []*string{&csvUserPath, &csvItemsPath, &csvTrashPath,
+		&csvRevisionsPath, &csvRatesPath, &csvImportPath, &csvWatchPath,
+		&csvOffersPath, &csvMessagesPath, &csvBlocksPath, &csvReviewsPath,
+		&csvCategoriesPath, &csvImagesPath, &csvMetaPath, &csvIndexPath,
+		&kvItemsPath, &journalPath, &lockPath, &auditPath, &blobDir} {
+		*path = filepath.Join(dir, filepath.Base(*path))
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// resetData - Start a test on an empty marketplace
+func resetData(t *testing.T) {
+	t.Helper()
+
+	if activeStore != nil {
+		activeStore.close()
+		activeStore = nil
+	}
+	rates = nil
+
+	files, err := ioutil.ReadDir(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		err = os.RemoveAll(filepath.Join(testDir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// register - Register users, failing the test on error
+func register(t *testing.T, usernames ...string) {
+	t.Helper()
+
+	for _, username := range usernames {
+		err := WriteCSVUser(username)
+		if err != nil {
+			t.Fatalf("register %s: %s", username, err)
+		}
+	}
+}
+
+// createListing - Create an item the way CREATE_LISTING does and return
+//                 its ID, the description is derived from the title
+func createListing(t *testing.T, username string, title string, price string,
+	category string) int {
+	t.Helper()
+
+	money, err := ParseMoney(price)
+	if err != nil {
+		t.Fatalf("price %s: %s", price, err)
+	}
+	id, err := CreateCSVProduct(ProductListing{Username: username, Title: title,
+		Description: "about " + title, Price: money, Category: category,
+		CreatedAt: time.Now().Format(timeFormat)})
+	if err != nil {
+		t.Fatalf("create %s: %s", title, err)
+	}
+
+	return id
+}
+
+// deleteListing - Delete an item, DeleteCSVItem reports success as an error
+func deleteListing(t *testing.T, username string, id int) {
+	t.Helper()
+
+	if err := DeleteCSVItem(username, id); err == nil || err.Error() != "Success" {
+		t.Fatalf("delete %d: %v", id, err)
+	}
+}
+
+// getListing - Read an item back from the store
+func getListing(t *testing.T, id int) ProductListing {
+	t.Helper()
+
+	product, err := findProduct(id)
+	if err != nil {
+		t.Fatalf("listing %d: %s", id, err)
+	}
+
+	return product
+}
+
+// hasListing - Check if the store holds an item
+func hasListing(t *testing.T, id int) bool {
+	t.Helper()
+
+	_, err := findProduct(id)
+	if err != nil && err != ErrLNE {
+		t.Fatal(err)
+	}
+
+	return err == nil
+}
+
+// listings - Every item of the store
+func listings(t *testing.T) []ProductListing {
+	t.Helper()
+
+	products, err := loadProducts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return products
+}
+
+// itemRows - Every item row of the store
+func itemRows(t *testing.T) [][]string {
+	t.Helper()
+
+	rows, err := ReadCSVProduct()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rows
+}
+
+// nextId - ID the next item gets
+func nextId(t *testing.T) int {
+	t.Helper()
+
+	id, err := LastProductId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// captureOutput - Lines printed to stdout while f runs
+func captureOutput(t *testing.T, f func()) []string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+
+	done := make(chan []string)
+	go func() {
+		var lines []string
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		done <- lines
+	}()
+
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+
+	return <-done
+}
+
+// hasLine - Check if a line of the output contains every part
+func hasLine(lines []string, parts ...string) bool {
+	for _, line := range lines {
+		found := true
+		for _, part := range parts {
+			found = found && strings.Contains(line, part)
+		}
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// testZones - Offsets from UTC in hours the time dependent tests run in,
+//             the data files hold local times
+var testZones = []int{-5, 8}
+
+// inZone - Set time.Local to a fixed zone hours away from UTC, returns the
+//          function putting the previous zone back
+func inZone(hours int) func() {
+	local := time.Local
+	time.Local = time.FixedZone(fmt.Sprintf("UTC%+d", hours), hours*3600)
+
+	return func() {
+		time.Local = local
+	}
+}
@@ -0,0 +1,506 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// messageMax - Longest message body in bytes
+	messageMax = 1000
+)
+
+var (
+	csvMessagesPath = "/tmp/messages.csv"
+	csvBlocksPath   = "/tmp/blocks.csv"
+
+	ErrBLCK = errors.New("Error - you cannot message this user")
+	ErrMSG  = errors.New("Error - Message cannot be empty, longer than 1000 bytes or contain new lines")
+	ErrNOTO = errors.New("Error - You need to specify the buyer with --to")
+	ErrSELF = errors.New("Error - cannot message yourself")
+	ErrTHNE = errors.New("Error - thread does not exist")
+)
+
+// message - A message about a listing. A thread is the messages of a
+//           listing between its seller and one buyer.
+type message struct {
+	id      int
+	listing int
+	from    string
+	to      string
+	sentAt  string
+	read    bool
+	body    string
+}
+
+// parseMessage - Parse a row of the csv message file, each row is
+//                id|listing|from|to|sent|read|body
+func parseMessage(entry string) (message, error) {
+	splEntry := strings.SplitN(entry, "|", 7)
+	if len(splEntry) != 7 {
+		return message{}, ErrMALF
+	}
+
+	id, err := strconv.Atoi(splEntry[0])
+	if err != nil {
+		return message{}, ErrMALF
+	}
+	listing, err := strconv.Atoi(splEntry[1])
+	if err != nil {
+		return message{}, ErrMALF
+	}
+
+	return message{id: id, listing: listing, from: splEntry[2], to: splEntry[3],
+		sentAt: splEntry[4], read: splEntry[5] == "read", body: splEntry[6]}, nil
+}
+
+// messageRecord - Format a message as a row of the csv message file
+func messageRecord(m message) string {
+	state := "unread"
+	if m.read {
+		state = "read"
+	}
+
+	return fmt.Sprintf("%d|%d|%s|%s|%s|%s|%s", m.id, m.listing, m.from, m.to,
+		m.sentAt, state, m.body)
+}
+
+// loadMessages - Read and parse all messages from the csv message file
+func loadMessages() []message {
+	var messages []message
+
+	for _, line := range readCSVRows(csvMessagesPath) {
+		m, err := parseMessage(line[0])
+		if err == nil {
+			messages = append(messages, m)
+		}
+	}
+
+	return messages
+}
+
+// messageRows - Rows of the csv message file
+func messageRows(messages []message) [][]string {
+	var lines [][]string
+	for _, m := range messages {
+		lines = append(lines, []string{messageRecord(m)})
+	}
+
+	return lines
+}
+
+// saveMessages - Regenerates the csv message file
+func saveMessages(messages []message) error {
+	return writeCSVAtomic(csvMessagesPath, messageRows(messages))
+}
+
+// loadBlocks - Read the csv block file, each row is username|blocked user
+func loadBlocks() [][2]string {
+	var blocks [][2]string
+
+	for _, line := range readCSVRows(csvBlocksPath) {
+		splEntry := strings.SplitN(line[0], "|", 2)
+		if len(splEntry) == 2 {
+			blocks = append(blocks, [2]string{splEntry[0], splEntry[1]})
+		}
+	}
+
+	return blocks
+}
+
+// blockRows - Rows of the csv block file
+func blockRows(blocks [][2]string) [][]string {
+	var lines [][]string
+	for _, b := range blocks {
+		lines = append(lines, []string{b[0] + "|" + b[1]})
+	}
+
+	return lines
+}
+
+// saveBlocks - Regenerates the csv block file
+func saveBlocks(blocks [][2]string) error {
+	return writeCSVAtomic(csvBlocksPath, blockRows(blocks))
+}
+
+// blocked - Check if either user blocked the other
+func blocked(a string, b string) bool {
+	for _, block := range loadBlocks() {
+		if (sameUser(block[0], a) && sameUser(block[1], b)) ||
+			(sameUser(block[0], b) && sameUser(block[1], a)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BlockUser - Stop another user from messaging an user, or let it again
+//             when block is false
+func BlockUser(username string, other string, block bool) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, ok := FindUser(username)
+	if !ok {
+		return ErrUNKU
+	}
+	target, ok := FindUser(other)
+	if !ok {
+		return ErrUNKU
+	}
+	if sameUser(user.Username, target.Username) {
+		return ErrSELF
+	}
+
+	var kept [][2]string
+	found := false
+	for _, b := range loadBlocks() {
+		if sameUser(b[0], user.Username) && sameUser(b[1], target.Username) {
+			found = true
+			continue
+		}
+		kept = append(kept, b)
+	}
+
+	switch {
+	case block && found:
+		return errors.New("Error - user is already blocked")
+	case !block && !found:
+		return errors.New("Error - user is not blocked")
+	case block:
+		kept = append(kept, [2]string{user.Username, target.Username})
+	}
+
+	return saveRows(username, "blocks", blockRows(kept))
+}
+
+// GetCSVBlocks - Show the users an user blocked
+func GetCSVBlocks(username string) error {
+	if !IsUsernameExist(username) {
+		return ErrUNKU
+	}
+
+	found := false
+	for _, b := range loadBlocks() {
+		if sameUser(b[0], username) {
+			fmt.Println(b[1])
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("Error - no blocked users")
+	}
+
+	return nil
+}
+
+// ParseRecipient - Take --to out of the arguments
+func ParseRecipient(args []string) (to string, rest []string, err error) {
+	for i := 0; i < len(args); i++ {
+		if args[i] != "--to" {
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 >= len(args) {
+			return "", nil, ErrNOTO
+		}
+		to = canonicalUsername(args[i+1])
+		i++
+	}
+
+	return to, rest, nil
+}
+
+// threadPeer - The other party of the thread of a listing, the seller for
+//              a buyer and the given buyer for the seller
+func threadPeer(username string, product ProductListing, to string) (string, error) {
+	if !sameUser(username, product.Username) {
+		return product.Username, nil
+	}
+	if len(to) == 0 {
+		return "", ErrNOTO
+	}
+	if to == deletedUser {
+		return deletedUser, nil
+	}
+	peer, ok := FindUser(to)
+	if !ok {
+		return "", ErrUNKU
+	}
+	if sameUser(peer.Username, username) {
+		return "", ErrSELF
+	}
+
+	return peer.Username, nil
+}
+
+// SendMessage - Send a message about a listing, buyers write to the
+//               seller and the seller answers the buyer given with to
+func SendMessage(username string, id int, to string, body string) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, ok := FindUser(username)
+	if !ok {
+		return ErrUNKU
+	}
+	if !user.Active {
+		return ErrUINA
+	}
+	body = strings.TrimSpace(trimQuotes(body))
+	if len(body) == 0 || len(body) > messageMax || strings.ContainsAny(body, "\r\n") {
+		return ErrMSG
+	}
+	product, err := findProduct(id)
+	if err != nil {
+		return err
+	}
+	peer, err := threadPeer(user.Username, product, to)
+	if err != nil {
+		return err
+	}
+	if !IsUserActive(peer) || blocked(user.Username, peer) {
+		return ErrBLCK
+	}
+
+	messages := loadMessages()
+	next := 1
+	if len(messages) > 0 {
+		next = messages[len(messages)-1].id + 1
+	}
+
+	messages = append(messages, message{id: next, listing: id, from: user.Username,
+		to: peer, sentAt: time.Now().Format(timeFormat), body: body})
+
+	return saveRows(username, "messages", messageRows(messages))
+}
+
+// inThread - Check if a message belongs to the thread of a listing
+//            between two users
+func (m message) inThread(listing int, a string, b string) bool {
+	return m.listing == listing &&
+		((sameUser(m.from, a) && sameUser(m.to, b)) ||
+			(sameUser(m.from, b) && sameUser(m.to, a)))
+}
+
+// UnreadMessages - Number of messages an user has not read yet
+func UnreadMessages(username string) int {
+	unread := 0
+	for _, m := range loadMessages() {
+		if !m.read && sameUser(m.to, username) {
+			unread++
+		}
+	}
+
+	return unread
+}
+
+// GetCSVInbox - Show the threads of an user, latest first, as
+//               listing|other user|last message time|unread|last message
+func GetCSVInbox(username string, page Page) error {
+	if !IsUsernameExist(username) {
+		return ErrUNKU
+	}
+
+	type thread struct {
+		listing int
+		peer    string
+		last    message
+		unread  int
+	}
+	threads := make(map[string]*thread)
+	for _, m := range loadMessages() {
+		peer := m.to
+		if sameUser(m.to, username) {
+			peer = m.from
+		} else if !sameUser(m.from, username) {
+			continue
+		}
+
+		key := fmt.Sprintf("%d|%s", m.listing, canonicalUsername(peer))
+		t, ok := threads[key]
+		if !ok {
+			t = &thread{listing: m.listing, peer: peer}
+			threads[key] = t
+		}
+		t.last = m
+		if !m.read && sameUser(m.to, username) {
+			t.unread++
+		}
+	}
+	if len(threads) == 0 {
+		return errors.New("Error - inbox is empty")
+	}
+
+	var inbox []*thread
+	for _, t := range threads {
+		inbox = append(inbox, t)
+	}
+	sort.Slice(inbox, func(i, j int) bool {
+		return inbox[i].last.id > inbox[j].last.id
+	})
+
+	start, end, next := page.window(len(inbox))
+	for _, t := range inbox[start:end] {
+		fmt.Println(fmt.Sprintf("%d|%s|%s|%d|%s", t.listing, t.peer,
+			t.last.sentAt, t.unread, t.last.body))
+	}
+	page.printNext(next)
+
+	return nil
+}
+
+// GetCSVThread - Show the messages of a thread, oldest first, as
+//                id|from|sent|message and mark the ones shown as read
+func GetCSVThread(username string, id int, to string, page Page) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, ok := FindUser(username)
+	if !ok {
+		return ErrUNKU
+	}
+
+	// The thread of a listing gone from the store, or with a deleted
+	// user, still shows
+	peer := to
+	product, err := findProduct(id)
+	if err == nil && to != deletedUser {
+		peer, err = threadPeer(user.Username, product, to)
+	} else if err == nil || err == ErrLNE {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	messages := loadMessages()
+	var thread []int
+	for i, m := range messages {
+		if m.inThread(id, user.Username, peer) {
+			thread = append(thread, i)
+		}
+	}
+	if len(thread) == 0 {
+		return ErrTHNE
+	}
+
+	start, end, next := page.window(len(thread))
+	for _, i := range thread[start:end] {
+		m := &messages[i]
+		fmt.Println(fmt.Sprintf("%d|%s|%s|%s", m.id, m.from, m.sentAt, m.body))
+		if sameUser(m.to, user.Username) {
+			m.read = true
+		}
+	}
+	page.printNext(next)
+
+	return saveRows(username, "messages", messageRows(messages))
+}
+
+// renameMessages - Rewrite an username in the messages and blocks
+func renameMessages(from string, to string) error {
+	messages := loadMessages()
+	for i := range messages {
+		if sameUser(messages[i].from, from) {
+			messages[i].from = to
+		}
+		if sameUser(messages[i].to, from) {
+			messages[i].to = to
+		}
+	}
+	if len(messages) > 0 {
+		err := saveMessages(messages)
+		if err != nil {
+			return err
+		}
+	}
+
+	blocks := loadBlocks()
+	for i := range blocks {
+		for j := range blocks[i] {
+			if sameUser(blocks[i][j], from) {
+				blocks[i][j] = to
+			}
+		}
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	return saveBlocks(blocks)
+}
+
+// anonymizeMessages - Hide the name of a deleted user in its messages, so
+//                     a new user of the same name does not get them
+func anonymizeMessages(username string) error {
+	messages := loadMessages()
+	for i := range messages {
+		if sameUser(messages[i].from, username) {
+			messages[i].from = deletedUser
+		}
+		if sameUser(messages[i].to, username) {
+			messages[i].to = deletedUser
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return saveMessages(messages)
+}
+
+// dropBlocks - Remove the blocks made by or against a deleted user
+func dropBlocks(username string) error {
+	var kept [][2]string
+	for _, b := range loadBlocks() {
+		if !sameUser(b[0], username) && !sameUser(b[1], username) {
+			kept = append(kept, b)
+		}
+	}
+
+	return saveBlocks(kept)
+}
@@ -0,0 +1,167 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+// thread - Print a thread, marking its messages as read
+func thread(t *testing.T, username string, id int, to string) ([]string, error) {
+	t.Helper()
+
+	var err error
+	lines := captureOutput(t, func() {
+		err = GetCSVThread(username, id, to, Page{})
+	})
+
+	return lines, err
+}
+
+func TestSendMessage(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	if err := SendMessage("user2", id, "", "'Is it still available?'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendMessage("user1", id, "", "Yes"); err != ErrNOTO {
+		t.Errorf("seller without --to: %v, want %v", err, ErrNOTO)
+	}
+	if err := SendMessage("user1", id, "user1", "Yes"); err != ErrSELF {
+		t.Errorf("seller to itself: %v, want %v", err, ErrSELF)
+	}
+	if err := SendMessage("user1", id, "user3", "Yes"); err != ErrUNKU {
+		t.Errorf("seller to an unknown user: %v, want %v", err, ErrUNKU)
+	}
+	for _, body := range []string{"''", "two\nlines", strings.Repeat("a", messageMax+1)} {
+		if err := SendMessage("user2", id, "", body); err != ErrMSG {
+			t.Errorf("body %q: %v, want %v", body, err, ErrMSG)
+		}
+	}
+	if err := SendMessage("user1", id, "user2", "'Yes it is'"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := BlockUser("user1", "user2", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendMessage("user2", id, "", "Hello?"); err != ErrBLCK {
+		t.Errorf("message to a user who blocked you: %v, want %v", err, ErrBLCK)
+	}
+	if err := SendMessage("user1", id, "user2", "Sorry"); err != ErrBLCK {
+		t.Errorf("message to a blocked user: %v, want %v", err, ErrBLCK)
+	}
+	if err := BlockUser("user1", "user2", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendMessage("user2", id, "", "Hello?"); err != nil {
+		t.Errorf("message after unblock: %v", err)
+	}
+}
+
+func TestInboxAndThread(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2", "user3")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	for _, buyer := range []string{"user2", "user3"} {
+		if err := SendMessage(buyer, id, "", "'Is it still available?'"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := UnreadMessages("user1"); n != 2 {
+		t.Errorf("unread %d, want 2", n)
+	}
+	lines := captureOutput(t, func() {
+		if err := GetCSVInbox("user1", Page{}); err != nil {
+			t.Error(err)
+		}
+	})
+	if len(lines) != 2 || !hasLine(lines[:1], "|user3|", "|1|") || !hasLine(lines[1:], "|user2|") {
+		t.Errorf("inbox = %q", lines)
+	}
+
+	lines, err := thread(t, "user1", id, "user2")
+	if err != nil || len(lines) != 1 || !hasLine(lines, "|user2|", "Is it still available?") {
+		t.Errorf("thread = %q, %v", lines, err)
+	}
+	if n := UnreadMessages("user1"); n != 1 {
+		t.Errorf("unread %d after reading a thread, want 1", n)
+	}
+	if _, err := thread(t, "user1", id, ""); err != ErrNOTO {
+		t.Errorf("seller thread without --to: %v, want %v", err, ErrNOTO)
+	}
+	if _, err := thread(t, "user2", id+1, "user1"); err != ErrTHNE {
+		t.Errorf("thread of another listing: %v, want %v", err, ErrTHNE)
+	}
+}
+
+// TestDeletedUserMessages - A new user taking the name of a deleted one
+//                           does not get its messages
+func TestDeletedUserMessages(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	if err := SendMessage("user2", id, "", "'Is it still available?'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendMessage("user1", id, "user2", "'Yes it is'"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteUser("user2", "user2", ""); err != nil {
+		t.Fatal(err)
+	}
+	register(t, "user2")
+
+	if n := UnreadMessages("user2"); n != 0 {
+		t.Errorf("new user2 has %d unread messages", n)
+	}
+	if err := GetCSVInbox("user2", Page{}); err == nil {
+		t.Errorf("new user2 sees the inbox of the deleted one")
+	}
+	if _, err := thread(t, "user2", id, ""); err != ErrTHNE {
+		t.Errorf("new user2 thread: %v, want %v", err, ErrTHNE)
+	}
+
+	lines, err := thread(t, "user1", id, deletedUser)
+	if err != nil || len(lines) != 2 || !hasLine(lines, "|"+deletedUser+"|") {
+		t.Errorf("thread with the deleted user = %q, %v", lines, err)
+	}
+	if err := SendMessage("user1", id, deletedUser, "Hello?"); err != ErrBLCK {
+		t.Errorf("message to the deleted user: %v, want %v", err, ErrBLCK)
+	}
+	if _, err := NormalizeUsername(deletedUser); err == nil {
+		t.Errorf("%s is a valid username", deletedUser)
+	}
+}
@@ -0,0 +1,232 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultCurrency = "SGD"
+)
+
+var (
+	csvRatesPath = "/tmp/rates.csv"
+
+	ErrBADM = errors.New("Error - Invalid price, use an amount like 19.99 and an optional currency like USD")
+	ErrBADR = errors.New("Error - Invalid exchange rate")
+
+	// currencies - ISO 4217 codes and their number of minor unit digits
+	currencies = map[string]int{
+		"AUD": 2, "BHD": 3, "CAD": 2, "CHF": 2, "CNY": 2, "EUR": 2,
+		"GBP": 2, "HKD": 2, "IDR": 2, "INR": 2, "JPY": 0, "KRW": 0,
+		"KWD": 3, "MYR": 2, "NZD": 2, "PHP": 2, "SGD": 2, "THB": 2,
+		"TWD": 2, "USD": 2, "VND": 0,
+	}
+
+	moneyRgx = regexp.MustCompile(`^([A-Za-z]{3})?\s*([0-9]+)(?:\.([0-9]+))?\s*([A-Za-z]{3})?$`)
+
+	// rates - Value of one unit of a currency in DefaultCurrency, loaded
+	//         once from csvRatesPath
+	rates map[string]*big.Rat
+)
+
+// Money - An exact amount in the minor units of an ISO 4217 currency
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// ParseMoney - Parse 19.99, 19.99 USD, USD 19.99 or 19.99USD, a missing
+//              currency is DefaultCurrency and a bare integer is a whole
+//              amount, so the prices stored before Money read back the same
+func ParseMoney(value string) (Money, error) {
+	m := moneyRgx.FindStringSubmatch(strings.TrimSpace(trimQuotes(value)))
+	if m == nil || (len(m[1]) > 0 && len(m[4]) > 0) {
+		return Money{}, ErrBADM
+	}
+
+	currency := strings.ToUpper(m[1] + m[4])
+	if len(currency) == 0 {
+		currency = DefaultCurrency
+	}
+	digits, ok := currencies[currency]
+	if !ok || len(m[3]) > digits {
+		return Money{}, ErrBADM
+	}
+
+	minor := m[2] + m[3] + strings.Repeat("0", digits-len(m[3]))
+	amount, err := strconv.ParseInt(minor, 10, 64)
+	if err != nil {
+		return Money{}, ErrBADM
+	}
+
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// String - Format the amount with the digits of its currency, 19.99 USD
+func (m Money) String() string {
+	digits := currencies[m.Currency]
+	if digits == 0 {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+
+	scale := int64(1)
+	for i := 0; i < digits; i++ {
+		scale *= 10
+	}
+
+	return fmt.Sprintf("%d.%0*d %s", m.Amount/scale, digits, m.Amount%scale, m.Currency)
+}
+
+// rat - Exact value in major units
+func (m Money) rat() *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencies[m.Currency])), nil)
+	return new(big.Rat).SetFrac(big.NewInt(m.Amount), scale)
+}
+
+// loadRates - Read the local exchange rate table, one CUR|rate row per
+//             currency giving the value of one unit in DefaultCurrency
+func loadRates() map[string]*big.Rat {
+	if rates != nil {
+		return rates
+	}
+
+	rates = map[string]*big.Rat{DefaultCurrency: big.NewRat(1, 1)}
+	file, err := os.Open(csvRatesPath)
+	if err != nil {
+		return rates
+	}
+	defer file.Close()
+
+	lines, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return rates
+	}
+
+	for _, line := range lines {
+		splEntry := strings.Split(line[0], "|")
+		if len(splEntry) != 2 {
+			continue
+		}
+		rate, ok := new(big.Rat).SetString(strings.TrimSpace(splEntry[1]))
+		if ok && rate.Sign() > 0 {
+			rates[strings.ToUpper(strings.TrimSpace(splEntry[0]))] = rate
+		}
+	}
+
+	return rates
+}
+
+// inDefault - Exact value of the amount in DefaultCurrency, false if the
+//             rate table has no rate for its currency
+func (m Money) inDefault() (*big.Rat, bool) {
+	rate, ok := loadRates()[m.Currency]
+	if !ok {
+		return nil, false
+	}
+
+	return new(big.Rat).Mul(m.rat(), rate), true
+}
+
+// Compare - Three way comparison of two amounts, amounts in different
+//           currencies go through the exchange rate table and are not
+//           comparable when a rate is missing
+func (m Money) Compare(o Money) (int, bool) {
+	if m.Currency == o.Currency {
+		switch {
+		case m.Amount < o.Amount:
+			return -1, true
+		case m.Amount > o.Amount:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	a, ok := m.inDefault()
+	if !ok {
+		return 0, false
+	}
+	b, ok := o.inDefault()
+	if !ok {
+		return 0, false
+	}
+
+	return a.Cmp(b), true
+}
+
+// SetExchangeRate - Store the value of one unit of currency in
+//                   DefaultCurrency in the local rate table
+func SetExchangeRate(currency string, value string) error {
+	currency = strings.ToUpper(trimQuotes(currency))
+	if _, ok := currencies[currency]; !ok || currency == DefaultCurrency {
+		return ErrBADM
+	}
+	rate, ok := new(big.Rat).SetString(trimQuotes(value))
+	if !ok || rate.Sign() <= 0 {
+		return ErrBADR
+	}
+
+	table := loadRates()
+	table[currency] = rate
+
+	var lines [][]string
+	for k, v := range table {
+		if k != DefaultCurrency {
+			// The exact fraction, a rounded one loses the small rates
+			lines = append(lines, []string{k + "|" + v.RatString()})
+		}
+	}
+
+	return writeCSVAtomic(csvRatesPath, lines)
+}
+
+// PrintExchangeRates - Show the local exchange rate table
+func PrintExchangeRates() {
+	table := loadRates()
+
+	var codes []string
+	for k := range table {
+		codes = append(codes, k)
+	}
+	sort.Strings(codes)
+
+	for _, k := range codes {
+		fmt.Println(fmt.Sprintf("%s|%s", k, table[k].FloatString(6)))
+	}
+}
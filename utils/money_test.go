@@ -0,0 +1,148 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Money
+	}{
+		{"1000", Money{100000, "SGD"}},
+		{"19.99", Money{1999, "SGD"}},
+		{"19.9", Money{1990, "SGD"}},
+		{"'19.99 USD'", Money{1999, "USD"}},
+		{"USD 19.99", Money{1999, "USD"}},
+		{"19.99usd", Money{1999, "USD"}},
+		{"1500 JPY", Money{1500, "JPY"}},
+		{"1.234 KWD", Money{1234, "KWD"}},
+		{"0", Money{0, "SGD"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMoney(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "abc", "-5", "1.999", "15.5 JPY", "10 XYZ",
+		"USD 10 EUR", "1,000", "99999999999999999999"} {
+		if _, err := ParseMoney(value); err != ErrBADM {
+			t.Errorf("ParseMoney(%q): %v, want %v", value, err, ErrBADM)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{Money{1999, "USD"}, "19.99 USD"},
+		{Money{5, "SGD"}, "0.05 SGD"},
+		{Money{100000, "SGD"}, "1000.00 SGD"},
+		{Money{1500, "JPY"}, "1500 JPY"},
+		{Money{1234, "KWD"}, "1.234 KWD"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("%#v.String() = %q, want %q", tt.m, got, tt.want)
+		}
+		// The stored form reads back the same
+		if back, err := ParseMoney(tt.want); err != nil || back != tt.m {
+			t.Errorf("ParseMoney(%q) = %v, %v", tt.want, back, err)
+		}
+	}
+}
+
+func TestMoneyCompare(t *testing.T) {
+	resetData(t)
+	err := SetExchangeRate("USD", "1.35")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		a, b Money
+		want int
+		ok   bool
+	}{
+		{Money{1000, "SGD"}, Money{2000, "SGD"}, -1, true},
+		{Money{2000, "EUR"}, Money{2000, "EUR"}, 0, true},
+		{Money{100, "USD"}, Money{135, "SGD"}, 0, true},
+		{Money{100, "USD"}, Money{134, "SGD"}, 1, true},
+		{Money{134, "SGD"}, Money{100, "USD"}, -1, true},
+		{Money{100, "EUR"}, Money{100, "SGD"}, 0, false},
+		{Money{100, "USD"}, Money{100, "EUR"}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.a.Compare(tt.b)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%v.Compare(%v) = %d, %v, want %d, %v", tt.a, tt.b, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestSmallExchangeRate - A rate below the rounding of six decimals is
+//                         stored exactly and survives a reload
+func TestSmallExchangeRate(t *testing.T) {
+	resetData(t)
+	err := SetExchangeRate("IDR", "0.0000000857")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetExchangeRate("VND", "27/500000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rates = nil
+	table := loadRates()
+	want, _ := new(big.Rat).SetString("0.0000000857")
+	if got, ok := table["IDR"]; !ok || got.Cmp(want) != 0 {
+		t.Errorf("IDR rate = %v, want %v", got, want)
+	}
+	if got, ok := table["VND"]; !ok || got.Cmp(big.NewRat(27, 500000)) != 0 {
+		t.Errorf("VND rate = %v", got)
+	}
+
+	for _, value := range []string{"0", "-1", "abc"} {
+		if err := SetExchangeRate("USD", value); err != ErrBADR {
+			t.Errorf("SetExchangeRate(USD, %s): %v, want %v", value, err, ErrBADR)
+		}
+	}
+	if err := SetExchangeRate("SGD", "2"); err != ErrBADM {
+		t.Errorf("SetExchangeRate(SGD): %v, want %v", err, ErrBADM)
+	}
+}
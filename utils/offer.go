@@ -0,0 +1,469 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// offerTTL - Time an offer stays open when no expiry is given
+	offerTTL = 48 * time.Hour
+
+	OfferPending   = "pending"
+	OfferCountered = "countered"
+	OfferAccepted  = "accepted"
+	OfferRejected  = "rejected"
+	OfferExpired   = "expired"
+)
+
+var (
+	csvOffersPath = "/tmp/offers.csv"
+
+	ErrONE  = errors.New("Error - offer does not exist")
+	ErrOOWN = errors.New("Error - cannot make an offer on your own listing")
+	ErrOPND = errors.New("Error - offer is not pending")
+	ErrOTO  = errors.New("Error - offer is not addressed to you")
+	ErrODUP = errors.New("Error - you already have a pending offer on this listing")
+	ErrONA  = errors.New("Error - listing is not open to offers")
+	ErrBADX = errors.New("Error - Invalid expiry, use a duration as 30m, 24h or 7d")
+)
+
+// Offer - A price proposed for a listing. The buyer makes the first offer
+//         of a negotiation, then buyer and seller counter each other, each
+//         counter offer points to the offer it answers.
+type Offer struct {
+	Id        int
+	Listing   int
+	Buyer     string
+	From      string
+	Price     Money
+	Status    string
+	CreatedAt string
+	ExpiresAt string
+	Parent    int
+}
+
+// parseOffer - Parse a row of the csv offer file, each row is
+//              id|listing|buyer|from|price|status|created|expires|parent
+func parseOffer(entry string) (Offer, error) {
+	splEntry := strings.Split(entry, "|")
+	if len(splEntry) != 9 {
+		return Offer{}, ErrMALF
+	}
+
+	id, err := strconv.Atoi(splEntry[0])
+	if err != nil {
+		return Offer{}, ErrMALF
+	}
+	listing, err := strconv.Atoi(splEntry[1])
+	if err != nil {
+		return Offer{}, ErrMALF
+	}
+	price, err := ParseMoney(splEntry[4])
+	if err != nil {
+		return Offer{}, ErrMALF
+	}
+	parent, _ := strconv.Atoi(splEntry[8])
+
+	return Offer{Id: id, Listing: listing, Buyer: splEntry[2], From: splEntry[3],
+		Price: price, Status: splEntry[5], CreatedAt: splEntry[6],
+		ExpiresAt: splEntry[7], Parent: parent}, nil
+}
+
+// offerRecord - Format an offer as a row of the csv offer file
+func offerRecord(o Offer) string {
+	return fmt.Sprintf("%d|%d|%s|%s|%s|%s|%s|%s|%d", o.Id, o.Listing, o.Buyer,
+		o.From, o.Price, o.Status, o.CreatedAt, o.ExpiresAt, o.Parent)
+}
+
+// loadOffers - Read and parse all offers from the csv offer file
+func loadOffers() []Offer {
+	var offers []Offer
+
+	for _, line := range readCSVRows(csvOffersPath) {
+		offer, err := parseOffer(line[0])
+		if err == nil {
+			offers = append(offers, offer)
+		}
+	}
+
+	return offers
+}
+
+// offerRows - Rows of the csv offer file
+func offerRows(offers []Offer) [][]string {
+	var lines [][]string
+	for _, o := range offers {
+		lines = append(lines, []string{offerRecord(o)})
+	}
+
+	return lines
+}
+
+// saveOffers - Regenerates the csv offer file
+func saveOffers(offers []Offer) error {
+	return writeCSVAtomic(csvOffersPath, offerRows(offers))
+}
+
+// state - Status of an offer, a pending offer past its expiry is expired
+func (o Offer) state() string {
+	if o.Status != OfferPending {
+		return o.Status
+	}
+
+	expires, err := time.ParseInLocation(timeFormat, o.ExpiresAt, time.Local)
+	if err == nil && time.Now().After(expires) {
+		return OfferExpired
+	}
+
+	return OfferPending
+}
+
+// to - The party an offer waits for, the seller for offers made by the
+//      buyer and the buyer for counter offers made by the seller
+func (o Offer) to(seller string) string {
+	if sameUser(o.From, o.Buyer) {
+		return seller
+	}
+
+	return o.Buyer
+}
+
+// ParseExpiry - Take --expires out of the arguments, a duration as 30m,
+//               24h or 7d. Offers expire after 48 hours by default.
+func ParseExpiry(args []string) (ttl time.Duration, rest []string, err error) {
+	ttl = offerTTL
+	for i := 0; i < len(args); i++ {
+		if args[i] != "--expires" {
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 >= len(args) {
+			return 0, nil, ErrBADX
+		}
+		value := trimQuotes(args[i+1])
+		i++
+
+		if days := strings.TrimSuffix(value, "d"); days != value {
+			n, err := strconv.Atoi(days)
+			ttl = time.Duration(n) * 24 * time.Hour
+			if err != nil {
+				return 0, nil, ErrBADX
+			}
+		} else if ttl, err = time.ParseDuration(value); err != nil {
+			return 0, nil, ErrBADX
+		}
+		if ttl <= 0 {
+			return 0, nil, ErrBADX
+		}
+	}
+
+	return ttl, rest, nil
+}
+
+// newOffer - Append an offer with the next free offer ID
+func newOffer(offers []Offer, o Offer, ttl time.Duration) ([]Offer, Offer) {
+	for _, other := range offers {
+		if other.Id >= o.Id {
+			o.Id = other.Id + 1
+		}
+	}
+	if o.Id == 0 {
+		o.Id = 1
+	}
+
+	now := time.Now()
+	o.Status = OfferPending
+	o.CreatedAt = now.Format(timeFormat)
+	o.ExpiresAt = now.Add(ttl).Format(timeFormat)
+
+	return append(offers, o), o
+}
+
+// MakeOffer - Offer a price for the active listing of another seller,
+//             returns the offer ID
+func MakeOffer(username string, id int, price Money, ttl time.Duration) (int, error) {
+	unlock, err := lockData()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	user, ok := FindUser(username)
+	if !ok {
+		return 0, ErrUNKU
+	}
+	if !user.Active {
+		return 0, ErrUINA
+	}
+	product, err := findProduct(id)
+	if err != nil {
+		return 0, err
+	}
+	if sameUser(product.Username, user.Username) {
+		return 0, ErrOOWN
+	}
+	if product.state() != StatusActive {
+		return 0, ErrONA
+	}
+
+	offers := loadOffers()
+	for _, o := range offers {
+		if o.Listing == id && sameUser(o.Buyer, user.Username) && o.state() == OfferPending {
+			return 0, ErrODUP
+		}
+	}
+
+	offers, offer := newOffer(offers, Offer{Listing: id, Buyer: user.Username,
+		From: user.Username, Price: price}, ttl)
+
+	return offer.Id, saveRows(username, "offers", offerRows(offers))
+}
+
+// answerOffer - Find a pending offer waiting for username on a listing
+//               still open to offers
+func answerOffer(offers []Offer, username string, id int) (int, ProductListing, error) {
+	for i, o := range offers {
+		if o.Id != id {
+			continue
+		}
+
+		product, err := findProduct(o.Listing)
+		if err != nil {
+			return 0, product, err
+		}
+		if !sameUser(o.to(product.Username), username) {
+			return 0, product, ErrOTO
+		}
+		if o.state() != OfferPending {
+			return 0, product, fmt.Errorf("%s, it is %s", ErrOPND, o.state())
+		}
+		if product.state() != StatusActive {
+			return 0, product, ErrONA
+		}
+
+		return i, product, nil
+	}
+
+	return 0, ProductListing{}, ErrONE
+}
+
+// CounterOffer - Answer a pending offer with another price, returns the
+//                ID of the counter offer
+func CounterOffer(username string, id int, price Money, ttl time.Duration) (int, error) {
+	unlock, err := lockData()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	offers := loadOffers()
+	i, _, err := answerOffer(offers, username, id)
+	if err != nil {
+		return 0, err
+	}
+
+	offers[i].Status = OfferCountered
+	offers, offer := newOffer(offers, Offer{Listing: offers[i].Listing,
+		Buyer: offers[i].Buyer, From: canonicalUsername(username),
+		Price: price, Parent: id}, ttl)
+
+	return offer.Id, saveRows(username, "offers", offerRows(offers))
+}
+
+// AcceptOffer - Accept a pending offer, the listing gets reserved and the
+//               other pending offers on it are rejected. Both go to the
+//               journal as one change.
+func AcceptOffer(username string, id int) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	offers := loadOffers()
+	i, product, err := answerOffer(offers, username, id)
+	if err != nil {
+		return err
+	}
+	acceptOffer(offers, i)
+
+	seq, err := beginJournal(username, JournalAcceptOffer, strconv.Itoa(id))
+	if err != nil {
+		return err
+	}
+	err = SetCSVItemStatus(product.Username, product.Id, StatusReserved)
+	if err == nil {
+		err = saveOffers(offers)
+	}
+
+	return endJournal(seq, JournalAcceptOffer, err)
+}
+
+// acceptOffer - Accept the offer at i and reject the other pending offers
+//               on its listing
+func acceptOffer(offers []Offer, i int) {
+	for j, o := range offers {
+		switch {
+		case j == i:
+			offers[j].Status = OfferAccepted
+		case o.Listing == offers[i].Listing && o.state() == OfferPending:
+			offers[j].Status = OfferRejected
+		}
+	}
+}
+
+// settleOffer - Finish an accepted offer a crash cut short, the offer is
+//               accepted and its listing reserved. Settling it again
+//               changes nothing.
+func settleOffer(id int) error {
+	offers := loadOffers()
+	for i, o := range offers {
+		if o.Id != id {
+			continue
+		}
+		if o.Status != OfferAccepted {
+			acceptOffer(offers, i)
+			err := saveOffers(offers)
+			if err != nil {
+				return err
+			}
+		}
+
+		product, err := findProduct(o.Listing)
+		if err != nil || product.Status == StatusReserved {
+			return nil
+		}
+		product.Status = StatusReserved
+		store, err := currentStore()
+		if err == nil {
+			err = store.update(product)
+		}
+		if err == nil {
+			err = indexProduct(product)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// RejectOffer - Turn down a pending offer
+func RejectOffer(username string, id int) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	offers := loadOffers()
+	i, _, err := answerOffer(offers, username, id)
+	if err != nil {
+		return err
+	}
+	offers[i].Status = OfferRejected
+
+	return saveRows(username, "offers", offerRows(offers))
+}
+
+// GetCSVOffers - Show the offers an user made or got as
+//                id|listing|buyer|from|price|status|created|expires|parent,
+//                only the offers on one listing when id is not 0
+func GetCSVOffers(username string, id int, page Page) error {
+	if !IsUsernameExist(username) {
+		return ErrUNKU
+	}
+
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	var offers []Offer
+	for _, o := range loadOffers() {
+		if id != 0 && o.Listing != id {
+			continue
+		}
+		product, _ := store.get(o.Listing)
+		if sameUser(o.Buyer, username) || sameUser(product.Username, username) {
+			o.Status = o.state()
+			offers = append(offers, o)
+		}
+	}
+	if len(offers) == 0 {
+		return errors.New("Error - no offers found")
+	}
+
+	start, end, next := page.window(len(offers))
+	for _, o := range offers[start:end] {
+		fmt.Println(offerRecord(o))
+	}
+	page.printNext(next)
+
+	return nil
+}
+
+// renameOffers - Rewrite an username as buyer and maker of the offers
+func renameOffers(from string, to string) error {
+	offers := loadOffers()
+	for i := range offers {
+		if sameUser(offers[i].Buyer, from) {
+			offers[i].Buyer = to
+		}
+		if sameUser(offers[i].From, from) {
+			offers[i].From = to
+		}
+	}
+	if len(offers) == 0 {
+		return nil
+	}
+
+	return saveOffers(offers)
+}
+
+// withdrawOffers - Reject the pending offers of a deleted user, the
+//                  settled ones are kept as the record of the sale
+func withdrawOffers(username string) error {
+	offers := loadOffers()
+	for i, o := range offers {
+		if sameUser(o.Buyer, username) && o.state() == OfferPending {
+			offers[i].Status = OfferRejected
+		}
+	}
+	if len(offers) == 0 {
+		return nil
+	}
+
+	return saveOffers(offers)
+}
@@ -0,0 +1,260 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeOffer - Offer a price in the default currency, failing the test on
+//             error, returns the offer ID
+func makeOffer(t *testing.T, username string, id int, amount int64) int {
+	t.Helper()
+
+	offer, err := MakeOffer(username, id, Money{Amount: amount, Currency: DefaultCurrency}, time.Hour)
+	if err != nil {
+		t.Fatalf("offer on %d: %s", id, err)
+	}
+
+	return offer
+}
+
+// findOffer - Read an offer back from the csv offer file
+func findOffer(t *testing.T, id int) Offer {
+	t.Helper()
+
+	for _, o := range loadOffers() {
+		if o.Id == id {
+			return o
+		}
+	}
+	t.Fatalf("offer %d not found", id)
+
+	return Offer{}
+}
+
+func TestMakeOffer(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	price := Money{Amount: 8000, Currency: DefaultCurrency}
+
+	if _, err := MakeOffer("user3", id, price, time.Hour); err != ErrUNKU {
+		t.Errorf("offer by an unknown user: %v, want %v", err, ErrUNKU)
+	}
+	if _, err := MakeOffer("user1", id, price, time.Hour); err != ErrOOWN {
+		t.Errorf("offer on your own listing: %v, want %v", err, ErrOOWN)
+	}
+	if _, err := MakeOffer("user2", id+1, price, time.Hour); err != ErrLNE {
+		t.Errorf("offer on a missing listing: %v, want %v", err, ErrLNE)
+	}
+
+	offer := makeOffer(t, "user2", id, 8000)
+	if _, err := MakeOffer("user2", id, price, time.Hour); err != ErrODUP {
+		t.Errorf("second pending offer: %v, want %v", err, ErrODUP)
+	}
+	if o := findOffer(t, offer); o.Buyer != "user2" || o.From != "user2" ||
+		o.Price != price || o.state() != OfferPending {
+		t.Errorf("offer = %v", o)
+	}
+
+	if err := SetCSVItemStatus("user1", id, StatusArchived); err != nil {
+		t.Fatal(err)
+	}
+	register(t, "user3")
+	if _, err := MakeOffer("user3", id, price, time.Hour); err != ErrONA {
+		t.Errorf("offer on an archived listing: %v, want %v", err, ErrONA)
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2", "user3")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	first := makeOffer(t, "user2", id, 8000)
+	other := makeOffer(t, "user3", id, 7000)
+
+	price := Money{Amount: 9500, Currency: DefaultCurrency}
+	if _, err := CounterOffer("user2", first, price, time.Hour); err != ErrOTO {
+		t.Errorf("buyer counters its own offer: %v, want %v", err, ErrOTO)
+	}
+	counter, err := CounterOffer("user1", first, price, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := findOffer(t, counter); o.Parent != first || o.From != "user1" || o.Buyer != "user2" {
+		t.Errorf("counter offer = %v", o)
+	}
+	if err := AcceptOffer("user1", first); err == nil || !strings.HasPrefix(err.Error(), ErrOPND.Error()) {
+		t.Errorf("accept a countered offer: %v", err)
+	}
+	if err := AcceptOffer("user1", counter); err != ErrOTO {
+		t.Errorf("seller accepts its counter offer: %v, want %v", err, ErrOTO)
+	}
+
+	if err := AcceptOffer("user2", counter); err != nil {
+		t.Fatal(err)
+	}
+	// The reservation and the offers are one change of the journal
+	records := lastJournal(t, 4)
+	if records[0].op != JournalAcceptOffer || records[0].phase != journalBegin ||
+		records[3].seq != records[0].seq || records[3].phase != journalCommit {
+		t.Errorf("accept journaled as %v", records)
+	}
+	if p := getListing(t, id); p.state() != StatusReserved {
+		t.Errorf("listing %s after accept, want %s", p.state(), StatusReserved)
+	}
+	if o := findOffer(t, other); o.Status != OfferRejected {
+		t.Errorf("other offer %s after accept, want %s", o.Status, OfferRejected)
+	}
+	if err := RejectOffer("user1", other); err == nil {
+		t.Errorf("rejected an offer twice")
+	}
+	if err := AcceptOffer("user2", 99); err != ErrONE {
+		t.Errorf("accept a missing offer: %v, want %v", err, ErrONE)
+	}
+}
+
+func TestOfferExpiry(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	offer := makeOffer(t, "user2", id, 8000)
+
+	offers := loadOffers()
+	offers[0].ExpiresAt = time.Now().Add(-time.Hour).Format(timeFormat)
+	if err := saveOffers(offers); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AcceptOffer("user1", offer); err == nil || !strings.Contains(err.Error(), OfferExpired) {
+		t.Errorf("accept an expired offer: %v", err)
+	}
+	// An expired offer does not block a new one
+	makeOffer(t, "user2", id, 8500)
+
+	lines := captureOutput(t, func() {
+		err := GetCSVOffers("user1", id, Page{})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	if len(lines) != 2 || !hasLine(lines, "|expired|") || !hasLine(lines, "|pending|") {
+		t.Errorf("offers = %q", lines)
+	}
+}
+
+// TestOfferExpiryLocalTime - The expiry is a local time, an offer lasts
+//                            its TTL whatever the zone
+func TestOfferExpiryLocalTime(t *testing.T) {
+	for _, hours := range testZones {
+		func() {
+			defer inZone(hours)()
+
+			resetData(t)
+			register(t, "user1", "user2")
+			id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+			offer, err := MakeOffer("user2", id, Money{Amount: 8000, Currency: DefaultCurrency},
+				30*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state := findOffer(t, offer).state(); state != OfferPending {
+				t.Errorf("UTC%+d: new offer %s, want %s", hours, state, OfferPending)
+			}
+
+			o := findOffer(t, offer)
+			o.ExpiresAt = time.Now().Add(-time.Minute).Format(timeFormat)
+			if state := o.state(); state != OfferExpired {
+				t.Errorf("UTC%+d: offer past expiry %s, want %s", hours, state, OfferExpired)
+			}
+		}()
+	}
+}
+
+func TestReplayAcceptOffer(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2", "user3")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	accepted := makeOffer(t, "user2", id, 8000)
+	other := makeOffer(t, "user3", id, 7000)
+
+	// A crash after the journal, before the listing or the offers changed
+	if _, err := beginJournal("user1", JournalAcceptOffer, strconv.Itoa(accepted)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if n, err := ReplayJournal(); err != nil || n != 1-i {
+			t.Fatalf("replay %d: %d, %v", i+1, n, err)
+		}
+		if o := findOffer(t, accepted); o.Status != OfferAccepted {
+			t.Errorf("offer %s, want %s", o.Status, OfferAccepted)
+		}
+		if o := findOffer(t, other); o.Status != OfferRejected {
+			t.Errorf("other offer %s, want %s", o.Status, OfferRejected)
+		}
+		if p := getListing(t, id); p.Status != StatusReserved {
+			t.Errorf("listing %s, want %s", p.Status, StatusReserved)
+		}
+	}
+
+	records := lastJournal(t, 1)
+	if records[0].op != JournalAcceptOffer || records[0].payload != "replayed" {
+		t.Errorf("last record = %v", records[0])
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	tests := []struct {
+		args []string
+		ttl  time.Duration
+		err  error
+	}{
+		{[]string{"80"}, offerTTL, nil},
+		{[]string{"80", "--expires", "30m"}, 30 * time.Minute, nil},
+		{[]string{"--expires", "'7d'", "80"}, 7 * 24 * time.Hour, nil},
+		{[]string{"80", "--expires"}, 0, ErrBADX},
+		{[]string{"80", "--expires", "0d"}, 0, ErrBADX},
+		{[]string{"80", "--expires", "-1h"}, 0, ErrBADX},
+		{[]string{"80", "--expires", "soon"}, 0, ErrBADX},
+	}
+	for _, tt := range tests {
+		ttl, rest, err := ParseExpiry(tt.args)
+		if err != tt.err || ttl != tt.ttl {
+			t.Errorf("ParseExpiry(%q) = %v, %v, want %v, %v", tt.args, ttl, err, tt.ttl, tt.err)
+		}
+		if err == nil && (len(rest) != 1 || rest[0] != "80") {
+			t.Errorf("ParseExpiry(%q) left %q", tt.args, rest)
+		}
+	}
+}
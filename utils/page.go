@@ -0,0 +1,166 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrBADP = errors.New("Error - Invalid --limit or --offset")
+	ErrBADC = errors.New("Error - Invalid cursor")
+)
+
+// Page - Window of a list command set by --limit, --offset and --cursor.
+//        A cursor pins the highest ID seen by the first page, so items
+//        inserted between two pages never shift the following ones. The
+//        token is hex encoded since the shell lower cases the command line.
+type Page struct {
+	Limit    int
+	Offset   int
+	Cursor   string
+	snapshot int
+	position int
+}
+
+// ParsePage - Take --limit, --offset and --cursor out of the arguments
+func ParsePage(args []string) (page Page, rest []string, err error) {
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		if flag != "--limit" && flag != "--offset" && flag != "--cursor" {
+			rest = append(rest, flag)
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return page, nil, ErrBADP
+		}
+		value := trimQuotes(args[i+1])
+		i++
+
+		switch flag {
+		case "--limit":
+			page.Limit, err = strconv.Atoi(value)
+			if err != nil || page.Limit < 0 {
+				return page, nil, ErrBADP
+			}
+		case "--offset":
+			page.Offset, err = strconv.Atoi(value)
+			if err != nil || page.Offset < 0 {
+				return page, nil, ErrBADP
+			}
+		case "--cursor":
+			page.Cursor = value
+			page.snapshot, page.position, err = decodeCursor(value)
+			if err != nil {
+				return page, nil, err
+			}
+		}
+	}
+
+	return page, rest, nil
+}
+
+func encodeCursor(snapshot int, position int) string {
+	return hex.EncodeToString(
+		[]byte(fmt.Sprintf("%d|%d", snapshot, position)))
+}
+
+func decodeCursor(cursor string) (snapshot int, position int, err error) {
+	raw, err := hex.DecodeString(strings.ToLower(cursor))
+	if err != nil {
+		return 0, 0, ErrBADC
+	}
+
+	splEntry := strings.Split(string(raw), "|")
+	if len(splEntry) != 2 {
+		return 0, 0, ErrBADC
+	}
+	snapshot, err = strconv.Atoi(splEntry[0])
+	if err != nil || snapshot < 0 {
+		return 0, 0, ErrBADC
+	}
+	position, err = strconv.Atoi(splEntry[1])
+	if err != nil || position < 0 {
+		return 0, 0, ErrBADC
+	}
+
+	return snapshot, position, nil
+}
+
+// restrict - Drop the items created after the snapshot of the cursor, the
+//            first page takes the snapshot from the highest ID in use
+func (page *Page) restrict(products []ProductListing) []ProductListing {
+	if page.snapshot == 0 {
+		for _, product := range products {
+			if product.Id > page.snapshot {
+				page.snapshot = product.Id
+			}
+		}
+		return products
+	}
+
+	var kept []ProductListing
+	for _, product := range products {
+		if product.Id <= page.snapshot {
+			kept = append(kept, product)
+		}
+	}
+
+	return kept
+}
+
+// window - Bounds of the page over n sorted results and the cursor of the
+//          next page, empty when this is the last one
+func (page Page) window(n int) (start int, end int, next string) {
+	start = page.position + page.Offset
+	if start > n {
+		start = n
+	}
+
+	end = n
+	if page.Limit > 0 && start+page.Limit < n {
+		end = start + page.Limit
+		next = encodeCursor(page.snapshot, end)
+	}
+
+	return start, end, next
+}
+
+// printNext - Print the cursor of the next page
+func (page Page) printNext(next string) {
+	if len(next) > 0 {
+		fmt.Println("Next - " + next)
+	}
+}
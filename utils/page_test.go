@@ -0,0 +1,108 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParsePage(t *testing.T) {
+	page, rest, err := ParsePage([]string{"user1", "--limit", "2", "phones", "--offset", "'1'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Limit != 2 || page.Offset != 1 || !reflect.DeepEqual(rest, []string{"user1", "phones"}) {
+		t.Errorf("page %+v rest %q", page, rest)
+	}
+
+	for _, args := range [][]string{{"--limit"}, {"--limit", "-1"}, {"--offset", "x"}} {
+		if _, _, err := ParsePage(args); err != ErrBADP {
+			t.Errorf("ParsePage(%q): %v, want %v", args, err, ErrBADP)
+		}
+	}
+	if _, _, err := ParsePage([]string{"--cursor", "zz"}); err != ErrBADC {
+		t.Errorf("bad cursor: %v, want %v", err, ErrBADC)
+	}
+}
+
+func TestPageWindow(t *testing.T) {
+	tests := []struct {
+		page       Page
+		n          int
+		start, end int
+		next       bool
+	}{
+		{Page{}, 5, 0, 5, false},
+		{Page{Limit: 2}, 5, 0, 2, true},
+		{Page{Limit: 2, Offset: 4}, 5, 4, 5, false},
+		{Page{Offset: 9}, 5, 5, 5, false},
+		{Page{Limit: 5}, 5, 0, 5, false},
+	}
+
+	for _, tt := range tests {
+		start, end, next := tt.page.window(tt.n)
+		if start != tt.start || end != tt.end || (len(next) > 0) != tt.next {
+			t.Errorf("%+v.window(%d) = %d, %d, %q", tt.page, tt.n, start, end, next)
+		}
+	}
+}
+
+// TestCursorIgnoresNewItems - Items created after the first page do not
+//                             shift the next pages
+func TestCursorIgnoresNewItems(t *testing.T) {
+	products := []ProductListing{{Id: 1}, {Id: 2}, {Id: 3}}
+
+	first := Page{Limit: 2}
+	first.restrict(products)
+	_, _, next := first.window(len(products))
+
+	page, _, err := ParsePage([]string{"--cursor", next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	products = append(products, ProductListing{Id: 4})
+	kept := page.restrict(products)
+	start, end, next := page.window(len(kept))
+
+	if len(kept) != 3 || start != 2 || end != 3 || next != "" {
+		t.Errorf("second page %d items, window %d..%d, next %q", len(kept), start, end, next)
+	}
+}
+
+func TestPrintNext(t *testing.T) {
+	lines := captureOutput(t, func() {
+		Page{}.printNext(encodeCursor(3, 2))
+	})
+	if want := fmt.Sprintf("Next - %s", encodeCursor(3, 2)); len(lines) != 1 || lines[0] != want {
+		t.Errorf("printNext = %q, want %q", lines, want)
+	}
+}
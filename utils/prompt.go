@@ -30,6 +30,7 @@
 package utils
 
 import (
+	"fmt"
 	"reflect"
 )
 
@@ -45,6 +46,9 @@ func SetPrompt(arg ...string) string {
 	reftype := reflect.TypeOf(prompt)
 	if len(arg) > 0 {
 		prompt.super = arg[0] + "$ "
+		if unread := UnreadMessages(arg[0]); unread > 0 {
+			prompt.super = fmt.Sprintf("%s (%d unread)$ ", arg[0], unread)
+		}
 	} else {
 		f, _ := reftype.FieldByName("super")
 		prompt.super = f.Tag.Get("default")
@@ -0,0 +1,350 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// reviewMax - Longest review or reply in bytes
+	reviewMax = 1000
+)
+
+var (
+	csvReviewsPath = "/tmp/reviews.csv"
+
+	ErrBADG = errors.New("Error - Rating must be a number from 1 to 5")
+	ErrRTXT = errors.New("Error - Review cannot be empty, longer than 1000 bytes or contain '|' or new lines")
+	ErrNBUY = errors.New("Error - only the buyer of a sold listing can review it")
+	ErrRDUP = errors.New("Error - this sale has already been reviewed")
+	ErrRVNE = errors.New("Error - review does not exist")
+	ErrRPLD = errors.New("Error - review already has a reply")
+)
+
+// review - The rating a buyer gave the seller of a listing it bought, a
+//          sale is the accepted offer and gets one review
+type review struct {
+	id        int
+	listing   int
+	offer     int
+	buyer     string
+	seller    string
+	rating    int
+	createdAt string
+	text      string
+	repliedAt string
+	reply     string
+}
+
+// parseReview - Parse a row of the csv review file, each row is
+//               id|listing|offer|buyer|seller|rating|created|review|replied|reply
+func parseReview(entry string) (review, error) {
+	splEntry := strings.Split(entry, "|")
+	if len(splEntry) != 10 {
+		return review{}, ErrMALF
+	}
+
+	var n [4]int
+	for i, field := range []int{0, 1, 2, 5} {
+		v, err := strconv.Atoi(splEntry[field])
+		if err != nil {
+			return review{}, ErrMALF
+		}
+		n[i] = v
+	}
+
+	return review{id: n[0], listing: n[1], offer: n[2], buyer: splEntry[3],
+		seller: splEntry[4], rating: n[3], createdAt: splEntry[6],
+		text: splEntry[7], repliedAt: splEntry[8], reply: splEntry[9]}, nil
+}
+
+// reviewRecord - Format a review as a row of the csv review file
+func reviewRecord(r review) string {
+	return fmt.Sprintf("%d|%d|%d|%s|%s|%d|%s|%s|%s|%s", r.id, r.listing,
+		r.offer, r.buyer, r.seller, r.rating, r.createdAt, r.text,
+		r.repliedAt, r.reply)
+}
+
+// loadReviews - Read and parse all reviews from the csv review file
+func loadReviews() []review {
+	var reviews []review
+
+	for _, line := range readCSVRows(csvReviewsPath) {
+		r, err := parseReview(line[0])
+		if err == nil {
+			reviews = append(reviews, r)
+		}
+	}
+
+	return reviews
+}
+
+// reviewRows - Rows of the csv review file
+func reviewRows(reviews []review) [][]string {
+	var lines [][]string
+	for _, r := range reviews {
+		lines = append(lines, []string{reviewRecord(r)})
+	}
+
+	return lines
+}
+
+// saveReviews - Regenerates the csv review file
+func saveReviews(reviews []review) error {
+	return writeCSVAtomic(csvReviewsPath, reviewRows(reviews))
+}
+
+// reviewText - Check the text of a review or a reply
+func reviewText(text string) (string, error) {
+	text = strings.TrimSpace(trimQuotes(text))
+	if len(text) == 0 || len(text) > reviewMax || strings.ContainsAny(text, "|\r\n") {
+		return "", ErrRTXT
+	}
+
+	return text, nil
+}
+
+// ParseRating - Parse a rating from 1 to 5
+func ParseRating(value string) (int, error) {
+	rating, err := strconv.Atoi(trimQuotes(value))
+	if err != nil || rating < 1 || rating > 5 {
+		return 0, ErrBADG
+	}
+
+	return rating, nil
+}
+
+// sale - The accepted offer of a sold listing, the last one when the
+//        listing was sold more than once
+func sale(product ProductListing) (Offer, bool) {
+	var accepted Offer
+	found := false
+
+	if product.Status != StatusSold {
+		return accepted, false
+	}
+	for _, o := range loadOffers() {
+		if o.Listing == product.Id && o.Status == OfferAccepted {
+			accepted, found = o, true
+		}
+	}
+
+	return accepted, found
+}
+
+// ReviewCSVItem - Rate the seller of a listing the user bought, returns
+//                 the review ID
+func ReviewCSVItem(username string, id int, rating int, text string) (int, error) {
+	unlock, err := lockData()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	user, ok := FindUser(username)
+	if !ok {
+		return 0, ErrUNKU
+	}
+	if !user.Active {
+		return 0, ErrUINA
+	}
+	text, err = reviewText(text)
+	if err != nil {
+		return 0, err
+	}
+	product, err := findProduct(id)
+	if err != nil {
+		return 0, err
+	}
+	offer, ok := sale(product)
+	if !ok || !sameUser(offer.Buyer, user.Username) {
+		return 0, ErrNBUY
+	}
+
+	reviews := loadReviews()
+	next := 1
+	for _, r := range reviews {
+		if r.offer == offer.Id {
+			return 0, ErrRDUP
+		}
+		if r.id >= next {
+			next = r.id + 1
+		}
+	}
+
+	reviews = append(reviews, review{id: next, listing: id, offer: offer.Id,
+		buyer: user.Username, seller: product.Username, rating: rating,
+		createdAt: time.Now().Format(timeFormat), text: text})
+
+	return next, saveRows(username, "reviews", reviewRows(reviews))
+}
+
+// ReplyCSVReview - Answer a review once, only its seller can
+func ReplyCSVReview(username string, id int, text string) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	text, err = reviewText(text)
+	if err != nil {
+		return err
+	}
+
+	reviews := loadReviews()
+	for i, r := range reviews {
+		if r.id != id {
+			continue
+		}
+		if !sameUser(r.seller, username) {
+			return ErrOWN
+		}
+		if len(r.reply) > 0 {
+			return ErrRPLD
+		}
+		reviews[i].repliedAt = time.Now().Format(timeFormat)
+		reviews[i].reply = text
+
+		return saveRows(username, "reviews", reviewRows(reviews))
+	}
+
+	return ErrRVNE
+}
+
+// sellerScore - Average rating of a seller and the number of reviews
+type sellerScore struct {
+	total int
+	count int
+}
+
+func (s sellerScore) String() string {
+	if s.count == 0 {
+		return "no reviews"
+	}
+
+	plural := "s"
+	if s.count == 1 {
+		plural = ""
+	}
+
+	return fmt.Sprintf("%.1f/5 (%d review%s)", float64(s.total)/float64(s.count), s.count, plural)
+}
+
+// sellerScores - Score of every reviewed seller by normal username
+func sellerScores() map[string]sellerScore {
+	scores := make(map[string]sellerScore)
+	for _, r := range loadReviews() {
+		s := scores[canonicalUsername(r.seller)]
+		s.total += r.rating
+		s.count++
+		scores[canonicalUsername(r.seller)] = s
+	}
+
+	return scores
+}
+
+// scoreOf - Score of a seller in a score table
+func scoreOf(scores map[string]sellerScore, seller string) sellerScore {
+	return scores[canonicalUsername(seller)]
+}
+
+// GetCSVUserReviews - Show the score of a seller then its reviews as
+//                     id|listing|buyer|rating|time|review|replied|reply
+func GetCSVUserReviews(username string, seller string, page Page) error {
+	if !IsUsernameExist(username) {
+		return ErrUNKU
+	}
+	target, ok := FindUser(seller)
+	if !ok {
+		return ErrUNKU
+	}
+
+	var reviews []review
+	for _, r := range loadReviews() {
+		if sameUser(r.seller, target.Username) {
+			reviews = append(reviews, r)
+		}
+	}
+
+	fmt.Println(target.Username + "|" + scoreOf(sellerScores(), target.Username).String())
+
+	start, end, next := page.window(len(reviews))
+	for _, r := range reviews[start:end] {
+		fmt.Println(fmt.Sprintf("%d|%d|%s|%d|%s|%s|%s|%s", r.id, r.listing,
+			r.buyer, r.rating, r.createdAt, r.text, r.repliedAt, r.reply))
+	}
+	page.printNext(next)
+
+	return nil
+}
+
+// renameReviews - Rewrite an username as buyer and seller of the reviews
+func renameReviews(from string, to string) error {
+	reviews := loadReviews()
+	for i := range reviews {
+		if sameUser(reviews[i].buyer, from) {
+			reviews[i].buyer = to
+		}
+		if sameUser(reviews[i].seller, from) {
+			reviews[i].seller = to
+		}
+	}
+	if len(reviews) == 0 {
+		return nil
+	}
+
+	return saveReviews(reviews)
+}
+
+// anonymizeReviews - Hide the name of a deleted user in the reviews it
+//                    gave or got, so its score does not go to a new user
+//                    of the same name
+func anonymizeReviews(username string) error {
+	reviews := loadReviews()
+	for i := range reviews {
+		if sameUser(reviews[i].buyer, username) {
+			reviews[i].buyer = deletedUser
+		}
+		if sameUser(reviews[i].seller, username) {
+			reviews[i].seller = deletedUser
+		}
+	}
+	if len(reviews) == 0 {
+		return nil
+	}
+
+	return saveReviews(reviews)
+}
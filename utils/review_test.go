@@ -0,0 +1,172 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"testing"
+)
+
+// sell - Sell a listing to a buyer through an accepted offer
+func sell(t *testing.T, seller string, buyer string, id int) {
+	t.Helper()
+
+	offer := makeOffer(t, buyer, id, 9000)
+	if err := AcceptOffer(seller, offer); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetCSVItemStatus(seller, id, StatusSold); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReviewSale(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2", "user3")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	if _, err := ReviewCSVItem("user2", id, 5, "Great"); err != ErrNBUY {
+		t.Errorf("review before the sale: %v, want %v", err, ErrNBUY)
+	}
+	sell(t, "user1", "user2", id)
+
+	if _, err := ReviewCSVItem("user3", id, 5, "Great"); err != ErrNBUY {
+		t.Errorf("review by another user: %v, want %v", err, ErrNBUY)
+	}
+	if _, err := ReviewCSVItem("user2", id, 5, "'a|b'"); err != ErrRTXT {
+		t.Errorf("review with |: %v, want %v", err, ErrRTXT)
+	}
+	rid, err := ReviewCSVItem("user2", id, 4, "'Fast and friendly'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReviewCSVItem("user2", id, 5, "Again"); err != ErrRDUP {
+		t.Errorf("second review of a sale: %v, want %v", err, ErrRDUP)
+	}
+
+	if err := ReplyCSVReview("user2", rid, "Thanks"); err != ErrOWN {
+		t.Errorf("reply by the buyer: %v, want %v", err, ErrOWN)
+	}
+	if err := ReplyCSVReview("user1", rid, "'Thanks!'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplyCSVReview("user1", rid, "Thanks again"); err != ErrRPLD {
+		t.Errorf("second reply: %v, want %v", err, ErrRPLD)
+	}
+	if err := ReplyCSVReview("user1", rid+1, "Thanks"); err != ErrRVNE {
+		t.Errorf("reply to a missing review: %v, want %v", err, ErrRVNE)
+	}
+
+	lines := captureOutput(t, func() {
+		if err := GetCSVUserReviews("user3", "user1", Page{}); err != nil {
+			t.Error(err)
+		}
+	})
+	if len(lines) != 2 || lines[0] != "user1|4.0/5 (1 review)" ||
+		!hasLine(lines[1:], "|user2|4|", "|Fast and friendly|", "|Thanks!") {
+		t.Errorf("reviews = %q", lines)
+	}
+}
+
+func TestParseRating(t *testing.T) {
+	for _, value := range []string{"1", "'5'"} {
+		if _, err := ParseRating(value); err != nil {
+			t.Errorf("ParseRating(%q): %v", value, err)
+		}
+	}
+	for _, value := range []string{"0", "6", "4.5", ""} {
+		if _, err := ParseRating(value); err != ErrBADG {
+			t.Errorf("ParseRating(%q): %v, want %v", value, err, ErrBADG)
+		}
+	}
+}
+
+func TestSellerScore(t *testing.T) {
+	tests := []struct {
+		score sellerScore
+		want  string
+	}{
+		{sellerScore{}, "no reviews"},
+		{sellerScore{total: 4, count: 1}, "4.0/5 (1 review)"},
+		{sellerScore{total: 9, count: 2}, "4.5/5 (2 reviews)"},
+	}
+	for _, tt := range tests {
+		if got := tt.score.String(); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.score, got, tt.want)
+		}
+	}
+}
+
+func TestCategoryShowsScore(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	sold := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	createListing(t, "user1", "Old phone", "50", "Electronics")
+	sell(t, "user1", "user2", sold)
+	if _, err := ReviewCSVItem("user2", sold, 5, "Great"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := captureOutput(t, func() {
+		if err := GetCSVCategory("user1", "Electronics", Filter{status: statusAll}, Page{}); err != nil {
+			t.Error(err)
+		}
+	})
+	if len(lines) != 2 || !hasLine(lines, "Old phone|", "|5.0/5 (1 review)") {
+		t.Errorf("category = %q", lines)
+	}
+}
+
+// TestDeletedUserReviews - A new user taking the name of a deleted seller
+//                          does not get its score
+func TestDeletedUserReviews(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	sell(t, "user1", "user2", id)
+	if _, err := ReviewCSVItem("user2", id, 5, "Great"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteUser("user1", "user1", ""); err != nil {
+		t.Fatal(err)
+	}
+	register(t, "user1")
+
+	if s := scoreOf(sellerScores(), "user1"); s.count != 0 {
+		t.Errorf("new user1 has the score %s", s)
+	}
+	reviews := loadReviews()
+	if len(reviews) != 1 || reviews[0].seller != deletedUser || reviews[0].buyer != "user2" {
+		t.Errorf("reviews = %v", reviews)
+	}
+	if err := ReplyCSVReview("user1", reviews[0].id, "Thanks"); err != ErrOWN {
+		t.Errorf("reply by the new user1: %v, want %v", err, ErrOWN)
+	}
+}
@@ -0,0 +1,353 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	csvRevisionsPath = "/tmp/revisions.csv"
+
+	ErrRNE = errors.New("Error - revision does not exist")
+
+	// revisionFields - Fields of a product tracked by the revision history
+	revisionFields = []string{"title", "description", "price", "category",
+		"status", "created", "attributes", "tags"}
+)
+
+// revision - A version of a product, who made it, when and what changed
+type revision struct {
+	rev     int
+	author  string
+	at      string
+	changes []string
+	product ProductListing
+}
+
+// fieldValue - Value of a tracked field of a product
+func fieldValue(product ProductListing, field string) string {
+	switch field {
+	case "title":
+		return product.Title
+	case "description":
+		return product.Description
+	case "price":
+		return product.Price.String()
+	case "category":
+		return categoryLabel(product.Category)
+	case "status":
+		return product.Status
+	case "created":
+		return product.CreatedAt
+	case "attributes":
+		return encodeAttributes(product.Attributes)
+	case "tags":
+		return encodeTags(product.Tags)
+	}
+
+	return ""
+}
+
+// changedFields - Tracked fields that differ between two products
+func changedFields(a ProductListing, b ProductListing) []string {
+	var changed []string
+
+	for _, field := range revisionFields {
+		if fieldValue(a, field) != fieldValue(b, field) {
+			changed = append(changed, field)
+		}
+	}
+
+	return changed
+}
+
+// readRevisions - Read the revisions of a product from the csv revision
+//                 file, each row is id|rev|author|at|changes|item row
+func readRevisions(id int) []revision {
+	var revisions []revision
+
+	file, err := os.Open(csvRevisionsPath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	lines, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil
+	}
+
+	for _, line := range lines {
+		splEntry := strings.SplitN(line[0], "|", 6)
+		if len(splEntry) != 6 {
+			continue
+		}
+		if _id, _ := strconv.Atoi(splEntry[0]); _id != id {
+			continue
+		}
+		rev, err := strconv.Atoi(splEntry[1])
+		if err != nil {
+			continue
+		}
+		product, err := parseProduct(splEntry[5])
+		if err != nil {
+			continue
+		}
+		revisions = append(revisions, revision{rev: rev, author: splEntry[2],
+			at: splEntry[3], changes: strings.Split(splEntry[4], ","),
+			product: product})
+	}
+
+	return revisions
+}
+
+// appendRevision - Add a revision to the csv revision file
+func appendRevision(r revision) error {
+	file, err := os.OpenFile(csvRevisionsPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	err = w.Write([]string{fmt.Sprintf("%d|%d|%s|%s|%s|%s",
+		r.product.Id, r.rev, r.author, r.at,
+		strings.Join(r.changes, ","), productRecord(r.product))})
+	if err != nil {
+		return err
+	}
+	w.Flush()
+
+	return w.Error()
+}
+
+// seedRevision - First revision of a product, its state when created
+func seedRevision(product ProductListing) revision {
+	return revision{rev: 1, author: product.Username, at: product.CreatedAt,
+		changes: []string{"created"}, product: product}
+}
+
+// recordRevision - Record a change of a product. Products changed for the
+//                  first time get their state before it as revision 1.
+func recordRevision(before ProductListing, after ProductListing,
+	author string, changed []string) error {
+	next := 1
+	if revisions := readRevisions(after.Id); len(revisions) > 0 {
+		next = revisions[len(revisions)-1].rev + 1
+	} else {
+		err := appendRevision(seedRevision(before))
+		if err != nil {
+			return err
+		}
+		next = 2
+	}
+
+	return appendRevision(revision{rev: next, author: author,
+		at: time.Now().Format(timeFormat), changes: changed, product: after})
+}
+
+// dropRevisions - Remove the revisions of purged products
+func dropRevisions(ids map[int]bool) error {
+	file, err := os.Open(csvRevisionsPath)
+	if err != nil {
+		return nil
+	}
+	lines, err := csv.NewReader(file).ReadAll()
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	var kept [][]string
+	for _, line := range lines {
+		id, _ := strconv.Atoi(strings.SplitN(line[0], "|", 2)[0])
+		if !ids[id] {
+			kept = append(kept, line)
+		}
+	}
+
+	return writeCSVAtomic(csvRevisionsPath, kept)
+}
+
+// renameRevisions - Rewrite an username as author and owner of the revisions
+func renameRevisions(from string, to string) error {
+	file, err := os.Open(csvRevisionsPath)
+	if err != nil {
+		return nil
+	}
+	lines, err := csv.NewReader(file).ReadAll()
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	for i, line := range lines {
+		splEntry := strings.SplitN(line[0], "|", 6)
+		if len(splEntry) != 6 {
+			continue
+		}
+		if sameUser(splEntry[2], from) {
+			splEntry[2] = to
+		}
+		product, err := parseProduct(splEntry[5])
+		if err == nil && sameUser(product.Username, from) {
+			product.Username = to
+			splEntry[5] = productRecord(product)
+		}
+		lines[i][0] = strings.Join(splEntry, "|")
+	}
+
+	return writeCSVAtomic(csvRevisionsPath, lines)
+}
+
+// productRevisions - Revisions of a product, a product that never changed
+//                    has only its current state as revision 1
+func productRevisions(id int) ([]revision, error) {
+	revisions := readRevisions(id)
+	if len(revisions) > 0 {
+		return revisions, nil
+	}
+
+	product, err := findProduct(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return []revision{seedRevision(product)}, nil
+}
+
+// findRevision - Pick a revision by number
+func findRevision(revisions []revision, rev int) (revision, error) {
+	for _, r := range revisions {
+		if r.rev == rev {
+			return r, nil
+		}
+	}
+
+	return revision{}, ErrRNE
+}
+
+// GetCSVItemHistory - Show the revisions of an item, oldest first
+func GetCSVItemHistory(username string, id int, page Page) error {
+	if !IsUsernameExist(username) {
+		return ErrUNKU
+	}
+
+	revisions, err := productRevisions(id)
+	if err != nil {
+		return err
+	}
+
+	start, end, next := page.window(len(revisions))
+	for _, r := range revisions[start:end] {
+		fmt.Println(fmt.Sprintf("%d|%s|%s|%s", r.rev, r.author, r.at,
+			strings.Join(r.changes, ",")))
+	}
+	page.printNext(next)
+
+	return nil
+}
+
+// DiffCSVItem - Show the fields that differ between two revisions of an
+//               item as field|value in from|value in to
+func DiffCSVItem(username string, id int, from int, to int) error {
+	if !IsUsernameExist(username) {
+		return ErrUNKU
+	}
+
+	revisions, err := productRevisions(id)
+	if err != nil {
+		return err
+	}
+	a, err := findRevision(revisions, from)
+	if err != nil {
+		return err
+	}
+	b, err := findRevision(revisions, to)
+	if err != nil {
+		return err
+	}
+
+	changed := changedFields(a.product, b.product)
+	if len(changed) == 0 {
+		fmt.Println("No changes")
+	}
+	for _, field := range changed {
+		fmt.Println(fmt.Sprintf("%s|%s|%s", field,
+			fieldValue(a.product, field), fieldValue(b.product, field)))
+	}
+
+	return nil
+}
+
+// RevertCSVItem - Restore the title, description, price, category,
+//                 attributes and tags of an earlier revision, recorded as
+//                 a new revision. As an update the result must fit the
+//                 current categories and their required attributes.
+func RevertCSVItem(username string, id int, rev int) error {
+	revisions, err := productRevisions(id)
+	if err != nil {
+		return err
+	}
+	r, err := findRevision(revisions, rev)
+	if err != nil {
+		return err
+	}
+
+	return modifyProduct(username, id, func(product *ProductListing) error {
+		product.Title = r.product.Title
+		product.Description = r.product.Description
+		product.Price = r.product.Price
+		product.Attributes = r.product.Attributes
+		product.Tags = r.product.Tags
+		category, err := CheckCategory(r.product.Category)
+		if err != nil {
+			return err
+		}
+		product.Category = category
+		err = checkAttributes(*product)
+		if err != nil {
+			return err
+		}
+		dup, err := duplicateOf(*product)
+		if err == nil && dup != 0 {
+			err = ErrPAE
+		}
+
+		return err
+	})
+}
@@ -0,0 +1,167 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// updateListing - Update an item with UPDATE_LISTING arguments after the ID
+func updateListing(t *testing.T, username string, id int, args ...string) {
+	t.Helper()
+
+	err := UpdateCSVItem(username, id, append([]string{username, "id"}, args...))
+	if err == nil || err.Error() != "Item updated" {
+		t.Fatalf("update %d %q: %v", id, args, err)
+	}
+}
+
+func TestRevisionHistory(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Phone", "100", "Electronics")
+
+	revisions, err := productRevisions(id)
+	if err != nil || len(revisions) != 1 || revisions[0].rev != 1 {
+		t.Fatalf("revisions of a new item = %v, %v", revisions, err)
+	}
+
+	updateListing(t, "user1", id, "Phone", "about Phone", "90", "Electronics")
+	updateListing(t, "user1", id, "Red phone", "about Phone", "90", "Phones")
+
+	revisions, _ = productRevisions(id)
+	if len(revisions) != 3 {
+		t.Fatalf("%d revisions, want 3", len(revisions))
+	}
+	if got := revisions[1].changes; !reflect.DeepEqual(got, []string{"price"}) {
+		t.Errorf("revision 2 changes %q", got)
+	}
+	if got := revisions[2].changes; !reflect.DeepEqual(got, []string{"title", "category"}) {
+		t.Errorf("revision 3 changes %q", got)
+	}
+	if revisions[0].product.Price.String() != "100.00 SGD" || revisions[2].author != "user1" {
+		t.Errorf("revision 1 %v, revision 3 by %s", revisions[0].product, revisions[2].author)
+	}
+
+	lines := captureOutput(t, func() {
+		err = DiffCSVItem("user1", id, 1, 3)
+	})
+	want := []string{"title|Phone|Red phone", "price|100.00 SGD|90.00 SGD",
+		"category|Electronics|Phones"}
+	if err != nil || !reflect.DeepEqual(lines, want) {
+		t.Errorf("diff 1 3 = %q, %v, want %q", lines, err, want)
+	}
+
+	captureOutput(t, func() {
+		err = DiffCSVItem("user1", id, 1, 9)
+	})
+	if err != ErrRNE {
+		t.Errorf("diff with a missing revision: %v, want %v", err, ErrRNE)
+	}
+}
+
+func TestRevertListing(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Phone", "100", "Electronics")
+	updateListing(t, "user1", id, "--price", "90", "--tag", "retro")
+	err := SetCSVItemStatus("user1", id, StatusReserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RevertCSVItem("user2", id, 1); err != ErrOWN {
+		t.Errorf("revert by another user: %v, want %v", err, ErrOWN)
+	}
+	if err := RevertCSVItem("user1", id, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The content comes back, the status stays
+	product := getListing(t, id)
+	if product.Price.String() != "100.00 SGD" || len(product.Tags) != 0 ||
+		product.Status != StatusReserved {
+		t.Errorf("reverted to %v", product)
+	}
+	revisions, _ := productRevisions(id)
+	if len(revisions) != 4 {
+		t.Errorf("%d revisions after revert, want 4", len(revisions))
+	}
+}
+
+// TestRevertCurrentRules - A revert is checked as an update, against the
+//                          categories and required attributes of today
+func TestRevertCurrentRules(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Phone", "100", "Gadgets")
+	updateListing(t, "user1", id, "--category", "electronics", "--attr", "brand=acme")
+	updateListing(t, "user1", id, "--title", "Smart phone", "--attr", "brand=")
+
+	// The category tree came later, without gadgets and requiring a brand
+	manageCategories(t, []string{"add", "Electronics"}, []string{"require", "electronics", "brand"})
+
+	if err := RevertCSVItem("user1", id, 1); err != ErrCATU {
+		t.Errorf("revert to a category not in the tree: %v, want %v", err, ErrCATU)
+	}
+	err := RevertCSVItem("user1", id, 3)
+	if err == nil || !strings.Contains(err.Error(), "requires the attributes brand") {
+		t.Errorf("revert without a required attribute: %v", err)
+	}
+	if product := getListing(t, id); product.Title != "Smart phone" {
+		t.Errorf("failed reverts changed the listing: %v", product)
+	}
+
+	if err := RevertCSVItem("user1", id, 2); err != nil {
+		t.Fatal(err)
+	}
+	product := getListing(t, id)
+	if product.Title != "Phone" || product.Category != strconv.Itoa(categoryId(t, "electronics")) {
+		t.Errorf("reverted to %v", product)
+	}
+}
+
+func TestPurgeDropsRevisions(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Phone", "100", "Electronics")
+	updateListing(t, "user1", id, "Phone", "about Phone", "90", "Electronics")
+	deleteListing(t, "user1", id)
+
+	if _, err := PurgeCSVTrash("admin", id); err != nil {
+		t.Fatal(err)
+	}
+	if revisions := readRevisions(id); len(revisions) != 0 {
+		t.Errorf("revisions left after purge: %v", revisions)
+	}
+}
@@ -0,0 +1,333 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	csvMetaPath = "/tmp/meta.csv"
+
+	ErrSCHM = errors.New("Error - Invalid schema version in " + csvMetaPath)
+
+	// migrations - Ordered changes of the rows of the data files, the
+	//              schema version is the number of migrations applied
+	migrations = []migration{
+		{"items carry a status and a price with a currency", migrateItemRows},
+		{"users carry a profile", migrateUserRows},
+		{"items hold the ID of their category", migrateItemCategories},
+		{"items carry attributes and tags", migrateItemAttributes},
+	}
+
+	// SchemaVersion - Version of the rows of the data files
+	SchemaVersion = len(migrations)
+)
+
+// migration - A change of the data files, apply false only counts the
+//             rows it would change
+type migration struct {
+	description string
+	run         func(apply bool) (changed int, err error)
+}
+
+// readMeta - Read the key|value rows of the metadata file
+func readMeta() map[string]string {
+	meta := make(map[string]string)
+	for _, line := range readCSVRows(csvMetaPath) {
+		splEntry := strings.SplitN(line[0], "|", 2)
+		if len(splEntry) == 2 {
+			meta[splEntry[0]] = splEntry[1]
+		}
+	}
+
+	return meta
+}
+
+// setMeta - Set a key of the metadata file, an empty value removes it
+func setMeta(key string, value string) error {
+	meta := readMeta()
+	meta[key] = value
+	if len(value) == 0 {
+		delete(meta, key)
+	}
+
+	var keys []string
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var lines [][]string
+	for _, k := range keys {
+		lines = append(lines, []string{k + "|" + meta[k]})
+	}
+
+	return writeCSVAtomic(csvMetaPath, lines)
+}
+
+// writeSchemaVersion - Record the schema version of the data files
+func writeSchemaVersion(version int) error {
+	return setMeta("schema", strconv.Itoa(version))
+}
+
+// schemaVersion - Schema version of the data files. Data written before
+//                 the metadata file existed is version 0, no data at all
+//                 is the current version.
+func schemaVersion() (int, error) {
+	value, ok := readMeta()["schema"]
+	if !ok {
+		if hasData() {
+			return 0, nil
+		}
+		return SchemaVersion, nil
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 0 {
+		return 0, ErrSCHM
+	}
+
+	return version, nil
+}
+
+// CheckSchema - Refuse to run against data files of another schema, every
+//               command but MIGRATE checks it on startup
+func CheckSchema() error {
+	version, err := schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("Error - The data has schema %d, newer than %d of these commands, "+
+			"upgrade the marketplace", version, SchemaVersion)
+	}
+	if version < SchemaVersion {
+		return fmt.Errorf("Error - The data has schema %d, older than %d, run MIGRATE admin up",
+			version, SchemaVersion)
+	}
+
+	if _, ok := readMeta()["schema"]; !ok {
+		return writeSchemaVersion(version)
+	}
+
+	return nil
+}
+
+// The rows each migration writes are the rows of its own version, not
+// the current ones, so the migrations after it find the rows they expect
+
+// itemRowV1 - Item row of schema 1, the price carries its currency and
+//             the status follows the creation time
+func itemRowV1(product ProductListing) string {
+	return fmt.Sprintf("%d|%s|%s|%s|%s|%s|%s|%s",
+		product.Id,
+		trimQuotes(product.Username),
+		trimQuotes(product.Title),
+		trimQuotes(product.Description),
+		product.Price,
+		trimQuotes(product.Category),
+		trimQuotes(product.CreatedAt),
+		product.Status)
+}
+
+// itemRowV4 - Item row of schema 4, the attributes and tags follow
+func itemRowV4(product ProductListing) string {
+	return itemRowV1(product) + "|" + encodeAttributes(product.Attributes) +
+		"|" + encodeTags(product.Tags)
+}
+
+// userRowV2 - User row of schema 2, the profile follows the username
+func userRowV2(user User) string {
+	state := "active"
+	if !user.Active {
+		state = "inactive"
+	}
+
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s", user.Username, user.DisplayName,
+		user.Email, user.JoinedAt, user.Location, user.Bio, state)
+}
+
+// rewriteItemRows - Parse the rows of the csv item and trash files and
+//                   format them again with record, counting the rows
+//                   that change
+func rewriteItemRows(apply bool, record func(ProductListing) string) (changed int, err error) {
+	items, err := ReadCSVProduct()
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range items {
+		product, err := parseProduct(entry[0])
+		if err != nil {
+			return changed, fmt.Errorf("%s, item row %d", ErrMALF, i+1)
+		}
+		if row := record(product); row != entry[0] {
+			items[i][0] = row
+			changed++
+		}
+	}
+
+	var trash [][]string
+	lines := readCSVRows(csvTrashPath)
+	for i, t := range readTrash() {
+		row := t.deletedAt + "|" + record(t.product)
+		if i < len(lines) && lines[i][0] != row {
+			changed++
+		}
+		trash = append(trash, []string{row})
+	}
+
+	if !apply || changed == 0 {
+		return changed, nil
+	}
+	if len(items) > 0 {
+		err = ReGenerateCSVProduct(items)
+	}
+	if err == nil && len(trash) > 0 {
+		err = writeCSVAtomic(csvTrashPath, trash)
+	}
+
+	return changed, err
+}
+
+// migrateItemRows - Items written before the status and Money had a bare
+//                   integer price and no status, they become active items
+//                   priced in DefaultCurrency
+func migrateItemRows(apply bool) (int, error) {
+	return rewriteItemRows(apply, itemRowV1)
+}
+
+// migrateItemCategories - Items written before the category IDs hold the
+//                         name of their category, those whose name is in
+//                         the category tree get its ID. The item rows of
+//                         schema 3 are the rows of schema 1.
+func migrateItemCategories(apply bool) (int, error) {
+	tax := loadTaxonomy()
+
+	return rewriteItemRows(apply, func(product ProductListing) string {
+		if c, ok := tax.listingCategory(product.Category); ok {
+			product.Category = strconv.Itoa(c.id)
+		}
+		return itemRowV1(product)
+	})
+}
+
+// migrateItemAttributes - Items written before the attributes and tags
+//                         get neither
+func migrateItemAttributes(apply bool) (int, error) {
+	return rewriteItemRows(apply, itemRowV4)
+}
+
+// migrateUserRows - Users written before the profiles are bare usernames,
+//                   possibly split in one column per word
+func migrateUserRows(apply bool) (changed int, err error) {
+	users, _ := loadUsers()
+	lines := readCSVRows(csvUserPath)
+
+	var rows [][]string
+	for i, user := range users {
+		row := userRowV2(user)
+		if i >= len(lines) || len(lines[i]) != 1 || lines[i][0] != row {
+			changed++
+		}
+		rows = append(rows, []string{row})
+	}
+
+	if !apply || changed == 0 {
+		return changed, nil
+	}
+
+	return changed, writeCSVAtomic(csvUserPath, rows)
+}
+
+// Migrate - Show the migrations and whether they are applied, or with
+//           up apply the pending ones in order. A dry run shows how many
+//           rows each pending migration would change.
+func Migrate(username string, action string) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	version, err := schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "status":
+		fmt.Println(fmt.Sprintf("schema|%d|%d", version, SchemaVersion))
+		for i, m := range migrations {
+			state := "pending"
+			if i < version {
+				state = "applied"
+			}
+			fmt.Println(fmt.Sprintf("%d|%s|%s", i+1, state, m.description))
+		}
+		return nil
+	case "up", "dry-run":
+	default:
+		return errors.New("Error - Use status, up or dry-run")
+	}
+
+	if version > SchemaVersion {
+		return CheckSchema()
+	}
+	if action == "up" && !IsAdmin(username) {
+		return ErrPERM
+	}
+
+	apply := action == "up"
+	for i := version; i < SchemaVersion; i++ {
+		changed, err := migrations[i].run(apply)
+		if err != nil {
+			return fmt.Errorf("Error - Migration %d failed, %s", i+1, err)
+		}
+		if apply {
+			err = writeSchemaVersion(i + 1)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Println(fmt.Sprintf("%d|%d rows|%s", i+1, changed, migrations[i].description))
+	}
+
+	if version == SchemaVersion {
+		fmt.Println("Schema is up to date")
+	}
+
+	return nil
+}
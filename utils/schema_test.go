@@ -0,0 +1,159 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+// writeSchemaZero - Data files as written before the metadata file
+func writeSchemaZero(t *testing.T) {
+	t.Helper()
+
+	err := writeCSVAtomic(csvUserPath, [][]string{{"john", "doe"}, {"user1"}})
+	if err == nil {
+		err = writeCSVAtomic(csvItemsPath, [][]string{
+			{"1|user1|Phone|Brand new|100|Electronics|2019-06-01 10:00:00"}})
+	}
+	if err == nil {
+		err = writeCSVAtomic(csvTrashPath, [][]string{
+			{"2019-06-02 10:00:00|2|user1|Shoes|Red shoes|50|Sports|2019-06-01 10:00:00"}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationsWriteTheirVersion(t *testing.T) {
+	resetData(t)
+	writeSchemaZero(t)
+
+	if version, err := schemaVersion(); err != nil || version != 0 {
+		t.Fatalf("schema %d: %v, want 0", version, err)
+	}
+
+	// Migration 1 writes the rows of schema 1, the later ones change them
+	if _, err := migrations[0].run(true); err != nil {
+		t.Fatal(err)
+	}
+	want := "1|user1|Phone|Brand new|100.00 SGD|Electronics|2019-06-01 10:00:00|active"
+	if rows := itemRows(t); len(rows) != 1 || rows[0][0] != want {
+		t.Errorf("schema 1 item row = %v, want %s", rows, want)
+	}
+	trash := readCSVRows(csvTrashPath)
+	if len(trash) != 1 || strings.Count(trash[0][0], "|") != 8 {
+		t.Errorf("schema 1 trash row = %v", trash)
+	}
+
+	if _, err := migrations[1].run(true); err != nil {
+		t.Fatal(err)
+	}
+	users := readCSVRows(csvUserPath)
+	if len(users) != 2 || users[0][0] != "john_doe|john_doe|||||active" {
+		t.Errorf("schema 2 user rows = %v", users)
+	}
+
+	// Migration 3 gives the items in the category tree its ID
+	if err := writeCSVAtomic(csvCategoriesPath, [][]string{{"7|0|Electronics||0|"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrations[2].run(true); err != nil {
+		t.Fatal(err)
+	}
+	want = strings.Replace(want, "|Electronics|", "|7|", 1)
+	if rows := itemRows(t); len(rows) != 1 || rows[0][0] != want {
+		t.Errorf("schema 3 item row = %v, want %s", rows, want)
+	}
+	if trash := readTrash(); len(trash) != 1 || trash[0].product.Category != "Sports" {
+		t.Errorf("schema 3 trash = %v", trash)
+	}
+
+	if _, err := migrations[3].run(true); err != nil {
+		t.Fatal(err)
+	}
+	if rows := itemRows(t); len(rows) != 1 || rows[0][0] != want+"||" {
+		t.Errorf("schema 4 item row = %v, want %s||", rows, want)
+	}
+}
+
+func TestMigrateUp(t *testing.T) {
+	resetData(t)
+	writeSchemaZero(t)
+
+	if err := CheckSchema(); err == nil {
+		t.Errorf("commands run against schema 0")
+	}
+	if err := Migrate("user1", "up"); err != ErrPERM {
+		t.Errorf("migrate by an user: %v, want %v", err, ErrPERM)
+	}
+
+	var err error
+	out := captureOutput(t, func() {
+		err = Migrate(adminUser, "dry-run")
+	})
+	if err != nil || !hasLine(out, "1|2 rows") {
+		t.Errorf("dry run: %v, %q", err, out)
+	}
+	if version, _ := schemaVersion(); version != 0 {
+		t.Errorf("dry run changed the schema to %d", version)
+	}
+
+	captureOutput(t, func() {
+		err = Migrate(adminUser, "up")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchema(); err != nil {
+		t.Errorf("schema after migrate: %v", err)
+	}
+	if p := getListing(t, 1); p.Price.String() != "100.00 SGD" || p.Status != StatusActive {
+		t.Errorf("migrated listing = %v", p)
+	}
+
+	out = captureOutput(t, func() {
+		err = Migrate(adminUser, "up")
+	})
+	if err != nil || !hasLine(out, "up to date") {
+		t.Errorf("second migrate: %v, %q", err, out)
+	}
+}
+
+func TestCheckSchemaNewer(t *testing.T) {
+	resetData(t)
+
+	if err := writeSchemaVersion(SchemaVersion + 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchema(); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("newer schema: %v", err)
+	}
+}
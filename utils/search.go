@@ -0,0 +1,728 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+
+	// indexCompactAt - Changes appended to the index that trigger a rewrite
+	indexCompactAt = 1000
+)
+
+var (
+	csvIndexPath = "/tmp/items.idx"
+
+	ErrNOQ  = errors.New("Error - Empty search query")
+	ErrBADF = errors.New("Error - Invalid search filter")
+	ErrNOTF = errors.New("Error - not found")
+)
+
+// searchIndex - Inverted index over the title and description of the items,
+//               changes counts the changes appended since the last rewrite
+type searchIndex struct {
+	docs     map[int]int
+	postings map[string]map[int][]int
+	changes  int
+}
+
+// priceFilter - A single price:<op><value> condition
+type priceFilter struct {
+	op    string
+	value Money
+}
+
+// searchQuery - Terms, phrases and field filters of a SEARCH command
+type searchQuery struct {
+	terms    []string
+	phrases  [][]string
+	category string
+	seller   string
+	status   string
+	prices   []priceFilter
+	attrs    attrFilter
+}
+
+// searchHit - A product matching a query and its score
+type searchHit struct {
+	product ProductListing
+	score   float64
+}
+
+// foldText - Lower case a text and strip its diacritics
+func foldText(text string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, text)
+	if err != nil {
+		folded = text
+	}
+
+	return strings.ToLower(folded)
+}
+
+// tokenize - Split a text into folded search terms
+func tokenize(text string) []string {
+	return strings.FieldsFunc(foldText(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{docs: make(map[int]int),
+		postings: make(map[string]map[int][]int)}
+}
+
+// productTerms - Positions of the terms in the title and description of a
+//                product. The description positions start one after the
+//                title so phrases never span both.
+func productTerms(product ProductListing) map[string][]int {
+	terms := make(map[string][]int)
+
+	pos := 0
+	for _, field := range []string{product.Title, product.Description} {
+		for _, term := range tokenize(trimQuotes(field)) {
+			terms[term] = append(terms[term], pos)
+			pos++
+		}
+		pos++
+	}
+
+	return terms
+}
+
+// add - Index the title and description of a product
+func (idx *searchIndex) add(product ProductListing) {
+	idx.put(product.Id, productTerms(product))
+}
+
+// put - Index the terms of a doc, its length is the number of positions
+func (idx *searchIndex) put(id int, terms map[string][]int) {
+	length := 0
+	for term, positions := range terms {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[int][]int)
+		}
+		idx.postings[term][id] = positions
+		length += len(positions)
+	}
+	idx.docs[id] = length
+}
+
+// remove - Drop a product from the index
+func (idx *searchIndex) remove(id int) {
+	if _, ok := idx.docs[id]; !ok {
+		return
+	}
+	delete(idx.docs, id)
+
+	for term, docs := range idx.postings {
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+}
+
+// restrict - Drop the docs with an ID above the snapshot from the index
+func (idx *searchIndex) restrict(snapshot int) {
+	for id := range idx.docs {
+		if id > snapshot {
+			idx.remove(id)
+		}
+	}
+}
+
+// save - Persist the index next to the csv item file
+func (idx *searchIndex) save() error {
+	tmp := csvIndexPath + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	for id, length := range idx.docs {
+		err = w.Write([]string{fmt.Sprintf("D|%d|%d", id, length)})
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	for term, docs := range idx.postings {
+		var list []string
+		for id, positions := range docs {
+			list = append(list, fmt.Sprintf("%d:%s", id, joinPositions(positions)))
+		}
+		err = w.Write([]string{fmt.Sprintf("T|%s|%s", term, strings.Join(list, ";"))})
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	w.Flush()
+	if err = w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, csvIndexPath)
+}
+
+// joinPositions - Encode the positions of a term as 1,5,9
+func joinPositions(positions []int) string {
+	list := make([]string, len(positions))
+	for i, p := range positions {
+		list[i] = strconv.Itoa(p)
+	}
+
+	return strings.Join(list, ",")
+}
+
+// splitPositions - Decode the positions written by joinPositions
+func splitPositions(list string) ([]int, error) {
+	var positions []int
+	for _, v := range strings.Split(list, ",") {
+		pos, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, ErrMALF
+		}
+		positions = append(positions, pos)
+	}
+
+	return positions, nil
+}
+
+// readSearchIndex - Parse the persisted index: D and T records for the
+//                   docs and the terms, then an A record for each product
+//                   indexed and an X record for each product removed since
+func readSearchIndex() (*searchIndex, error) {
+	file, err := os.Open(csvIndexPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	idx := newSearchIndex()
+	r := csv.NewReader(file)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		splEntry := strings.Split(record[0], "|")
+		if len(splEntry) != 3 {
+			return nil, ErrMALF
+		}
+
+		switch splEntry[0] {
+		case "D":
+			id, err := strconv.Atoi(splEntry[1])
+			if err != nil {
+				return nil, ErrMALF
+			}
+			idx.docs[id], _ = strconv.Atoi(splEntry[2])
+		case "T":
+			docs := make(map[int][]int)
+			for _, posting := range strings.Split(splEntry[2], ";") {
+				p := strings.SplitN(posting, ":", 2)
+				if len(p) != 2 {
+					return nil, ErrMALF
+				}
+				id, err := strconv.Atoi(p[0])
+				if err != nil {
+					return nil, ErrMALF
+				}
+				docs[id], err = splitPositions(p[1])
+				if err != nil {
+					return nil, err
+				}
+			}
+			idx.postings[splEntry[1]] = docs
+		case "A":
+			id, err := strconv.Atoi(splEntry[1])
+			if err != nil {
+				return nil, ErrMALF
+			}
+			terms := make(map[string][]int)
+			if len(splEntry[2]) > 0 {
+				for _, entry := range strings.Split(splEntry[2], ";") {
+					p := strings.SplitN(entry, ":", 2)
+					if len(p) != 2 {
+						return nil, ErrMALF
+					}
+					terms[p[0]], err = splitPositions(p[1])
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+			idx.remove(id)
+			idx.put(id, terms)
+			idx.changes++
+		case "X":
+			id, err := strconv.Atoi(splEntry[1])
+			if err != nil {
+				return nil, ErrMALF
+			}
+			idx.remove(id)
+			idx.changes++
+		default:
+			return nil, ErrMALF
+		}
+	}
+
+	return idx, nil
+}
+
+// RebuildSearchIndex - Index every item of the csv item file from scratch
+func RebuildSearchIndex() error {
+	products, err := loadProducts()
+	if err != nil {
+		return err
+	}
+	idx := newSearchIndex()
+	for _, product := range products {
+		idx.add(product)
+	}
+
+	return idx.save()
+}
+
+// loadSearchIndex - Read the index, rebuilding it when missing or damaged
+//                   and rewriting it past indexCompactAt appended changes.
+//                   Both take the lock so no change is appended meanwhile.
+func loadSearchIndex() (*searchIndex, error) {
+	idx, err := readSearchIndex()
+	if err == nil && idx.changes < indexCompactAt {
+		return idx, nil
+	}
+
+	unlock, err := lockData()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	idx, err = readSearchIndex()
+	if err != nil {
+		err = RebuildSearchIndex()
+		if err != nil {
+			return nil, err
+		}
+		return readSearchIndex()
+	}
+
+	// The index with its changes is still good if the rewrite fails
+	if idx.changes >= indexCompactAt && idx.save() == nil {
+		idx.changes = 0
+	}
+
+	return idx, nil
+}
+
+// dropSearchIndex - Remove a stale index, the next search rebuilds it
+func dropSearchIndex() error {
+	err := os.Remove(csvIndexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// appendSearchIndex - Append a change to the index, a missing index is
+//                     built from the csv item file instead
+func appendSearchIndex(record string) error {
+	file, err := os.OpenFile(csvIndexPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if os.IsNotExist(err) {
+		return RebuildSearchIndex()
+	}
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	err = w.Write([]string{record})
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// indexProduct - Add or refresh a product in the index. The csv item file
+//                is already updated at this point, so a failure drops the
+//                index instead of failing a change that was applied.
+func indexProduct(product ProductListing) error {
+	var list []string
+	for term, positions := range productTerms(product) {
+		list = append(list, term+":"+joinPositions(positions))
+	}
+
+	err := appendSearchIndex(fmt.Sprintf("A|%d|%s", product.Id, strings.Join(list, ";")))
+	if err != nil {
+		return dropSearchIndex()
+	}
+
+	return nil
+}
+
+// unindexProduct - Remove a product from the index, same as indexProduct
+//                  a failure drops the index
+func unindexProduct(id int) error {
+	err := appendSearchIndex(fmt.Sprintf("X|%d|", id))
+	if err != nil {
+		return dropSearchIndex()
+	}
+
+	return nil
+}
+
+// parsePriceFilter - Parse <100, <=100, >100, >=100, 100 or 10..100
+func parsePriceFilter(value string) ([]priceFilter, error) {
+	if bounds := strings.SplitN(value, "..", 2); len(bounds) == 2 {
+		min, err := ParseMoney(bounds[0])
+		if err != nil {
+			return nil, ErrBADF
+		}
+		max, err := ParseMoney(bounds[1])
+		if err != nil {
+			return nil, ErrBADF
+		}
+		return []priceFilter{{">=", min}, {"<=", max}}, nil
+	}
+
+	for _, op := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(value, op) {
+			v, err := ParseMoney(value[len(op):])
+			if err != nil {
+				return nil, ErrBADF
+			}
+			return []priceFilter{{op, v}}, nil
+		}
+	}
+
+	v, err := ParseMoney(value)
+	if err != nil {
+		return nil, ErrBADF
+	}
+
+	return []priceFilter{{"=", v}}, nil
+}
+
+// match - Check a price against the filter, a price that cannot be
+//         converted to the currency of the filter never matches
+func (f priceFilter) match(price Money) bool {
+	c, ok := price.Compare(f.value)
+	if !ok {
+		return false
+	}
+
+	switch f.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+
+	return c == 0
+}
+
+// parseSearchQuery - Split SEARCH arguments into terms, phrases and
+//                    category:, seller:, price:, attr: and tag: filters,
+//                    the last two also given as --attr and --tag
+func parseSearchQuery(args []string) (q searchQuery, err error) {
+	for n := 0; n < len(args); n++ {
+		arg := args[n]
+		if (arg == "--attr" || arg == "--tag") && n+1 < len(args) {
+			err = q.attrs.add(arg, args[n+1])
+			if err != nil {
+				return q, err
+			}
+			n++
+			continue
+		}
+
+		word := trimQuotes(arg)
+		if i := strings.Index(word, ":"); i > 0 {
+			value := word[i+1:]
+			switch strings.ToLower(word[:i]) {
+			case "attr", "tag":
+				err = q.attrs.add("--"+strings.ToLower(word[:i]), value)
+				if err != nil {
+					return q, err
+				}
+				continue
+			case "category":
+				q.category = value
+				continue
+			case "seller":
+				q.seller = value
+				continue
+			case "status":
+				q.status, err = parseStatus(value)
+				if err != nil {
+					return q, err
+				}
+				continue
+			case "price":
+				filters, err := parsePriceFilter(value)
+				if err != nil {
+					return q, err
+				}
+				q.prices = append(q.prices, filters...)
+				continue
+			}
+		}
+
+		tokens := tokenize(word)
+		if len(tokens) > 1 && (word != arg || strings.ContainsAny(word, " \t")) {
+			q.phrases = append(q.phrases, tokens)
+		} else {
+			q.terms = append(q.terms, tokens...)
+		}
+	}
+
+	if len(q.terms) == 0 && len(q.phrases) == 0 && len(q.category) == 0 &&
+		len(q.seller) == 0 && len(q.status) == 0 && len(q.prices) == 0 &&
+		q.attrs.empty() {
+		return q, ErrNOQ
+	}
+
+	return q, nil
+}
+
+// hasPhrase - Check if the words of a phrase appear in sequence in a doc
+func (idx *searchIndex) hasPhrase(id int, phrase []string) bool {
+	for _, start := range idx.postings[phrase[0]][id] {
+		found := true
+		for i, term := range phrase[1:] {
+			if !containsInt(idx.postings[term][id], start+i+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsInt(list []int, v int) bool {
+	for _, n := range list {
+		if n == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// score - BM25 score of a doc for a set of terms
+func (idx *searchIndex) score(id int, terms []string) float64 {
+	var total, score float64
+
+	n := float64(len(idx.docs))
+	for _, length := range idx.docs {
+		total += float64(length)
+	}
+	avgdl := total / n
+	dl := float64(idx.docs[id])
+
+	for _, term := range terms {
+		df := float64(len(idx.postings[term]))
+		tf := float64(len(idx.postings[term][id]))
+		if tf == 0 {
+			continue
+		}
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		score += idf * tf * (bm25K1 + 1) /
+			(tf + bm25K1*(1-bm25B+bm25B*dl/avgdl))
+	}
+
+	return score
+}
+
+// search - Find and rank the products matching a query
+func (idx *searchIndex) search(q searchQuery, products []ProductListing) []searchHit {
+	var hits []searchHit
+
+	terms := append([]string{}, q.terms...)
+	for _, phrase := range q.phrases {
+		terms = append(terms, phrase...)
+	}
+	unique := make(map[string]bool)
+	var scoreTerms []string
+	for _, term := range terms {
+		if !unique[term] {
+			unique[term] = true
+			scoreTerms = append(scoreTerms, term)
+		}
+	}
+
+	// A category of the tree takes in the categories below it
+	inCategory, ok := categoryMatcher(q.category, true)
+	if !ok {
+		inCategory = func(product ProductListing) bool {
+			return foldText(strings.TrimSpace(trimQuotes(product.Category))) ==
+				foldText(strings.TrimSpace(q.category))
+		}
+	}
+
+	for _, product := range products {
+		if _, ok := idx.docs[product.Id]; !ok {
+			continue
+		}
+		if !matchStatus(product, q.status) {
+			continue
+		}
+		if len(q.category) > 0 && !inCategory(product) {
+			continue
+		}
+		if len(q.seller) > 0 &&
+			!sameUser(product.Username, q.seller) {
+			continue
+		}
+		if !q.attrs.match(product) {
+			continue
+		}
+
+		matched := true
+		for _, f := range q.prices {
+			if !f.match(product.Price) {
+				matched = false
+				break
+			}
+		}
+		for _, term := range scoreTerms {
+			if _, ok := idx.postings[term][product.Id]; !ok {
+				matched = false
+				break
+			}
+		}
+		for _, phrase := range q.phrases {
+			if !matched || !idx.hasPhrase(product.Id, phrase) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		hits = append(hits, searchHit{product, idx.score(product.Id, scoreTerms)})
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].product.Id < hits[j].product.Id
+	})
+
+	return hits
+}
+
+// SearchCSVItems - Full text search over the title and description of
+//                  every item, ranked with BM25. Items created after the
+//                  cursor snapshot are left out of the ranking as well, so
+//                  the scores stay the same from one page to the next.
+func SearchCSVItems(args []string, page Page) error {
+	q, err := parseSearchQuery(args)
+	if err != nil {
+		return err
+	}
+
+	products, err := visibleProducts()
+	if err != nil {
+		return err
+	}
+	products = page.restrict(products)
+	if len(products) == 0 {
+		return ErrPLE
+	}
+
+	idx, err := loadSearchIndex()
+	if err != nil {
+		return err
+	}
+	idx.restrict(page.snapshot)
+
+	hits := idx.search(q, products)
+	if len(hits) == 0 {
+		return ErrNOTF
+	}
+
+	scores := sellerScores()
+	start, end, next := page.window(len(hits))
+	for _, hit := range hits[start:end] {
+		fmt.Println(listingLine(hit.product) + "|" + scoreOf(scores, hit.product.Username).String())
+	}
+	page.printNext(next)
+
+	return nil
+}
@@ -0,0 +1,224 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Phone model 8", []string{"phone", "model", "8"}},
+		{"Café, CRÈME-brûlée!", []string{"cafe", "creme", "brulee"}},
+		{"  ", []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := tokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	q, err := parseSearchQuery([]string{"phone", "'brand new'", "category:Electronics",
+		"seller:user1", "price:10..100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(q.terms, []string{"phone"}) {
+		t.Errorf("terms = %q", q.terms)
+	}
+	if !reflect.DeepEqual(q.phrases, [][]string{{"brand", "new"}}) {
+		t.Errorf("phrases = %q", q.phrases)
+	}
+	if q.category != "Electronics" || q.seller != "user1" {
+		t.Errorf("category %q seller %q", q.category, q.seller)
+	}
+	if len(q.prices) != 2 || q.prices[0].op != ">=" || q.prices[1].op != "<=" {
+		t.Errorf("prices = %v", q.prices)
+	}
+
+	if _, err := parseSearchQuery(nil); err != ErrNOQ {
+		t.Errorf("empty query: %v, want %v", err, ErrNOQ)
+	}
+	if _, err := parseSearchQuery([]string{"price:cheap"}); err != ErrBADF {
+		t.Errorf("bad price: %v, want %v", err, ErrBADF)
+	}
+}
+
+func TestSearchIndexRanking(t *testing.T) {
+	products := []ProductListing{
+		{Id: 1, Title: "Red phone", Description: "A phone, a great phone", Status: StatusActive},
+		{Id: 2, Title: "Blue phone", Description: "Brand new in its box", Status: StatusActive},
+		{Id: 3, Title: "Black shoes", Description: "Training shoes", Status: StatusActive},
+	}
+	idx := newSearchIndex()
+	for _, p := range products {
+		idx.add(p)
+	}
+
+	hits := idx.search(searchQuery{terms: []string{"phone"}}, products)
+	if len(hits) != 2 || hits[0].product.Id != 1 || hits[1].product.Id != 2 {
+		t.Fatalf("phone hits = %v", hits)
+	}
+
+	hits = idx.search(searchQuery{phrases: [][]string{{"brand", "new"}}}, products)
+	if len(hits) != 1 || hits[0].product.Id != 2 {
+		t.Errorf("phrase hits = %v", hits)
+	}
+
+	// A phrase never spans the title and the description
+	hits = idx.search(searchQuery{phrases: [][]string{{"phone", "a"}}}, products)
+	if len(hits) != 1 || hits[0].product.Id != 1 {
+		t.Errorf("phrase across fields hits = %v", hits)
+	}
+
+	idx.remove(1)
+	hits = idx.search(searchQuery{terms: []string{"phone"}}, products)
+	if len(hits) != 1 || hits[0].product.Id != 2 {
+		t.Errorf("hits after remove = %v", hits)
+	}
+}
+
+func TestSearchIndexPersisted(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	idx, err := readSearchIndex()
+	if err != nil {
+		t.Fatalf("index not written on create: %s", err)
+	}
+	if _, ok := idx.postings["camera"][id]; !ok {
+		t.Errorf("camera not indexed for %d", id)
+	}
+
+	err = UpdateCSVItem("user1", id, []string{"user1", "1", "Vintage camera", "Old lens",
+		"100", "Electronics"})
+	if err.Error() != "Item updated" {
+		t.Fatal(err)
+	}
+	idx, _ = readSearchIndex()
+	if _, ok := idx.postings["about"][id]; ok {
+		t.Errorf("stale term kept after update")
+	}
+	if _, ok := idx.postings["lens"][id]; !ok {
+		t.Errorf("new term not indexed after update")
+	}
+
+	// A damaged index is rebuilt from the items
+	createListing(t, "user1", "Running shoes", "50", "Sports")
+	err = ioutil.WriteFile(csvIndexPath, []byte("garbage\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err = loadSearchIndex()
+	if err != nil || len(idx.docs) != 2 {
+		t.Errorf("rebuilt index: %v, %d docs", err, len(idx.docs))
+	}
+}
+
+// indexRows - Raw records of the search index file
+func indexRows(t *testing.T) [][]string {
+	t.Helper()
+
+	file, err := os.Open(csvIndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rows
+}
+
+func TestSearchIndexIncremental(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	first := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	second := createListing(t, "user1", "Running shoes", "50", "Sports")
+
+	// A change is appended to the index instead of rewriting it
+	rows := indexRows(t)
+	if last := rows[len(rows)-1][0]; !strings.HasPrefix(last, fmt.Sprintf("A|%d|", second)) {
+		t.Errorf("last index record after create %q", last)
+	}
+	deleteListing(t, "user1", first)
+	rows = indexRows(t)
+	if last := rows[len(rows)-1][0]; last != fmt.Sprintf("X|%d|", first) {
+		t.Errorf("last index record after delete %q", last)
+	}
+
+	idx, err := readSearchIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.changes != 2 {
+		t.Errorf("%d changes, want 2", idx.changes)
+	}
+	if _, ok := idx.docs[first]; ok {
+		t.Errorf("deleted %d still indexed", first)
+	}
+	built := newSearchIndex()
+	built.add(getListing(t, second))
+	if !reflect.DeepEqual(idx.docs, built.docs) || !reflect.DeepEqual(idx.postings, built.postings) {
+		t.Errorf("index with changes %v %v, rebuilt %v %v", idx.docs, idx.postings,
+			built.docs, built.postings)
+	}
+
+	// Past indexCompactAt changes the next load rewrites the index
+	for i := idx.changes; i < indexCompactAt; i++ {
+		if err := appendSearchIndex(fmt.Sprintf("X|%d|", first)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := loadSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	idx, err = readSearchIndex()
+	if err != nil || idx.changes != 0 || len(idx.docs) != 1 {
+		t.Errorf("compacted index: %v, %d changes, %d docs", err, idx.changes, len(idx.docs))
+	}
+}
@@ -0,0 +1,118 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	StatusActive   = "active"
+	StatusReserved = "reserved"
+	StatusSold     = "sold"
+	StatusExpired  = "expired"
+	StatusArchived = "archived"
+	statusAll      = "all"
+
+	// listingTTL - Active listings older than this are shown as expired
+	listingTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrOWN  = errors.New("Error - listing owner mismatch")
+	ErrLNE  = errors.New("Error - listing does not exist")
+	ErrBADT = errors.New("Error - invalid status transition")
+	ErrBADU = errors.New("Error - unknown status")
+
+	// transitions - Statuses a listing can move to from each status
+	transitions = map[string][]string{
+		StatusActive:   {StatusReserved, StatusSold, StatusArchived},
+		StatusReserved: {StatusActive, StatusSold, StatusArchived},
+		StatusSold:     {StatusArchived},
+		StatusExpired:  {StatusActive, StatusArchived},
+		StatusArchived: {},
+	}
+)
+
+// state - Status of a product, an active product past its time to live
+//         is expired until it gets relisted
+func (product ProductListing) state() string {
+	if product.Status != StatusActive {
+		return product.Status
+	}
+
+	created := createdTime(product)
+	if !created.IsZero() && time.Since(created) > listingTTL {
+		return StatusExpired
+	}
+
+	return StatusActive
+}
+
+// parseStatus - Validate the value of --status or status:
+func parseStatus(status string) (string, error) {
+	status = strings.ToLower(trimQuotes(status))
+	if _, ok := transitions[status]; ok || status == statusAll {
+		return status, nil
+	}
+
+	return "", ErrBADU
+}
+
+// matchStatus - Check a product against a status filter, active if unset
+func matchStatus(product ProductListing, status string) bool {
+	if len(status) == 0 {
+		status = StatusActive
+	}
+
+	return status == statusAll || status == product.state()
+}
+
+// SetCSVItemStatus - Move an item to a new status if the lifecycle allows
+//                    it, relisting also renews the creation time
+func SetCSVItemStatus(username string, id int, status string) error {
+	return modifyProduct(username, id, func(product *ProductListing) error {
+		from := product.state()
+		for _, to := range transitions[from] {
+			if to == status {
+				product.Status = status
+				if status == StatusActive {
+					product.CreatedAt = time.Now().Format(timeFormat)
+				}
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%s from %s to %s", ErrBADT, from, status)
+	})
+}
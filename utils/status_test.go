@@ -0,0 +1,156 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) {
+	old := time.Now().Add(-listingTTL - time.Hour).Format(timeFormat)
+	now := time.Now().Format(timeFormat)
+
+	tests := []struct {
+		product ProductListing
+		want    string
+	}{
+		{ProductListing{Status: StatusActive, CreatedAt: now}, StatusActive},
+		{ProductListing{Status: StatusActive, CreatedAt: old}, StatusExpired},
+		{ProductListing{Status: StatusActive, CreatedAt: "not a time"}, StatusActive},
+		{ProductListing{Status: StatusSold, CreatedAt: old}, StatusSold},
+		{ProductListing{Status: StatusReserved, CreatedAt: now}, StatusReserved},
+	}
+
+	for _, tt := range tests {
+		if got := tt.product.state(); got != tt.want {
+			t.Errorf("state of %s created %s = %s, want %s", tt.product.Status,
+				tt.product.CreatedAt, got, tt.want)
+		}
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	for _, status := range []string{"active", "'SOLD'", "all"} {
+		if _, err := parseStatus(status); err != nil {
+			t.Errorf("parseStatus(%s): %s", status, err)
+		}
+	}
+	if _, err := parseStatus("gone"); err != ErrBADU {
+		t.Errorf("parseStatus(gone): %v, want %v", err, ErrBADU)
+	}
+}
+
+func TestStatusTransitions(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Phone", "100", "Electronics")
+
+	steps := []struct {
+		status string
+		ok     bool
+	}{
+		{StatusReserved, true},
+		{StatusActive, true},
+		{StatusSold, true},
+		{StatusActive, false},
+		{StatusReserved, false},
+		{StatusArchived, true},
+		{StatusActive, false},
+	}
+	for _, step := range steps {
+		err := SetCSVItemStatus("user1", id, step.status)
+		if step.ok && err != nil {
+			t.Fatalf("move to %s: %s", step.status, err)
+		}
+		if !step.ok && (err == nil || !strings.HasPrefix(err.Error(), ErrBADT.Error())) {
+			t.Fatalf("move to %s: %v, want %v", step.status, err, ErrBADT)
+		}
+	}
+	if got := getListing(t, id).Status; got != StatusArchived {
+		t.Errorf("status = %s, want %s", got, StatusArchived)
+	}
+
+	other := createListing(t, "user1", "Laptop", "900", "Electronics")
+	if err := SetCSVItemStatus("user2", other, StatusSold); err != ErrOWN {
+		t.Errorf("status by another user: %v, want %v", err, ErrOWN)
+	}
+	if err := SetCSVItemStatus("user1", 99, StatusSold); err != ErrLNE {
+		t.Errorf("status of a missing listing: %v, want %v", err, ErrLNE)
+	}
+}
+
+// TestRelistRenews - Relisting an expired item makes it active again with
+//                    a new creation time
+func TestRelistRenews(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Phone", "100", "Electronics")
+
+	expired := getListing(t, id)
+	expired.CreatedAt = time.Now().Add(-listingTTL - time.Hour).Format(timeFormat)
+	err := ReGenerateCSVProduct([][]string{{productRecord(expired)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := getListing(t, id).state(); state != StatusExpired {
+		t.Fatalf("state = %s, want %s", state, StatusExpired)
+	}
+
+	err = SetCSVItemStatus("user1", id, StatusActive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product := getListing(t, id); product.state() != StatusActive ||
+		product.CreatedAt == expired.CreatedAt {
+		t.Errorf("relisted %s created %s", product.state(), product.CreatedAt)
+	}
+}
+
+// TestExpiryLocalTime - The creation time is a local time, a listing is
+//                       active for its TTL whatever the zone
+func TestExpiryLocalTime(t *testing.T) {
+	for _, hours := range testZones {
+		func() {
+			defer inZone(hours)()
+
+			product := ProductListing{Status: StatusActive}
+			product.CreatedAt = time.Now().Add(-listingTTL + time.Hour).Format(timeFormat)
+			if state := product.state(); state != StatusActive {
+				t.Errorf("UTC%+d: listing created %s %s", hours, product.CreatedAt, state)
+			}
+			product.CreatedAt = time.Now().Add(-listingTTL - time.Hour).Format(timeFormat)
+			if state := product.state(); state != StatusExpired {
+				t.Errorf("UTC%+d: listing created %s %s", hours, product.CreatedAt, state)
+			}
+		}()
+	}
+}
@@ -0,0 +1,722 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BackendCSV = "csv"
+	BackendKV  = "kv"
+)
+
+// Trees of the kv store
+const (
+	kvById = iota
+	kvByOwner
+	kvByOwnerCategory
+	kvByCreated
+	kvByContent
+)
+
+var (
+	kvItemsPath = "/tmp/items.kv"
+
+	ErrBACK = errors.New("Error - Unknown backend, use csv or kv")
+
+	// activeStore - Store of the items, opened on first use
+	activeStore itemStore
+)
+
+// itemStore - Where the items live. Every read and write of the items
+//             goes through it, the csv item file scans its rows while
+//             the kv store keeps them indexed by ID, owner, owner and
+//             category, creation time and content.
+type itemStore interface {
+	// rows - Every item row, in the order of the store
+	rows() [][]string
+	// replace - Make the rows the whole content of the store at once
+	replace(lines [][]string) error
+	add(product ProductListing) error
+	// update - Write items over the ones with their IDs in one write, an
+	//          item not in the store yet is added
+	update(products ...ProductListing) error
+	// remove - Drop the items with the IDs in one write
+	remove(ids ...int) error
+	get(id int) (ProductListing, bool)
+	byOwner(username string) []ProductListing
+	byOwnerCategory(username string, category string) []ProductListing
+	byCreated(since time.Time, until time.Time) []ProductListing
+	// duplicateOf - ID of another item with the same title, description
+	//               and category, 0 if there is none
+	duplicateOf(product ProductListing) int
+	lastId() int
+	close() error
+}
+
+// Backend - Storage backend of the items recorded in the metadata file
+func Backend() string {
+	if readMeta()["backend"] == BackendKV {
+		return BackendKV
+	}
+
+	return BackendCSV
+}
+
+// currentStore - Store of the backend in use
+func currentStore() (itemStore, error) {
+	if activeStore != nil {
+		return activeStore, nil
+	}
+
+	if Backend() == BackendKV {
+		store, err := openKVStore(kvItemsPath)
+		if err != nil {
+			return nil, err
+		}
+		activeStore = store
+	} else {
+		activeStore = &csvStore{csvItemsPath}
+	}
+
+	return activeStore, nil
+}
+
+// refreshStore - Drop what the store read before the data lock was taken,
+//                another process may have changed the items, compacted
+//                the kv file or moved the items to another backend since
+func refreshStore() error {
+	if activeStore == nil {
+		return nil
+	}
+
+	store, ok := activeStore.(*kvStore)
+	if ok != (Backend() == BackendKV) {
+		activeStore.close()
+		activeStore = nil
+		return nil
+	}
+	if ok {
+		return store.kv.refresh()
+	}
+
+	return nil
+}
+
+// sameCategory - Categories compare case insensitively
+func sameCategory(a string, b string) bool {
+	return strings.ToLower(trimQuotes(a)) == strings.ToLower(trimQuotes(b))
+}
+
+// sameContent - Two items with the same title, description and category
+//               are duplicates
+func sameContent(a ProductListing, b ProductListing) bool {
+	return trimQuotes(a.Title) == trimQuotes(b.Title) &&
+		trimQuotes(a.Description) == trimQuotes(b.Description) &&
+		trimQuotes(a.Category) == trimQuotes(b.Category)
+}
+
+// csvStore - The items as rows of a csv file
+type csvStore struct {
+	path string
+}
+
+func (s *csvStore) rows() [][]string {
+	file, err := os.OpenFile(s.path, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.LazyQuotes = true
+	lines, err := r.ReadAll()
+	if err != nil || len(lines) == 0 {
+		return nil
+	}
+
+	return lines
+}
+
+func (s *csvStore) replace(lines [][]string) error {
+	return writeCSVAtomic(s.path, lines)
+}
+
+func (s *csvStore) add(product ProductListing) error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	wr := csv.NewWriter(file)
+	err = wr.Write([]string{productRecord(product)})
+	if err != nil {
+		return err
+	}
+	wr.Flush()
+
+	return wr.Error()
+}
+
+func (s *csvStore) update(products ...ProductListing) error {
+	records := make(map[int]string)
+	for _, product := range products {
+		records[product.Id] = productRecord(product)
+	}
+
+	lines := s.rows()
+	for i, line := range lines {
+		id, _ := strconv.Atoi(strings.SplitN(line[0], "|", 2)[0])
+		if record, ok := records[id]; ok {
+			lines[i][0] = record
+			delete(records, id)
+		}
+	}
+	for _, product := range products {
+		if record, ok := records[product.Id]; ok {
+			lines = append(lines, []string{record})
+		}
+	}
+
+	return writeCSVAtomic(s.path, lines)
+}
+
+func (s *csvStore) remove(ids ...int) error {
+	drop := make(map[int]bool)
+	for _, id := range ids {
+		drop[id] = true
+	}
+
+	var kept [][]string
+	for _, line := range s.rows() {
+		id, _ := strconv.Atoi(strings.SplitN(line[0], "|", 2)[0])
+		if !drop[id] {
+			kept = append(kept, line)
+		}
+	}
+
+	return writeCSVAtomic(s.path, kept)
+}
+
+// products - Every parsable item of the file matching keep
+func (s *csvStore) products(keep func(ProductListing) bool) []ProductListing {
+	var products []ProductListing
+	for _, entry := range s.rows() {
+		product, err := parseProduct(entry[0])
+		if err == nil && keep(product) {
+			products = append(products, product)
+		}
+	}
+
+	return products
+}
+
+func (s *csvStore) get(id int) (ProductListing, bool) {
+	found := s.products(func(p ProductListing) bool { return p.Id == id })
+	if len(found) == 0 {
+		return ProductListing{}, false
+	}
+
+	return found[0], true
+}
+
+func (s *csvStore) byOwner(username string) []ProductListing {
+	return s.products(func(p ProductListing) bool {
+		return sameUser(p.Username, username)
+	})
+}
+
+func (s *csvStore) byOwnerCategory(username string, category string) []ProductListing {
+	return s.products(func(p ProductListing) bool {
+		return sameUser(p.Username, username) && sameCategory(p.Category, category)
+	})
+}
+
+func (s *csvStore) byCreated(since time.Time, until time.Time) []ProductListing {
+	return s.products(func(p ProductListing) bool {
+		t := createdTime(p)
+		return !t.Before(since) && t.Before(until)
+	})
+}
+
+func (s *csvStore) duplicateOf(product ProductListing) int {
+	for _, entry := range s.rows() {
+		splEntry := strings.Split(entry[0], "|")
+		if len(splEntry) < 6 {
+			continue
+		}
+		id, _ := strconv.Atoi(splEntry[0])
+		other := ProductListing{Title: splEntry[2], Description: splEntry[3],
+			Category: splEntry[5]}
+		if id != product.Id && sameContent(product, other) {
+			return id
+		}
+	}
+
+	return 0
+}
+
+func (s *csvStore) lastId() int {
+	var lastID int
+	for _, entry := range s.rows() {
+		id, _ := strconv.Atoi(strings.Split(entry[0], "|")[0])
+		if id > lastID {
+			lastID = id
+		}
+	}
+
+	return lastID
+}
+
+func (s *csvStore) close() error {
+	return nil
+}
+
+// kvStore - The items in a kv file, the item rows keyed by ID plus one
+//           tree per index whose keys end with the ID of the item
+type kvStore struct {
+	kv *kvFile
+}
+
+func openKVStore(path string) (*kvStore, error) {
+	kv, err := openKV(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kvStore{kv}, nil
+}
+
+func idKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+
+	return key
+}
+
+func keyId(key []byte) int {
+	return int(binary.BigEndian.Uint64(key[len(key)-8:]))
+}
+
+// digest - Fixed size key part for free text, the index only narrows the
+//          search and the items found are compared in full
+func digest(parts ...string) []byte {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return sum[:16]
+}
+
+func ownerPrefix(username string) []byte {
+	return []byte(canonicalUsername(username) + "\x00")
+}
+
+func ownerCategoryPrefix(username string, category string) []byte {
+	return append(ownerPrefix(username), digest(strings.ToLower(trimQuotes(category)))...)
+}
+
+func createdKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	if t.Unix() > 0 {
+		binary.BigEndian.PutUint64(key, uint64(t.Unix()))
+	}
+
+	return key
+}
+
+func contentPrefix(product ProductListing) []byte {
+	return digest(trimQuotes(product.Title), trimQuotes(product.Description),
+		trimQuotes(product.Category))
+}
+
+// indexKeys - Keys of an item in the index trees
+func indexKeys(product ProductListing) map[int][]byte {
+	id := idKey(product.Id)
+
+	return map[int][]byte{
+		kvByOwner:         append(ownerPrefix(product.Username), id...),
+		kvByOwnerCategory: append(ownerCategoryPrefix(product.Username, product.Category), id...),
+		kvByCreated:       append(createdKey(createdTime(product)), id...),
+		kvByContent:       append(contentPrefix(product), id...),
+	}
+}
+
+// set - Write an item and its index keys, dropping the keys of the item
+//       it replaces
+func (s *kvStore) set(product ProductListing) error {
+	if old, ok := s.get(product.Id); ok {
+		for tree, key := range indexKeys(old) {
+			err := s.kv.delete(tree, key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := s.kv.put(kvById, idKey(product.Id), []byte(productRecord(product)))
+	for tree, key := range indexKeys(product) {
+		if err == nil {
+			err = s.kv.put(tree, key, nil)
+		}
+	}
+
+	return err
+}
+
+// unset - Remove an item and its index keys
+func (s *kvStore) unset(product ProductListing) error {
+	err := s.kv.delete(kvById, idKey(product.Id))
+	for tree, key := range indexKeys(product) {
+		if err == nil {
+			err = s.kv.delete(tree, key)
+		}
+	}
+
+	return err
+}
+
+func (s *kvStore) rows() [][]string {
+	var lines [][]string
+	s.kv.scan(kvById, nil, func(key []byte, val []byte) bool {
+		lines = append(lines, []string{string(val)})
+		return true
+	})
+
+	return lines
+}
+
+// replace - Apply the difference between the rows and the store in one
+//           commit, only the changed items are written
+func (s *kvStore) replace(lines [][]string) error {
+	wanted := make(map[int]string)
+	for _, line := range lines {
+		product, err := parseProduct(line[0])
+		if err != nil {
+			return ErrMALF
+		}
+		wanted[product.Id] = productRecord(product)
+	}
+
+	var stale []ProductListing
+	err := s.kv.scan(kvById, nil, func(key []byte, val []byte) bool {
+		id := keyId(key)
+		if record, ok := wanted[id]; ok && record == string(val) {
+			delete(wanted, id)
+		} else if !ok {
+			product, _ := parseProduct(string(val))
+			stale = append(stale, product)
+		}
+		return true
+	})
+
+	for _, product := range stale {
+		if err == nil {
+			err = s.unset(product)
+		}
+	}
+	for _, line := range lines {
+		product, _ := parseProduct(line[0])
+		if _, ok := wanted[product.Id]; ok && err == nil {
+			err = s.set(product)
+		}
+	}
+	if err != nil {
+		s.kv.rollback()
+		return err
+	}
+
+	return s.kv.commit()
+}
+
+func (s *kvStore) add(product ProductListing) error {
+	return s.update(product)
+}
+
+func (s *kvStore) update(products ...ProductListing) error {
+	var err error
+	for _, product := range products {
+		var stored ProductListing
+		stored, err = parseProduct(productRecord(product))
+		if err == nil {
+			err = s.set(stored)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		s.kv.rollback()
+		return err
+	}
+
+	return s.kv.commit()
+}
+
+func (s *kvStore) remove(ids ...int) error {
+	var err error
+	for _, id := range ids {
+		if product, ok := s.get(id); ok && err == nil {
+			err = s.unset(product)
+		}
+	}
+	if err != nil {
+		s.kv.rollback()
+		return err
+	}
+
+	return s.kv.commit()
+}
+
+func (s *kvStore) get(id int) (ProductListing, bool) {
+	val, ok, err := s.kv.get(kvById, idKey(id))
+	if err != nil || !ok {
+		return ProductListing{}, false
+	}
+	product, err := parseProduct(string(val))
+
+	return product, err == nil
+}
+
+// lookup - Items whose keys in an index tree start with prefix, those
+//          failing keep are left out
+func (s *kvStore) lookup(tree int, prefix []byte, keep func(ProductListing) bool) []ProductListing {
+	var products []ProductListing
+	var ids []int
+	s.kv.scanPrefix(tree, prefix, func(key []byte, val []byte) bool {
+		ids = append(ids, keyId(key))
+		return true
+	})
+
+	for _, id := range ids {
+		if product, ok := s.get(id); ok && keep(product) {
+			products = append(products, product)
+		}
+	}
+
+	return products
+}
+
+func (s *kvStore) byOwner(username string) []ProductListing {
+	return s.lookup(kvByOwner, ownerPrefix(username), func(p ProductListing) bool {
+		return sameUser(p.Username, username)
+	})
+}
+
+func (s *kvStore) byOwnerCategory(username string, category string) []ProductListing {
+	return s.lookup(kvByOwnerCategory, ownerCategoryPrefix(username, category),
+		func(p ProductListing) bool {
+			return sameUser(p.Username, username) && sameCategory(p.Category, category)
+		})
+}
+
+func (s *kvStore) byCreated(since time.Time, until time.Time) []ProductListing {
+	var ids []int
+	end := createdKey(until)
+	s.kv.scan(kvByCreated, createdKey(since), func(key []byte, val []byte) bool {
+		if string(key[:8]) >= string(end) {
+			return false
+		}
+		ids = append(ids, keyId(key))
+		return true
+	})
+
+	var products []ProductListing
+	for _, id := range ids {
+		if product, ok := s.get(id); ok {
+			products = append(products, product)
+		}
+	}
+
+	return products
+}
+
+func (s *kvStore) duplicateOf(product ProductListing) int {
+	for _, other := range s.lookup(kvByContent, contentPrefix(product),
+		func(p ProductListing) bool { return p.Id != product.Id }) {
+		if sameContent(product, other) {
+			return other.Id
+		}
+	}
+
+	return 0
+}
+
+func (s *kvStore) lastId() int {
+	key, ok, err := s.kv.last(kvById)
+	if err != nil || !ok {
+		return 0
+	}
+
+	return keyId(key)
+}
+
+func (s *kvStore) close() error {
+	return s.kv.close()
+}
+
+// syncItemStore - Match the item store to the backend recorded after a
+//                 restore, which leaves the items in a csv item file
+func syncItemStore() error {
+	if activeStore != nil {
+		activeStore.close()
+		activeStore = nil
+	}
+
+	if Backend() != BackendKV {
+		err := os.Remove(kvItemsPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	lines := (&csvStore{csvItemsPath}).rows()
+	os.Remove(kvItemsPath)
+	store, err := currentStore()
+	if err == nil {
+		err = store.replace(lines)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Remove(csvItemsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// UseBackend - Move the items to another backend and record it as the
+//              one in use, only the admin can do it
+func UseBackend(username string, backend string) error {
+	if !IsAdmin(username) {
+		return ErrPERM
+	}
+	if backend != BackendCSV && backend != BackendKV {
+		return ErrBACK
+	}
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if backend == Backend() {
+		return nil
+	}
+
+	from, err := currentStore()
+	if err != nil {
+		return err
+	}
+	lines := from.rows()
+
+	var to itemStore = &csvStore{csvItemsPath}
+	target := csvItemsPath
+	if backend == BackendKV {
+		os.Remove(kvItemsPath)
+		store, err := openKVStore(kvItemsPath)
+		if err != nil {
+			return err
+		}
+		to = store
+		target = kvItemsPath
+	}
+
+	err = to.replace(lines)
+	if err == nil {
+		err = setMeta("backend", backend)
+	}
+	to.close()
+	if err != nil {
+		os.Remove(target)
+		return err
+	}
+
+	from.close()
+	activeStore = nil
+	if backend == BackendKV {
+		return os.Remove(csvItemsPath)
+	}
+
+	return os.Remove(kvItemsPath)
+}
+
+// CompactStore - Rewrite the kv store without its unreachable pages
+func CompactStore(username string) error {
+	if !IsAdmin(username) {
+		return ErrPERM
+	}
+
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	kv, ok := store.(*kvStore)
+	if !ok {
+		return errors.New("Error - Only the kv backend can be compacted")
+	}
+
+	return kv.kv.compact()
+}
+
+// PrintStore - Show the backend in use and the size of the item store
+func PrintStore() error {
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	if kv, ok := store.(*kvStore); ok {
+		fmt.Println(fmt.Sprintf("%s|%s|%d bytes|%d pages|%d unreachable",
+			BackendKV, kvItemsPath, fileSize(kvItemsPath), kv.kv.meta.pages,
+			kv.kv.meta.freed))
+		return nil
+	}
+
+	fmt.Println(fmt.Sprintf("%s|%s|%d bytes|%d rows", BackendCSV, csvItemsPath,
+		fileSize(csvItemsPath), len(store.rows())))
+
+	return nil
+}
@@ -0,0 +1,297 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	syntheticOwners     = 100
+	syntheticCategories = 10
+)
+
+var syntheticStart = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// syntheticProducts - Items spread over syntheticOwners sellers,
+//                     syntheticCategories categories and one per minute
+func syntheticProducts(n int) [][]string {
+	var lines [][]string
+
+	for i := 1; i <= n; i++ {
+		product := ProductListing{Id: i,
+			Username:    fmt.Sprintf("user%d", i%syntheticOwners),
+			Title:       fmt.Sprintf("item %d", i),
+			Description: "synthetic listing",
+			Price:       Money{Amount: int64(i % 100000), Currency: DefaultCurrency},
+			Category:    fmt.Sprintf("category%d", i%syntheticCategories),
+			CreatedAt:   syntheticStart.Add(time.Duration(i) * time.Minute).Format(timeFormat),
+			Status:      StatusActive}
+		lines = append(lines, []string{productRecord(product)})
+	}
+
+	return lines
+}
+
+// openStores - A csv and a kv store in files of their own in dir
+func openStores(dir string) (map[string]itemStore, error) {
+	kv, err := openKVStore(filepath.Join(dir, "items.kv"))
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]itemStore{
+		BackendCSV: &csvStore{filepath.Join(dir, "items.csv")},
+		BackendKV:  kv,
+	}, nil
+}
+
+func TestStoreBackends(t *testing.T) {
+	resetData(t)
+	stores, err := openStores(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, store := range stores {
+		lines := syntheticProducts(300)
+		if err := store.replace(lines); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if p, ok := store.get(42); !ok || p.Title != "item 42" {
+			t.Errorf("%s: get 42 = %v, %v", name, p, ok)
+		}
+		if n := len(store.byOwner("USER7")); n != 3 {
+			t.Errorf("%s: %d items of user7, want 3", name, n)
+		}
+		if n := len(store.byOwnerCategory("user7", "Category7")); n != 3 {
+			t.Errorf("%s: %d items of user7 in category7, want 3", name, n)
+		}
+		since := syntheticStart.Add(10 * time.Minute)
+		if n := len(store.byCreated(since, since.Add(time.Hour))); n != 60 {
+			t.Errorf("%s: %d items created in an hour, want 60", name, n)
+		}
+		dup, _ := parseProduct(lines[9][0])
+		dup.Id = 0
+		if id := store.duplicateOf(dup); id != 10 {
+			t.Errorf("%s: duplicate of item 10 = %d", name, id)
+		}
+
+		// update writes over an item and adds a new one in one write
+		changed, _ := store.get(42)
+		changed.Username = "seller"
+		added := changed
+		added.Id, added.Title = 301, "item 301"
+		if err := store.update(changed, added); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if p, _ := store.get(42); p.Username != "seller" {
+			t.Errorf("%s: owner after update %q", name, p.Username)
+		}
+		if n := len(store.byOwner("seller")); n != 2 {
+			t.Errorf("%s: %d items of seller, want 2", name, n)
+		}
+		if n := len(store.byOwner("user42")); n != 2 {
+			t.Errorf("%s: old owner index kept, %d items", name, n)
+		}
+
+		if err := store.remove(42, 301, 999); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if _, ok := store.get(42); ok {
+			t.Errorf("%s: item 42 kept after remove", name)
+		}
+		if n, id := len(store.rows()), store.lastId(); n != 299 || id != 300 {
+			t.Errorf("%s: %d rows, last id %d", name, n, id)
+		}
+		store.close()
+	}
+}
+
+func TestStoreRefreshedOnLock(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	if err := UseBackend(adminUser, BackendKV); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := currentStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process changes and compacts the store
+	other, err := openKVStore(kvItemsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	product := getListing(t, id)
+	product.Title = "Old camera"
+	err = other.update(product)
+	if err == nil {
+		err = other.kv.compact()
+	}
+	other.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := lockData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := getListing(t, id)
+	unlock()
+	if p.Title != "Old camera" {
+		t.Errorf("title under the lock %q, want the one of the other process", p.Title)
+	}
+
+	// A change made now is not lost by the other process
+	updateListing(t, "user1", id, "--price", "90")
+	other, err = openKVStore(kvItemsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.close()
+	if p, _ := other.get(id); p.Title != "Old camera" || p.Price.String() != "90.00 SGD" {
+		t.Errorf("listing seen by the other process = %v", p)
+	}
+}
+
+func TestStoreOpenError(t *testing.T) {
+	resetData(t)
+
+	if err := setMeta("backend", BackendKV); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(kvItemsPath, make([]byte, 2*kvPageSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := currentStore(); err != ErrKVC {
+		t.Errorf("damaged kv file: %v, want %v", err, ErrKVC)
+	}
+	if _, err := CreateCSVProduct(ProductListing{Username: "user1"}); err != ErrKVC {
+		t.Errorf("create on a damaged kv file: %v, want %v", err, ErrKVC)
+	}
+	if err := BrowseCSVCategory("Electronics", Filter{}, Page{}); err != ErrKVC {
+		t.Errorf("browse on a damaged kv file: %v, want %v", err, ErrKVC)
+	}
+}
+
+// benchStores - The csv and kv stores holding n synthetic items
+func benchStores(b *testing.B, n int) (map[string]itemStore, func()) {
+	dir, err := ioutil.TempDir("", "carousell-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	stores, err := openStores(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	lines := syntheticProducts(n)
+	for _, store := range stores {
+		if err := store.replace(lines); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return stores, func() {
+		for _, store := range stores {
+			store.close()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// benchmarkStores - Time an operation on both backends
+func benchmarkStores(b *testing.B, op func(store itemStore, i int)) {
+	stores, cleanup := benchStores(b, 10000)
+	defer cleanup()
+
+	for _, name := range []string{BackendCSV, BackendKV} {
+		store := stores[name]
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				op(store, i)
+			}
+		})
+	}
+}
+
+func BenchmarkStoreGet(b *testing.B) {
+	benchmarkStores(b, func(store itemStore, i int) {
+		store.get(i%10000 + 1)
+	})
+}
+
+func BenchmarkStoreByOwner(b *testing.B) {
+	benchmarkStores(b, func(store itemStore, i int) {
+		store.byOwner(fmt.Sprintf("user%d", i%syntheticOwners))
+	})
+}
+
+func BenchmarkStoreByOwnerCategory(b *testing.B) {
+	benchmarkStores(b, func(store itemStore, i int) {
+		store.byOwnerCategory(fmt.Sprintf("user%d", i%syntheticOwners),
+			fmt.Sprintf("category%d", i%syntheticCategories))
+	})
+}
+
+func BenchmarkStoreByCreated(b *testing.B) {
+	benchmarkStores(b, func(store itemStore, i int) {
+		since := syntheticStart.Add(time.Duration(i%10000) * time.Minute)
+		store.byCreated(since, since.Add(24*time.Hour))
+	})
+}
+
+func BenchmarkStoreDuplicate(b *testing.B) {
+	benchmarkStores(b, func(store itemStore, i int) {
+		store.duplicateOf(ProductListing{Title: fmt.Sprintf("item %d", i%10000+1),
+			Description: "synthetic listing",
+			Category:    fmt.Sprintf("category%d", (i%10000+1)%syntheticCategories)})
+	})
+}
+
+func BenchmarkStoreUpdate(b *testing.B) {
+	benchmarkStores(b, func(store itemStore, i int) {
+		product, _ := store.get(i%10000 + 1)
+		product.Price.Amount++
+		if err := store.update(product); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,317 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	adminUser = "admin"
+
+	// trashRetention - Time an item stays in the trash before its owner
+	//                  can purge it, the admin can purge at any time
+	trashRetention = 30 * 24 * time.Hour
+)
+
+var (
+	csvTrashPath = "/tmp/trash.csv"
+
+	ErrTNE = errors.New("Error - listing is not in the trash")
+	ErrRET = errors.New("Error - listing is still within the trash retention period")
+)
+
+// trashEntry - An item of the trash and when it got deleted
+type trashEntry struct {
+	product   ProductListing
+	deletedAt string
+}
+
+// IsAdmin - Check if username is the marketplace admin
+func IsAdmin(username string) bool {
+	return canonicalUsername(username) == adminUser
+}
+
+// readTrash - Read all items from the csv trash file, each row is the
+//             deletion time followed by the csv item row
+func readTrash() []trashEntry {
+	var trash []trashEntry
+
+	file, err := os.Open(csvTrashPath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	lines, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil
+	}
+
+	for _, line := range lines {
+		splEntry := strings.SplitN(line[0], "|", 2)
+		if len(splEntry) != 2 {
+			continue
+		}
+		product, err := parseProduct(splEntry[1])
+		if err != nil {
+			continue
+		}
+		trash = append(trash, trashEntry{product, splEntry[0]})
+	}
+
+	return trash
+}
+
+// writeTrash - Regenerates the csv trash file
+func writeTrash(trash []trashEntry) error {
+	var lines [][]string
+	for _, t := range trash {
+		lines = append(lines, []string{t.deletedAt + "|" + productRecord(t.product)})
+	}
+
+	return writeCSVAtomic(csvTrashPath, lines)
+}
+
+// appendTrash - Add a deleted item to the csv trash file
+func appendTrash(product ProductListing, deletedAt string) error {
+	file, err := os.OpenFile(csvTrashPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	err = w.Write([]string{deletedAt + "|" + productRecord(product)})
+	if err != nil {
+		return err
+	}
+	w.Flush()
+
+	return w.Error()
+}
+
+// trashProduct - Move an item from the store to the trash. An item already
+//                in the trash is only dropped from the store, so running
+//                it again after a crash moves the item once.
+func trashProduct(product ProductListing, deletedAt string) error {
+	trashed := false
+	for _, t := range readTrash() {
+		trashed = trashed || t.product.Id == product.Id
+	}
+	if !trashed {
+		err := appendTrash(product, deletedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	store, err := currentStore()
+	if err == nil {
+		err = store.remove(product.Id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return unindexProduct(product.Id)
+}
+
+// expired - Check if an item has been in the trash for the retention period
+func (t trashEntry) expired() bool {
+	deleted, err := time.ParseInLocation(timeFormat, t.deletedAt, time.Local)
+	return err == nil && time.Since(deleted) > trashRetention
+}
+
+// RestoreCSVItem - Bring an item back from the trash to the csv item file
+func RestoreCSVItem(username string, id int) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, t := range readTrash() {
+		if t.product.Id != id {
+			continue
+		}
+		if !sameUser(username, t.product.Username) {
+			return ErrOWN
+		}
+
+		store, err := currentStore()
+		if err != nil {
+			return err
+		}
+		if store.duplicateOf(t.product) != 0 {
+			return ErrPAE
+		}
+		user, ok := FindUser(t.product.Username)
+		if !ok {
+			return ErrUNKU
+		}
+		if !user.Active {
+			return ErrUINA
+		}
+
+		seq, err := beginJournal(username, JournalRestore, productRecord(t.product))
+		if err != nil {
+			return err
+		}
+		return endJournal(seq, JournalRestore, restoreProduct(t.product))
+	}
+
+	return ErrTNE
+}
+
+// restoreProduct - Move an item from the trash back to the store. As
+//                  trashProduct it can run again after a crash.
+func restoreProduct(product ProductListing) error {
+	store, err := currentStore()
+	if err == nil {
+		err = store.update(product)
+	}
+	if err == nil {
+		err = indexProduct(product)
+	}
+	if err != nil {
+		return err
+	}
+
+	var kept []trashEntry
+	for _, t := range readTrash() {
+		if t.product.Id != product.Id {
+			kept = append(kept, t)
+		}
+	}
+
+	return writeTrash(kept)
+}
+
+// GetCSVTrash - Show the items in the trash of an user
+func GetCSVTrash(username string, page Page) error {
+	var items []trashEntry
+
+	for _, t := range readTrash() {
+		if sameUser(username, t.product.Username) {
+			items = append(items, t)
+		}
+	}
+
+	if len(items) == 0 {
+		return errors.New("Error - trash is empty")
+	}
+
+	start, end, next := page.window(len(items))
+	for _, t := range items[start:end] {
+		fmt.Println(listingLine(t.product) + "|" + t.deletedAt)
+	}
+	page.printNext(next)
+
+	return nil
+}
+
+// PurgeCSVTrash - Remove items from the trash for good. The admin purges
+//                 any item, or with id 0 every item past the retention
+//                 period. Owners only purge their items past the retention.
+func PurgeCSVTrash(username string, id int) (purged int, err error) {
+	unlock, err := lockData()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	ids := make(map[int]bool)
+	admin := IsAdmin(username)
+	for _, t := range readTrash() {
+		owner := sameUser(username, t.product.Username)
+		switch {
+		case id != 0 && t.product.Id != id:
+		case id != 0 && !admin && !owner:
+			return 0, ErrOWN
+		case id != 0 && (admin || t.expired()):
+			ids[t.product.Id] = true
+		case id != 0:
+			return 0, ErrRET
+		case (admin || owner) && t.expired():
+			ids[t.product.Id] = true
+		}
+	}
+
+	purged = len(ids)
+	if id != 0 && purged == 0 {
+		return 0, ErrTNE
+	}
+	if purged == 0 {
+		return 0, nil
+	}
+
+	var list []string
+	for n := range ids {
+		list = append(list, strconv.Itoa(n))
+	}
+	sort.Strings(list)
+	seq, err := beginJournal(username, JournalPurge, strings.Join(list, ","))
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, endJournal(seq, JournalPurge, purgeProducts(ids))
+}
+
+// purgeProducts - Drop items from the trash with their revisions and
+//                 images, purging them again changes nothing
+func purgeProducts(ids map[int]bool) error {
+	var kept []trashEntry
+	for _, t := range readTrash() {
+		if !ids[t.product.Id] {
+			kept = append(kept, t)
+		}
+	}
+
+	err := writeTrash(kept)
+	if err != nil {
+		return err
+	}
+
+	err = dropRevisions(ids)
+	if err != nil {
+		return err
+	}
+
+	return dropImages(ids)
+}
@@ -0,0 +1,153 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeleteAndRestore(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Phone", "100", "Electronics")
+
+	if err := DeleteCSVItem("user2", id); err != ErrOWN {
+		t.Errorf("delete by another user: %v, want %v", err, ErrOWN)
+	}
+	deleteListing(t, "user1", id)
+	if hasListing(t, id) {
+		t.Fatal("deleted item still listed")
+	}
+	if trash := readTrash(); len(trash) != 1 || trash[0].product.Id != id {
+		t.Fatalf("trash = %v", trash)
+	}
+
+	if err := RestoreCSVItem("user2", id); err != ErrOWN {
+		t.Errorf("restore by another user: %v, want %v", err, ErrOWN)
+	}
+	if err := RestoreCSVItem("user1", id); err != nil {
+		t.Fatal(err)
+	}
+	if product := getListing(t, id); product.Title != "Phone" {
+		t.Errorf("restored %v", product)
+	}
+	if len(readTrash()) != 0 {
+		t.Errorf("trash not emptied by restore")
+	}
+	if err := RestoreCSVItem("user1", id); err != ErrTNE {
+		t.Errorf("restore twice: %v, want %v", err, ErrTNE)
+	}
+}
+
+func TestPurgeRetention(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	fresh := createListing(t, "user1", "Phone", "100", "Electronics")
+	old := createListing(t, "user1", "Laptop", "900", "Electronics")
+	other := createListing(t, "user2", "Shoes", "50", "Sports")
+	deleteListing(t, "user1", fresh)
+	deleteListing(t, "user1", old)
+	deleteListing(t, "user2", other)
+
+	// Age the deletion of one item past the retention period
+	trash := readTrash()
+	for i := range trash {
+		if trash[i].product.Id == old {
+			trash[i].deletedAt = time.Now().Add(-trashRetention - time.Hour).Format(timeFormat)
+		}
+	}
+	if err := writeTrash(trash); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := PurgeCSVTrash("user1", fresh); err != ErrRET {
+		t.Errorf("purge within retention: %v, want %v", err, ErrRET)
+	}
+	if _, err := PurgeCSVTrash("user1", other); err != ErrOWN {
+		t.Errorf("purge another user's item: %v, want %v", err, ErrOWN)
+	}
+	if n, err := PurgeCSVTrash("user1", 0); err != nil || n != 1 {
+		t.Errorf("purge expired = %d, %v, want 1", n, err)
+	}
+	if n, err := PurgeCSVTrash("admin", fresh); err != nil || n != 1 {
+		t.Errorf("admin purge = %d, %v, want 1", n, err)
+	}
+	if trash := readTrash(); len(trash) != 1 || trash[0].product.Id != other {
+		t.Errorf("trash after purge = %v", trash)
+	}
+	if _, err := PurgeCSVTrash("admin", fresh); err != ErrTNE {
+		t.Errorf("purge twice: %v, want %v", err, ErrTNE)
+	}
+}
+
+// TestRetentionLocalTime - The deletion time is a local time, an item is
+//                          kept the retention period whatever the zone
+func TestRetentionLocalTime(t *testing.T) {
+	for _, hours := range testZones {
+		func() {
+			defer inZone(hours)()
+
+			kept := trashEntry{deletedAt: time.Now().Add(-trashRetention + time.Hour).Format(timeFormat)}
+			if kept.expired() {
+				t.Errorf("UTC%+d: item deleted %s expired", hours, kept.deletedAt)
+			}
+			old := trashEntry{deletedAt: time.Now().Add(-trashRetention - time.Hour).Format(timeFormat)}
+			if !old.expired() {
+				t.Errorf("UTC%+d: item deleted %s kept", hours, old.deletedAt)
+			}
+		}()
+	}
+}
+
+// TestPurgedIdNotReused - Purging the newest item does not free its ID
+func TestPurgedIdNotReused(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	createListing(t, "user1", "Phone", "100", "Electronics")
+	id := createListing(t, "user1", "Laptop", "900", "Electronics")
+	deleteListing(t, "user1", id)
+
+	if _, err := PurgeCSVTrash("admin", id); err != nil {
+		t.Fatal(err)
+	}
+	if next := createListing(t, "user1", "Shoes", "50", "Sports"); next != id+1 {
+		t.Errorf("new item got ID %d, want %d", next, id+1)
+	}
+
+	// Data from before the counter starts past the highest ID in use
+	if err := os.Remove(csvMetaPath); err != nil {
+		t.Fatal(err)
+	}
+	if next := nextId(t); next != id+2 {
+		t.Errorf("next ID without the counter = %d, want %d", next, id+2)
+	}
+}
@@ -0,0 +1,517 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// deletedUser - Owner of what a deleted user leaves behind, the username
+	//               grammar keeps anyone from registering it
+	deletedUser = "[deleted]"
+)
+
+var (
+	ErrUAE  = errors.New("Error - user already exists")
+	ErrUINA = errors.New("Error - user is deactivated")
+	ErrBADE = errors.New("Error - Invalid email")
+	ErrPERM = errors.New("Error - permission denied")
+
+	// profileFields - Fields of a profile set by EDIT_PROFILE
+	profileFields = []string{"name", "email", "location", "bio"}
+)
+
+// User - Structure used to organize an user profile
+type User struct {
+	Username    string
+	DisplayName string
+	Email       string
+	JoinedAt    string
+	Location    string
+	Bio         string
+	Active      bool
+}
+
+// parseUser - Parse a row of the csv user file. Rows written before the
+//             profiles hold the username only, split in one column per
+//             word, those words are joined by '_'.
+func parseUser(line []string) User {
+	if len(line) > 1 {
+		line = []string{strings.Join(line, "_")}
+	}
+	splEntry := strings.Split(line[0], "|")
+	user := User{Username: splEntry[0], DisplayName: splEntry[0], Active: true}
+	if len(splEntry) >= 7 {
+		user.DisplayName = splEntry[1]
+		user.Email = splEntry[2]
+		user.JoinedAt = splEntry[3]
+		user.Location = splEntry[4]
+		user.Bio = splEntry[5]
+		user.Active = splEntry[6] != "inactive"
+	}
+
+	return user
+}
+
+// userRecord - Format an user as a row of the csv user file
+func userRecord(user User) []string {
+	state := "active"
+	if !user.Active {
+		state = "inactive"
+	}
+
+	return []string{fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s",
+		user.Username, user.DisplayName, user.Email, user.JoinedAt,
+		user.Location, user.Bio, state)}
+}
+
+// loadUsers - Read all users from the csv user file
+func loadUsers() ([]User, error) {
+	var users []User
+
+	file, err := os.Open(csvUserPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range lines {
+		if len(line) > 0 && len(line[0]) > 0 {
+			users = append(users, parseUser(line))
+		}
+	}
+
+	return users, nil
+}
+
+// saveUsers - Regenerates the csv user file
+func saveUsers(users []User) error {
+	var lines [][]string
+	for _, user := range users {
+		lines = append(lines, userRecord(user))
+	}
+
+	return writeCSVAtomic(csvUserPath, lines)
+}
+
+// FindUser - Look up an user by the normal form of its username. The
+//            admin always exists, even when it never registered.
+func FindUser(username string) (User, bool) {
+	users, _ := loadUsers()
+	for _, user := range users {
+		if sameUser(user.Username, username) {
+			return user, true
+		}
+	}
+
+	if IsAdmin(username) {
+		return User{Username: adminUser, DisplayName: adminUser, Active: true}, true
+	}
+
+	return User{}, false
+}
+
+// IsUserActive - Check if an user exists and is not deactivated
+func IsUserActive(username string) bool {
+	user, ok := FindUser(username)
+	return ok && user.Active
+}
+
+// inactiveUsers - Set of the deactivated usernames in normal form
+func inactiveUsers() map[string]bool {
+	inactive := make(map[string]bool)
+
+	users, _ := loadUsers()
+	for _, user := range users {
+		if !user.Active {
+			inactive[canonicalUsername(user.Username)] = true
+		}
+	}
+
+	return inactive
+}
+
+// visibleProducts - Items of the marketplace, the items of deactivated
+//                   users are hidden
+func visibleProducts() ([]ProductListing, error) {
+	var products []ProductListing
+
+	all, err := loadProducts()
+	if err != nil {
+		return nil, err
+	}
+	inactive := inactiveUsers()
+	for _, product := range all {
+		if !inactive[canonicalUsername(product.Username)] {
+			products = append(products, product)
+		}
+	}
+
+	return products, nil
+}
+
+// modifyUser - Apply a change to an user and save the csv user file
+func modifyUser(username string, change func(*User) error) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	users, err := loadUsers()
+	if err != nil {
+		return ErrUNKU
+	}
+
+	for i := range users {
+		if !sameUser(users[i].Username, username) {
+			continue
+		}
+		err = change(&users[i])
+		if err != nil {
+			return err
+		}
+		return saveUsers(users)
+	}
+
+	return ErrUNKU
+}
+
+// changeUser - Apply a change to an user under the data lock, the row it
+//              leads to goes to the journal before the csv user file
+func changeUser(actor string, username string, change func(*User) error) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	users, err := loadUsers()
+	if err != nil {
+		return ErrUNKU
+	}
+	for _, user := range users {
+		if !sameUser(user.Username, username) {
+			continue
+		}
+		err = change(&user)
+		if err != nil {
+			return err
+		}
+
+		seq, err := beginJournal(actor, JournalProfile, userRecord(user)[0])
+		if err != nil {
+			return err
+		}
+		return endJournal(seq, JournalProfile, replaceUser(user))
+	}
+
+	return ErrUNKU
+}
+
+// replaceUser - Write an user over the row with the same username
+func replaceUser(user User) error {
+	return modifyUser(user.Username, func(u *User) error {
+		*u = user
+		return nil
+	})
+}
+
+// canManage - The user itself or the admin can manage an account
+func canManage(actor string, target string) bool {
+	return IsAdmin(actor) || sameUser(actor, target)
+}
+
+// PrintProfile - Show the profile of an user
+func PrintProfile(username string) error {
+	user, ok := FindUser(username)
+	if !ok {
+		return ErrUNKU
+	}
+
+	state := "active"
+	if !user.Active {
+		state = "inactive"
+	}
+	fmt.Println(fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s", user.Username,
+		user.DisplayName, user.Email, user.JoinedAt, user.Location,
+		user.Bio, state))
+
+	return nil
+}
+
+// EditProfile - Set the name, email, location or bio of an user
+func EditProfile(username string, args []string) error {
+	fields := make(map[string]string)
+	for i := 0; i < len(args); i += 2 {
+		name := strings.TrimPrefix(args[i], "--")
+		if name == args[i] || i+1 >= len(args) {
+			return fmt.Errorf("Error - Use --field value with %s",
+				strings.Join(profileFields, ", "))
+		}
+		value := strings.TrimSpace(trimQuotes(args[i+1]))
+		if strings.Contains(value, "|") {
+			return fmt.Errorf("Error - Invalid %s, it cannot contain |", name)
+		}
+		fields[name] = value
+	}
+
+	if len(fields) == 0 {
+		return errors.New("Error - Nothing to update")
+	}
+
+	return changeUser(username, username, func(user *User) error {
+		for name, value := range fields {
+			switch name {
+			case "name":
+				if len(value) == 0 {
+					return errors.New("Error - Invalid name, it cannot be empty")
+				}
+				user.DisplayName = value
+			case "email":
+				at := strings.Index(value, "@")
+				if len(value) > 0 && (at < 1 || at == len(value)-1 ||
+					strings.ContainsAny(value, " \t")) {
+					return ErrBADE
+				}
+				user.Email = value
+			case "location":
+				user.Location = value
+			case "bio":
+				user.Bio = value
+			default:
+				return fmt.Errorf("Error - Unknown field %s, use %s", name,
+					strings.Join(profileFields, ", "))
+			}
+		}
+		return nil
+	})
+}
+
+// SetUserActive - Deactivate an user, hiding its items, or activate it
+func SetUserActive(actor string, username string, active bool) error {
+	if !canManage(actor, username) {
+		return ErrPERM
+	}
+
+	return changeUser(actor, username, func(user *User) error {
+		user.Active = active
+		return nil
+	})
+}
+
+// rewriteOwner - Change the owner of the items of an user in the csv item,
+//                trash and revision files
+func rewriteOwner(from string, to string) error {
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	products := store.byOwner(from)
+	for i := range products {
+		products[i].Username = to
+	}
+	if len(products) > 0 {
+		err := store.update(products...)
+		if err != nil {
+			return err
+		}
+	}
+
+	trash := readTrash()
+	for i := range trash {
+		if sameUser(trash[i].product.Username, from) {
+			trash[i].product.Username = to
+		}
+	}
+	if len(trash) > 0 {
+		err := writeTrash(trash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return renameRevisions(from, to)
+}
+
+// RenameUser - Change an username and hand its items over to the new
+//              name. The whole change holds the data lock and goes to
+//              the journal, a crash halfway is finished on the next start.
+func RenameUser(actor string, username string, newname string) error {
+	if !canManage(actor, username) {
+		return ErrPERM
+	}
+	newname, err := NormalizeUsername(newname)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, ok := FindUser(username)
+	if !ok {
+		return ErrUNKU
+	}
+	if other, ok := FindUser(newname); ok && other.Username != user.Username {
+		return ErrUAE
+	}
+
+	seq, err := beginJournal(actor, JournalRenameUser, user.Username+"|"+newname)
+	if err != nil {
+		return err
+	}
+
+	return endJournal(seq, JournalRenameUser, renameUser(user.Username, newname))
+}
+
+// renameUser - Move the rows of an user to its new name. Every step only
+//              rewrites the rows still under the old name, so running it
+//              again finishes a rename cut short.
+func renameUser(from string, to string) error {
+	err := modifyUser(from, func(u *User) error {
+		if u.DisplayName == u.Username {
+			u.DisplayName = to
+		}
+		u.Username = to
+		return nil
+	})
+	if _, ok := FindUser(to); err == ErrUNKU && ok {
+		err = nil
+	}
+
+	for _, rename := range []func(string, string) error{rewriteOwner,
+		renameWatches, renameOffers, renameMessages, renameReviews} {
+		if err == nil {
+			err = rename(from, to)
+		}
+	}
+
+	return err
+}
+
+// DeleteUser - Remove an user. Its items go to the trash, or to another
+//              user when heir is given. Same as RenameUser the whole
+//              change holds the data lock and goes to the journal.
+func DeleteUser(actor string, username string, heir string) error {
+	if !canManage(actor, username) {
+		return ErrPERM
+	}
+
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, ok := FindUser(username)
+	if !ok {
+		return ErrUNKU
+	}
+	if len(heir) > 0 {
+		other, ok := FindUser(heir)
+		if !ok || sameUser(other.Username, user.Username) {
+			return ErrUNKU
+		}
+		heir = other.Username
+	}
+
+	deletedAt := time.Now().Format(timeFormat)
+	seq, err := beginJournal(actor, JournalDeleteUser,
+		user.Username+"|"+heir+"|"+deletedAt)
+	if err != nil {
+		return err
+	}
+
+	return endJournal(seq, JournalDeleteUser, deleteUser(user.Username, heir, deletedAt))
+}
+
+// deleteUser - Remove the rows of an user, as renameUser it can run again
+func deleteUser(username string, heir string, deletedAt string) error {
+	store, err := currentStore()
+	if err == nil && len(heir) > 0 {
+		err = rewriteOwner(username, heir)
+	} else if err == nil {
+		for _, product := range store.byOwner(username) {
+			if err == nil {
+				err = trashProduct(product, deletedAt)
+			}
+		}
+		// The trash and the revisions must not go to a new user of the name
+		if err == nil {
+			err = rewriteOwner(username, deletedUser)
+		}
+	}
+
+	for _, drop := range []func(string) error{dropWatches, withdrawOffers,
+		anonymizeMessages, anonymizeReviews, dropBlocks} {
+		if err == nil {
+			err = drop(username)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	users, err := loadUsers()
+	if err != nil {
+		return err
+	}
+	var kept []User
+	for _, u := range users {
+		if !sameUser(u.Username, username) {
+			kept = append(kept, u)
+		}
+	}
+
+	return saveUsers(kept)
+}
+
+// newUser - Profile of a freshly registered user
+func newUser(username string) User {
+	return User{Username: username, DisplayName: username,
+		JoinedAt: time.Now().Format(timeFormat), Active: true}
+}
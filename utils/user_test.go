@@ -0,0 +1,217 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenameUser(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2", "user3")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	err := WatchCSVItem("user2", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := MakeOffer("user2", id, Money{Amount: 8000, Currency: DefaultCurrency}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RenameUser("user2", "user1", "seller"); err != ErrPERM {
+		t.Errorf("rename by another user: %v, want %v", err, ErrPERM)
+	}
+	if err := RenameUser("user1", "user1", "user3"); err != ErrUAE {
+		t.Errorf("rename to a taken name: %v, want %v", err, ErrUAE)
+	}
+
+	if err := RenameUser("user1", "user1", "seller"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RenameUser("user2", "user2", "buyer"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := FindUser("user1"); ok {
+		t.Errorf("old name still registered")
+	}
+	if p := getListing(t, id); p.Username != "seller" {
+		t.Errorf("listing owner %q, want seller", p.Username)
+	}
+	watches := readWatches()
+	if len(watches) != 1 || watches[0].username != "buyer" {
+		t.Errorf("watches not renamed: %v", watches)
+	}
+	for _, o := range loadOffers() {
+		if o.Id == offer && (o.Buyer != "buyer" || o.From != "buyer") {
+			t.Errorf("offer not renamed: %v", o)
+		}
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2", "user3")
+	kept := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	trashed := createListing(t, "user2", "Running shoes", "50", "Sports")
+
+	err := WatchCSVItem("user3", kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteUser("user1", "user1", "nobody"); err != ErrUNKU {
+		t.Errorf("unknown heir: %v, want %v", err, ErrUNKU)
+	}
+	if err := DeleteUser("user1", "user1", "user3"); err != nil {
+		t.Fatal(err)
+	}
+	if p := getListing(t, kept); p.Username != "user3" {
+		t.Errorf("heir did not get the listing, owner %q", p.Username)
+	}
+
+	if err := DeleteUser("user2", "user2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if hasListing(t, trashed) {
+		t.Errorf("listing of a deleted user kept in the store")
+	}
+	trash := readTrash()
+	if len(trash) != 1 || trash[0].product.Id != trashed {
+		t.Errorf("trash = %v", trash)
+	}
+
+	if err := DeleteUser("user3", "user3", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(readWatches()) != 0 {
+		t.Errorf("watches of a deleted user kept")
+	}
+	for _, name := range []string{"user1", "user2", "user3"} {
+		if _, ok := FindUser(name); ok {
+			t.Errorf("%s still registered", name)
+		}
+	}
+}
+
+// TestDeleteUserNameReused - A new user of the name of a deleted user
+//                             does not get its trash or its revisions
+func TestDeleteUserNameReused(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	updateListing(t, "user1", id, "--price", "90")
+
+	if err := DeleteUser("user1", "user1", ""); err != nil {
+		t.Fatal(err)
+	}
+	register(t, "user1")
+
+	if err := RestoreCSVItem("user1", id); err != ErrOWN {
+		t.Errorf("restore by a new user of the name: %v, want %v", err, ErrOWN)
+	}
+	if _, err := PurgeCSVTrash("user1", id); err != ErrOWN {
+		t.Errorf("purge by a new user of the name: %v, want %v", err, ErrOWN)
+	}
+	if trash := readTrash(); len(trash) != 1 || trash[0].product.Username != deletedUser {
+		t.Errorf("trash = %v, want the listing of %s", trash, deletedUser)
+	}
+	for _, r := range readRevisions(id) {
+		if r.author != deletedUser || r.product.Username != deletedUser {
+			t.Errorf("revision %d by %s of %s, want %s", r.rev, r.author,
+				r.product.Username, deletedUser)
+		}
+	}
+}
+
+func TestReplayRenameUser(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	// A crash after the user row was renamed, before its items were
+	_, err := beginJournal("user1", JournalRenameUser, "user1|seller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = modifyUser("user1", func(u *User) error {
+		u.Username = "seller"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ReplayJournal()
+	if err != nil || n != 1 {
+		t.Fatalf("replayed %d: %v", n, err)
+	}
+	if _, ok := FindUser("seller"); !ok {
+		t.Errorf("renamed user lost on replay")
+	}
+	if p := getListing(t, id); p.Username != "seller" {
+		t.Errorf("listing owner %q after replay, want seller", p.Username)
+	}
+}
+
+func TestReplayDeleteUser(t *testing.T) {
+	resetData(t)
+	register(t, "user1")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	product := getListing(t, id)
+
+	// A crash after the item went to the trash, before it left the store
+	deletedAt := time.Now().Format(timeFormat)
+	_, err := beginJournal("user1", JournalDeleteUser, "user1||"+deletedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = appendTrash(product, deletedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ReplayJournal()
+	if err != nil || n != 1 {
+		t.Fatalf("replayed %d: %v", n, err)
+	}
+	if hasListing(t, id) {
+		t.Errorf("listing kept in the store after replay")
+	}
+	if trash := readTrash(); len(trash) != 1 {
+		t.Errorf("listing trashed %d times, want once", len(trash))
+	}
+	if _, ok := FindUser("user1"); ok {
+		t.Errorf("user kept after replay")
+	}
+}
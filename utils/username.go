@@ -0,0 +1,104 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	usernameMinLen = 3
+	usernameMaxLen = 32
+)
+
+var (
+	ErrRSVD = errors.New("Error - username is reserved")
+	ErrBADN = fmt.Errorf("Error - Invalid username, use %d to %d letters, digits, "+
+		"'_', '-' or '.' starting and ending with a letter or digit",
+		usernameMinLen, usernameMaxLen)
+
+	// reservedNames - Usernames nobody can register, admin is the built in
+	//                 marketplace admin
+	reservedNames = map[string]bool{
+		adminUser:   true,
+		"root":      true,
+		"system":    true,
+		"support":   true,
+		"moderator": true,
+		"nobody":    true,
+		"anonymous": true,
+	}
+)
+
+// canonicalUsername - Normal form of an username: no quotes or surrounding
+//                     spaces, Unicode NFC and lower case
+func canonicalUsername(username string) string {
+	username = strings.TrimSpace(trimQuotes(username))
+
+	return strings.ToLower(norm.NFC.String(username))
+}
+
+// NormalizeUsername - Validate an username against the username grammar
+//                     and return its normal form. Reserved names are refused.
+func NormalizeUsername(username string) (string, error) {
+	username = canonicalUsername(username)
+
+	n := utf8.RuneCountInString(username)
+	if n < usernameMinLen || n > usernameMaxLen {
+		return "", ErrBADN
+	}
+
+	for i, r := range []rune(username) {
+		edge := i == 0 || i == n-1
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+		case !edge && (r == '_' || r == '-' || r == '.'):
+		default:
+			return "", ErrBADN
+		}
+	}
+
+	if reservedNames[username] {
+		return "", ErrRSVD
+	}
+
+	return username, nil
+}
+
+// sameUser - Check if two usernames name the same user
+func sameUser(a string, b string) bool {
+	return canonicalUsername(a) == canonicalUsername(b)
+}
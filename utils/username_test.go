@@ -0,0 +1,94 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"testing"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		want     string
+		err      error
+	}{
+		{"User1", "user1", nil},
+		{"  'john.doe'  ", "john.doe", nil},
+		{"\"jo_hn-1\"", "jo_hn-1", nil},
+		{"José", "josé", nil},
+		{"jo", "", ErrBADN},
+		{"abcdefghijklmnopqrstuvwxyz0123456", "", ErrBADN},
+		{"john doe", "", ErrBADN},
+		{"_john", "", ErrBADN},
+		{"john.", "", ErrBADN},
+		{"jo|hn", "", ErrBADN},
+		{"ADMIN", "", ErrRSVD},
+		{"root", "", ErrRSVD},
+	}
+
+	for _, tt := range tests {
+		got, err := NormalizeUsername(tt.username)
+		if got != tt.want || err != tt.err {
+			t.Errorf("NormalizeUsername(%q) = %q, %v, want %q, %v",
+				tt.username, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSameUser(t *testing.T) {
+	if !sameUser("User1", "'user1'") {
+		t.Errorf("case and quotes name another user")
+	}
+	if !sameUser("josé", "JOSÉ") {
+		t.Errorf("decomposed and composed forms name another user")
+	}
+	if sameUser("user1", "user2") {
+		t.Errorf("user1 and user2 name the same user")
+	}
+}
+
+func TestRegisterNormalizes(t *testing.T) {
+	resetData(t)
+
+	if err := WriteCSVUser("'User1'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteCSVUser("USER1"); err == nil {
+		t.Errorf("same user registered twice")
+	}
+	if err := WriteCSVUser("john doe"); err != ErrBADN {
+		t.Errorf("username with a space: %v, want %v", err, ErrBADN)
+	}
+
+	user, ok := FindUser("user1")
+	if !ok || user.Username != "user1" {
+		t.Errorf("FindUser(user1) = %v, %v", user, ok)
+	}
+}
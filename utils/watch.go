@@ -0,0 +1,270 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// watchDeleted - State of a watched listing that is gone
+	watchDeleted = "deleted"
+)
+
+var (
+	csvWatchPath = "/tmp/watch.csv"
+
+	ErrAWAT = errors.New("Error - listing is already on the watchlist")
+	ErrNWAT = errors.New("Error - listing is not on the watchlist")
+	ErrSWAT = errors.New("Error - cannot watch your own listing")
+)
+
+// watch - A listing on the watchlist of an user and the listing as the
+//         user last saw it, a listing seen deleted has the deleted status
+type watch struct {
+	username  string
+	watchedAt string
+	seen      ProductListing
+}
+
+// readWatches - Read the csv watch file, each row is
+//               username|watched at|item row
+func readWatches() []watch {
+	var watches []watch
+
+	for _, line := range readCSVRows(csvWatchPath) {
+		splEntry := strings.SplitN(line[0], "|", 3)
+		if len(splEntry) != 3 {
+			continue
+		}
+		product, err := parseProduct(splEntry[2])
+		if err != nil {
+			continue
+		}
+		watches = append(watches, watch{username: splEntry[0],
+			watchedAt: splEntry[1], seen: product})
+	}
+
+	return watches
+}
+
+// watchRows - Rows of the csv watch file
+func watchRows(watches []watch) [][]string {
+	var lines [][]string
+	for _, w := range watches {
+		lines = append(lines, []string{w.username + "|" + w.watchedAt + "|" +
+			productRecord(w.seen)})
+	}
+
+	return lines
+}
+
+// watchKey - An user watches a listing once, its rows are told apart by
+//            the username and the listing ID
+func watchKey(row string) string {
+	splEntry := strings.SplitN(row, "|", 4)
+	if len(splEntry) < 3 {
+		return row
+	}
+
+	return splEntry[0] + "|" + splEntry[2]
+}
+
+// writeWatches - Regenerates the csv watch file
+func writeWatches(watches []watch) error {
+	return writeCSVAtomic(csvWatchPath, watchRows(watches))
+}
+
+// WatchCSVItem - Add a listing of another seller to the watchlist of an user
+func WatchCSVItem(username string, id int) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	user, ok := FindUser(username)
+	if !ok {
+		return ErrUNKU
+	}
+	product, err := findProduct(id)
+	if err != nil {
+		return err
+	}
+	if sameUser(product.Username, user.Username) {
+		return ErrSWAT
+	}
+
+	watches := readWatches()
+	for _, w := range watches {
+		if sameUser(w.username, user.Username) && w.seen.Id == id {
+			return ErrAWAT
+		}
+	}
+
+	watches = append(watches, watch{username: user.Username,
+		watchedAt: time.Now().Format(timeFormat), seen: product})
+
+	return saveRows(username, "watches", watchRows(watches))
+}
+
+// UnwatchCSVItem - Remove a listing from the watchlist of an user
+func UnwatchCSVItem(username string, id int) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var kept []watch
+	watches := readWatches()
+	for _, w := range watches {
+		if !sameUser(w.username, username) || w.seen.Id != id {
+			kept = append(kept, w)
+		}
+	}
+	if len(kept) == len(watches) {
+		return ErrNWAT
+	}
+
+	return saveRows(username, "watches", watchRows(kept))
+}
+
+// watchChanges - What changed on a listing since the user saw it
+func watchChanges(seen ProductListing, now ProductListing, gone bool) []string {
+	var changes []string
+
+	if gone {
+		if seen.Status != watchDeleted {
+			changes = append(changes, watchDeleted)
+		}
+		return changes
+	}
+
+	if seen.Status == watchDeleted {
+		changes = append(changes, "restored")
+	}
+	if seen.Price != now.Price {
+		changes = append(changes, fmt.Sprintf("price %s -> %s", seen.Price, now.Price))
+	}
+	if seen.Status != watchDeleted && seen.state() != now.state() {
+		if now.state() == StatusSold {
+			changes = append(changes, StatusSold)
+		} else {
+			changes = append(changes, fmt.Sprintf("status %s -> %s", seen.state(), now.state()))
+		}
+	}
+
+	return changes
+}
+
+// GetCSVWatchlist - Show the watchlist of an user with the state of each
+//                   listing and what changed since the user last looked,
+//                   the listings shown are then marked as seen
+func GetCSVWatchlist(username string, page Page) error {
+	unlock, err := lockData()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !IsUsernameExist(username) {
+		return ErrUNKU
+	}
+
+	watches := readWatches()
+	var mine []int
+	for i, w := range watches {
+		if sameUser(w.username, username) {
+			mine = append(mine, i)
+		}
+	}
+	if len(mine) == 0 {
+		return errors.New("Error - watchlist is empty")
+	}
+
+	store, err := currentStore()
+	if err != nil {
+		return err
+	}
+	start, end, next := page.window(len(mine))
+	for _, i := range mine[start:end] {
+		w := &watches[i]
+		now, ok := store.get(w.seen.Id)
+		changes := watchChanges(w.seen, now, !ok)
+
+		state := watchDeleted
+		if ok {
+			state = now.state()
+			w.seen = now
+		} else {
+			w.seen.Status = watchDeleted
+		}
+
+		if len(changes) == 0 {
+			changes = []string{"-"}
+		}
+		fmt.Println(listingLine(w.seen) + "|" + state + "|" + strings.Join(changes, ","))
+	}
+	page.printNext(next)
+
+	return saveRows(username, "watches", watchRows(watches))
+}
+
+// renameWatches - Move the watchlist of an user to its new name
+func renameWatches(from string, to string) error {
+	watches := readWatches()
+	for i := range watches {
+		if sameUser(watches[i].username, from) {
+			watches[i].username = to
+		}
+	}
+	if len(watches) == 0 {
+		return nil
+	}
+
+	return writeWatches(watches)
+}
+
+// dropWatches - Remove the watchlist of a deleted user
+func dropWatches(username string) error {
+	var kept []watch
+	for _, w := range readWatches() {
+		if !sameUser(w.username, username) {
+			kept = append(kept, w)
+		}
+	}
+
+	return writeWatches(kept)
+}
+
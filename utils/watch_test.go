@@ -0,0 +1,156 @@
+// +build !windows
+
+// SPDX-License-Identifier: BSD-2-Clause
+/*-
+ * Copyright 2019 by Marcelo Araujo <araujo@FreeBSD.org>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted providing that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+// watchlist - Print the watchlist of an user, marking what it shows as seen
+func watchlist(t *testing.T, username string) []string {
+	t.Helper()
+
+	var err error
+	lines := captureOutput(t, func() {
+		err = GetCSVWatchlist(username, Page{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lines
+}
+
+func TestWatchAndUnwatch(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+
+	if err := WatchCSVItem("user3", id); err != ErrUNKU {
+		t.Errorf("watch by an unknown user: %v, want %v", err, ErrUNKU)
+	}
+	if err := WatchCSVItem("user2", id+1); err != ErrLNE {
+		t.Errorf("watch a missing listing: %v, want %v", err, ErrLNE)
+	}
+	if err := WatchCSVItem("user1", id); err != ErrSWAT {
+		t.Errorf("watch your own listing: %v, want %v", err, ErrSWAT)
+	}
+	if err := WatchCSVItem("User2", id); err != nil {
+		t.Fatal(err)
+	}
+	if err := WatchCSVItem("user2", id); err != ErrAWAT {
+		t.Errorf("watch twice: %v, want %v", err, ErrAWAT)
+	}
+	if watches := readWatches(); len(watches) != 1 || watches[0].username != "user2" {
+		t.Errorf("watches = %v", watches)
+	}
+
+	if err := UnwatchCSVItem("user1", id); err != ErrNWAT {
+		t.Errorf("unwatch by another user: %v, want %v", err, ErrNWAT)
+	}
+	if err := UnwatchCSVItem("user2", id); err != nil {
+		t.Fatal(err)
+	}
+	if len(readWatches()) != 0 {
+		t.Errorf("watch kept after unwatch")
+	}
+	if err := GetCSVWatchlist("user2", Page{}); err == nil {
+		t.Errorf("empty watchlist printed")
+	}
+}
+
+func TestWatchlistChanges(t *testing.T) {
+	resetData(t)
+	register(t, "user1", "user2")
+	id := createListing(t, "user1", "Vintage camera", "100", "Electronics")
+	if err := WatchCSVItem("user2", id); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := watchlist(t, "user2"); len(lines) != 1 || !hasLine(lines, "|active|-") {
+		t.Errorf("unchanged watchlist = %q", lines)
+	}
+
+	updateListing(t, "user1", id, "--price", "90")
+	if err := SetCSVItemStatus("user1", id, StatusSold); err != nil {
+		t.Fatal(err)
+	}
+	lines := watchlist(t, "user2")
+	if !hasLine(lines, "|sold|", "price 100.00 SGD -> 90.00 SGD", ",sold") {
+		t.Errorf("changed watchlist = %q", lines)
+	}
+	// The changes were seen
+	if lines := watchlist(t, "user2"); !hasLine(lines, "|sold|-") {
+		t.Errorf("watchlist seen twice = %q", lines)
+	}
+
+	deleteListing(t, "user1", id)
+	if lines := watchlist(t, "user2"); !hasLine(lines, "|deleted|deleted") {
+		t.Errorf("deleted listing = %q", lines)
+	}
+	if err := RestoreCSVItem("user1", id); err != nil {
+		t.Fatal(err)
+	}
+	if lines := watchlist(t, "user2"); !hasLine(lines, "|sold|restored") {
+		t.Errorf("restored listing = %q", lines)
+	}
+}
+
+func TestWatchChanges(t *testing.T) {
+	seen := ProductListing{Status: StatusActive,
+		Price: Money{Amount: 10000, Currency: DefaultCurrency}}
+	cheaper := seen
+	cheaper.Price.Amount = 9000
+	reserved := seen
+	reserved.Status = StatusReserved
+	deleted := seen
+	deleted.Status = watchDeleted
+
+	tests := []struct {
+		seen ProductListing
+		now  ProductListing
+		gone bool
+		want []string
+	}{
+		{seen, seen, false, nil},
+		{seen, cheaper, false, []string{"price 100.00 SGD -> 90.00 SGD"}},
+		{seen, reserved, false, []string{"status active -> reserved"}},
+		{seen, seen, true, []string{watchDeleted}},
+		{deleted, seen, true, nil},
+		{deleted, seen, false, []string{"restored"}},
+	}
+	for _, tt := range tests {
+		if got := watchChanges(tt.seen, tt.now, tt.gone); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("watchChanges(%v, %v, %v) = %q, want %q", tt.seen.Status,
+				tt.now.Status, tt.gone, got, tt.want)
+		}
+	}
+}